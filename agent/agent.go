@@ -3,26 +3,32 @@ package agent
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/quniob/shellm/config"
+	"github.com/quniob/shellm/redact"
 	"github.com/quniob/shellm/tools"
 
 	tea "github.com/charmbracelet/bubbletea"
-	"github.com/openai/openai-go/v2"
-	"github.com/openai/openai-go/v2/option"
 )
 
+// systemPrompt is the built-in prompt; promptContext is appended to it.
 const systemPrompt = `You are a ReAct agent called "SheLLM" whose goal is to help user to control his SSH hosts. You have 10+ years of experience in Linux administration and DevOps.
 
 Loop (strict):
-1) Thought: 1–2 short sentences (high-level, factual, no speculation). State only the immediate next step and the name of the tool you will call. Do NOT invent facts, credentials, or outcomes in the Thought.
-2) Action: call exactly ONE tool with a single JSON argument (the tool invocation will be produced by the assistant).
-3) Observation: process the tool's output and continue the loop.
+1) Thought: 1–2 short sentences (high-level, factual, no speculation). State only the immediate next step and the names of the tools you will call. Do NOT invent facts, credentials, or outcomes in the Thought.
+2) Action: call one tool, or several independent read-only tools, each with a single JSON argument (the tool invocations will be produced by the assistant).
+3) Observation: process the tools' output and continue the loop.
 
 Rules:
-- Use ONLY ONE tool per Action.
+- Several read-only calls that do not depend on each other (e.g. the same check on several hosts) may go in one Action; they may run in parallel.
+- A call that may change a host goes in an Action of its own, and so does any call that needs the result of another.
 - If a tool returns an error or an unknown tool is requested, report it in the Observation and continue.
 - When you want to finish, call the tool named "report" with JSON following its schema; do not output the report in plain text.
 - Keep Thoughts concise and actionable.
@@ -33,111 +39,405 @@ type ThoughtMsg struct{ Content string }
 type ToolCallMsg struct{ Content string }
 type ToolResultMsg struct{ Content string }
 type FinalResultMsg struct{ Content string }
-type TokenUsageMsg struct{ Tokens int }
+type TokenUsageMsg struct {
+	Tokens int
+	Cost   float64
+}
 type ErrMsg struct{ Err error }
 
+// CancelledMsg ends a run that was cancelled or ran out of time; Err holds
+// the cause of the cancellation.
+type CancelledMsg struct{ Err error }
+
 type UsageStats struct {
-	tokenUsage int
+	tokenUsage       int
+	promptTokens     int
+	completionTokens int
+	cachedTokens     int
+	cost             float64
+	byModel          map[string]*ModelUsage
+	steps            []StepUsage
 }
 
 type Agent struct {
 	config        *config.Config
-	client        *openai.Client
-	memory        []openai.ChatCompletionMessageParamUnion
+	targets       []modelTarget
+	current       int
+	memory        []Message
 	toolsRegistry *tools.Registry
+	hosts         *config.Hosts
+	redactor      *redact.Redactor
 	stats         UsageStats
+	statsMu       sync.Mutex
+	ledger        *Ledger
+	dryRun        atomic.Bool
 }
 
-func NewAgent(tr *tools.Registry, cfg *config.Config) *Agent {
-	client := openai.NewClient(
-		option.WithAPIKey(cfg.ApiKey),
-		option.WithBaseURL(cfg.ApiBaseUrl),
-	)
-	memory := make([]openai.ChatCompletionMessageParamUnion, 0)
-	memory = append(memory, openai.SystemMessage(systemPrompt))
-	return &Agent{
+func NewAgent(tr *tools.Registry, cfg *config.Config, hosts *config.Hosts) (*Agent, error) {
+	patterns := cfg.RedactPatterns
+	if cfg.RedactDefaults {
+		patterns = append(append([]string{}, redact.DefaultPatterns...), patterns...)
+	}
+	redactor, err := redact.New(patterns, hosts.SecretValues)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redact pattern: %w", err)
+	}
+
+	targets, err := newModelTargets(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	prompt, err := BuildSystemPrompt(cfg, hosts)
+	if err != nil {
+		return nil, err
+	}
+
+	memory := make([]Message, 0)
+	memory = append(memory, SystemMessage(prompt))
+	a := &Agent{
 		config:        cfg,
 		toolsRegistry: tr,
-		client:        &client,
+		hosts:         hosts,
+		targets:       targets,
 		memory:        memory,
+		redactor:      redactor,
 		stats:         UsageStats{},
+		ledger:        NewLedger(cfg.UsageLedgerPath),
 	}
+	a.dryRun.Store(cfg.DryRun)
+	return a, nil
 }
 
+// SetDryRun switches dry-run mode, in which calls that may change a host are
+// described to the model instead of being made. It takes effect with the next
+// tool call, even during a run.
+func (a *Agent) SetDryRun(on bool) { a.dryRun.Store(on) }
+
+func (a *Agent) DryRun() bool { return a.dryRun.Load() }
+
+// GetStats returns a snapshot of the usage; it is safe to call while the
+// agent is running.
 func (a *Agent) GetStats() UsageStats {
-	return a.stats
+	a.statsMu.Lock()
+	defer a.statsMu.Unlock()
+	return a.stats.clone()
+}
+
+func (s UsageStats) TotalTokens() int {
+	return s.tokenUsage
+}
+
+// Memory returns a copy of the conversation held by the agent.
+func (a *Agent) Memory() []Message {
+	return append([]Message{}, a.memory...)
+}
+
+// Restore replaces the conversation, e.g. when resuming a saved session.
+// Nothing but the system prompt is kept from the current memory if the saved
+// one is empty. Usage starts over from the saved totals.
+func (a *Agent) Restore(memory []Message, tokenUsage int, cost float64) {
+	if len(memory) == 0 {
+		memory = a.memory[:1]
+	}
+	a.memory = append([]Message{}, memory...)
+	a.statsMu.Lock()
+	a.stats = UsageStats{tokenUsage: tokenUsage, cost: cost}
+	a.statsMu.Unlock()
 }
 
-func (a *Agent) completion() (*openai.ChatCompletion, error) {
-	chatCompletion, err := a.client.Chat.Completions.New(context.TODO(), openai.ChatCompletionNewParams{
+// toolset is the set of tools offered to the model during a run, and the
+// name of the tool whose call ends it. A read-only toolset refuses calls that
+// may change a host. A toolset for a plan step carries the step, and calls
+// that may change a host other than its command need the operator's approval.
+type toolset struct {
+	list     []tools.Tool
+	byName   map[string]tools.Tool
+	finish   string
+	readOnly bool
+	step     *PlanStep
+}
+
+// newToolset sorts the tools by name so that requests are stable between
+// iterations, which keeps provider-side prompt caching effective.
+func newToolset(finish string, list ...tools.Tool) toolset {
+	ts := toolset{list: append([]tools.Tool{}, list...), byName: map[string]tools.Tool{}, finish: finish}
+	sort.Slice(ts.list, func(i, j int) bool { return ts.list[i].Name() < ts.list[j].Name() })
+	for _, t := range ts.list {
+		ts.byName[t.Name()] = t
+	}
+	return ts
+}
+
+// completion asks the current model for the next step, moving down the
+// fallback list when it keeps failing. A fallback that answered stays in use
+// until the end of the run.
+func (a *Agent) completion(ctx context.Context, ts toolset, msgCh chan<- tea.Msg) (*Response, error) {
+	req := Request{
 		Messages: a.memory,
-		Model:    a.config.ApiModel,
-		Tools:    a.toolsRegistry.Tools(),
-	})
-	return chatCompletion, err
+		Tools:    ts.list,
+		Stream:   a.config.LLMStream,
+	}
+
+	var err error
+	for i := a.current; i < len(a.targets); i++ {
+		target := a.targets[i]
+		var resp *Response
+		resp, err = a.completeWithRetry(ctx, target, req, msgCh)
+		if err == nil {
+			model := resp.Model
+			if model == "" {
+				model = target.model
+			}
+			a.current = i
+			a.recordUsage(target.model, resp.Usage)
+			msgCh <- ModelMsg{Provider: target.providerName, Model: model, Fallback: i > 0}
+			return resp, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		if i+1 < len(a.targets) {
+			msgCh <- FallbackMsg{From: target.String(), To: a.targets[i+1].String(), Err: err}
+		}
+	}
+	return nil, err
+}
+
+var errMaxIterations = errors.New("max iterations reached")
+
+// budgetError stops a run when a spending cap is reached.
+type budgetError struct{ BudgetMsg }
+
+func (e budgetError) Error() string { return e.BudgetMsg.String() }
+
+// begin prepares the agent for a new run started by the operator.
+func (a *Agent) begin(userMessage string) float64 {
+	if err := a.refreshSystemPrompt(); err != nil {
+		log.Printf("system prompt: %v", err)
+	}
+	a.memory = append(a.memory, UserMessage(userMessage))
+	a.current = 0
+	return a.GetStats().Cost()
 }
 
 func (a *Agent) Start(ctx context.Context, userMessage string, msgCh chan<- tea.Msg) {
-	a.memory = append(a.memory, openai.UserMessage(userMessage))
+	runStart := a.begin(userMessage)
+	final, _, err := a.run(ctx, a.defaultTools(), runStart, msgCh)
+	if err != nil {
+		a.fail(ctx, err, msgCh)
+		return
+	}
+	msgCh <- FinalResultMsg{Content: final}
+}
+
+func (a *Agent) defaultTools() toolset {
+	return newToolset("report", a.toolsRegistry.List()...)
+}
 
+// run drives the ReAct loop until the model calls the finishing tool of the
+// toolset, and returns that tool's result and call.
+func (a *Agent) run(ctx context.Context, ts toolset, runStart float64, msgCh chan<- tea.Msg) (string, ToolCall, error) {
 	for iter := 0; iter < a.config.LLMMaxIterations; iter++ {
-		completion, err := a.completion()
+		if ctx.Err() != nil {
+			return "", ToolCall{}, ctx.Err()
+		}
+		if budget, over := a.overBudget(runStart); over {
+			return "", ToolCall{}, budgetError{budget}
+		}
+
+		a.compactMemory(ctx, msgCh)
+
+		completion, err := a.completion(ctx, ts, msgCh)
 		if err != nil {
 			log.Printf("completion error: %v", err)
-			msgCh <- ErrMsg{Err: err}
-			return
+			return "", ToolCall{}, err
 		}
-		if completion == nil || len(completion.Choices) == 0 {
-			log.Println("empty completion / no choices")
-			msgCh <- ErrMsg{Err: fmt.Errorf("empty completion")}
-			return
+		if completion == nil {
+			log.Println("empty completion")
+			return "", ToolCall{}, fmt.Errorf("empty completion")
 		}
 
-		a.stats.tokenUsage += int(completion.Usage.TotalTokens)
-		msgCh <- TokenUsageMsg{Tokens: a.stats.tokenUsage}
+		stats := a.GetStats()
+		msgCh <- TokenUsageMsg{Tokens: stats.TotalTokens(), Cost: stats.Cost()}
 
-		choice := completion.Choices[0]
-		assistantMsg := choice.Message
+		assistantMsg := completion.Message
 
 		if assistantMsg.Content != "" || len(assistantMsg.ToolCalls) > 0 {
 			msgCh <- ThoughtMsg{Content: assistantMsg.Content}
-			a.memory = append(a.memory, openai.AssistantMessage(assistantMsg.Content))
+			a.memory = append(a.memory, assistantMsg)
 		}
 
 		if len(assistantMsg.ToolCalls) > 0 {
-			toolCall := assistantMsg.ToolCalls[0]
-			toolName := toolCall.Function.Name
-			toolArgs := toolCall.Function.Arguments
-
-			msgCh <- ToolCallMsg{Content: fmt.Sprintf("%s(%s)", toolName, toolArgs)}
-
-			tool, ok := a.toolsRegistry.Get(toolName)
-			if !ok {
-				errMsg := fmt.Sprintf("unknown tool: %s", toolName)
-				a.memory = append(a.memory, openai.ToolMessage(errMsg, toolCall.ID))
-				msgCh <- ToolResultMsg{Content: errMsg}
-				continue
+			results := a.runToolCalls(ctx, ts, assistantMsg.ToolCalls, msgCh)
+
+			final, finalCall, reported := "", ToolCall{}, false
+			for i, toolCall := range assistantMsg.ToolCalls {
+				a.memory = append(a.memory, ToolMessage(results[i].content, toolCall.ID))
+				if results[i].final {
+					final, finalCall, reported = results[i].content, toolCall, true
+				}
 			}
 
-			resp, err := tool.Call(ctx, json.RawMessage(toolArgs))
-			if err != nil {
-				errMsg := fmt.Sprintf("tool error: %v", err)
-				a.memory = append(a.memory, openai.ToolMessage(errMsg, toolCall.ID))
-				msgCh <- ToolResultMsg{Content: errMsg}
-				continue
+			if reported {
+				a.memory = append(a.memory, AssistantMessage(final))
+				return final, finalCall, nil
 			}
+			continue
+		}
+	}
+
+	return "", ToolCall{}, errMaxIterations
+}
+
+// fail ends a run that did not reach its finishing tool with the terminal
+// event matching the reason.
+func (a *Agent) fail(ctx context.Context, err error, msgCh chan<- tea.Msg) {
+	var budget budgetError
+	switch {
+	case ctx.Err() != nil:
+		a.cancelled(ctx, msgCh)
+	case errors.As(err, &budget):
+		msgCh <- budget.BudgetMsg
+		msgCh <- FinalResultMsg{Content: "stopped: " + budget.String()}
+	case errors.Is(err, errMaxIterations):
+		msgCh <- FinalResultMsg{Content: "failed: max iterations reached"}
+	default:
+		msgCh <- ErrMsg{Err: err}
+	}
+}
+
+// cancelled ends a run whose context is done. Tool calls always have their
+// results in memory by now, so only a closing note is added: it tells the
+// model on the next turn that the previous request was abandoned.
+func (a *Agent) cancelled(ctx context.Context, msgCh chan<- tea.Msg) {
+	note := "The previous request was cancelled by the operator before it finished."
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		note = "The previous request timed out before it finished."
+	}
+	a.memory = append(a.memory, AssistantMessage(note))
+	msgCh <- CancelledMsg{Err: context.Cause(ctx)}
+}
+
+type toolResult struct {
+	content string
+	final   bool
+}
+
+func (a *Agent) isMutating(ts toolset, toolCall ToolCall) bool {
+	tool, ok := ts.byName[toolCall.Name]
+	if !ok {
+		return false
+	}
+	return tools.IsMutating(tool, json.RawMessage(toolCall.Arguments))
+}
+
+// dryRunSkips reports whether a call is only previewed in dry-run mode: any
+// call that may change a host is, and so is a command classified as
+// read-only by the command policy unless dry_run_read_only is set.
+func (a *Agent) dryRunSkips(ts toolset, toolCall ToolCall) bool {
+	if !a.DryRun() || toolCall.Name == ts.finish {
+		return false
+	}
+	if a.isMutating(ts, toolCall) {
+		return true
+	}
+	_, runsCommand := ts.byName[toolCall.Name].(tools.ExecuteCommand)
+	return runsCommand && !a.config.DryRunReadOnly
+}
+
+// outsideStep reports whether a call during a plan step may change a host
+// without being the command approved with the plan.
+func (a *Agent) outsideStep(ts toolset, toolCall ToolCall) bool {
+	if ts.step == nil || toolCall.Name == ts.finish || !a.isMutating(ts, toolCall) {
+		return false
+	}
+	if _, runsCommand := ts.byName[toolCall.Name].(tools.ExecuteCommand); !runsCommand || ts.step.Command == "" {
+		return true
+	}
+	var args tools.ExecuteCommandArgs
+	if err := json.Unmarshal([]byte(toolCall.Arguments), &args); err != nil {
+		return true
+	}
+	if ts.step.Host != "" && args.HostID != ts.step.Host {
+		return true
+	}
+	return strings.TrimSpace(args.Command) != strings.TrimSpace(ts.step.Command)
+}
+
+func (a *Agent) callTool(ctx context.Context, ts toolset, toolCall ToolCall, msgCh chan<- tea.Msg) toolResult {
+	toolName := toolCall.Name
+
+	tool, ok := ts.byName[toolName]
+	if !ok {
+		return toolResult{content: fmt.Sprintf("unknown tool: %s", toolName)}
+	}
+
+	if ts.readOnly && toolName != ts.finish && a.isMutating(ts, toolCall) {
+		return toolResult{content: "not executed: planning mode only allows read-only calls"}
+	}
 
-			msgCh <- ToolResultMsg{Content: resp}
-			a.memory = append(a.memory, openai.ToolMessage(resp, toolCall.ID))
+	if a.dryRunSkips(ts, toolCall) {
+		preview := tools.Preview(tool, json.RawMessage(toolCall.Arguments))
+		return toolResult{content: a.redactor.Redact("dry run: " + preview + ". Nothing was executed; continue as if it succeeded.")}
+	}
+
+	needsApproval := tools.NeedsApproval(tool, json.RawMessage(toolCall.Arguments)) || a.outsideStep(ts, toolCall)
+	if needsApproval && !a.approve(ctx, tool, toolCall, msgCh) {
+		if ctx.Err() != nil {
+			return toolResult{content: "not executed: the run was cancelled"}
+		}
+		return toolResult{content: "not executed: the operator declined this call. Do not retry it; say what it would have done."}
+	}
+
+	resp, err := tool.Call(ctx, json.RawMessage(toolCall.Arguments))
+	if err != nil {
+		return toolResult{content: a.redactor.Redact(fmt.Sprintf("tool error: %v", err))}
+	}
 
-			if toolName == "report" {
-				msgCh <- FinalResultMsg{Content: resp}
-				a.memory = append(a.memory, openai.AssistantMessage(resp))
-				return
+	return toolResult{content: a.redactor.Redact(resp), final: toolName == ts.finish}
+}
+
+// runToolCalls executes every tool call of an assistant message and returns
+// the observations in call order. Consecutive read-only calls run concurrently
+// when parallel tool calls are enabled; a call that may change a host always
+// runs on its own, after everything requested before it.
+func (a *Agent) runToolCalls(ctx context.Context, ts toolset, toolCalls []ToolCall, msgCh chan<- tea.Msg) []toolResult {
+	results := make([]toolResult, len(toolCalls))
+
+	for start := 0; start < len(toolCalls); {
+		if ctx.Err() != nil {
+			// Nothing is started after a cancellation, but every call still
+			// gets a result so the memory stays valid for the API.
+			for i := start; i < len(toolCalls); i++ {
+				results[i] = toolResult{content: "not executed: the run was cancelled"}
 			}
-			continue
+			break
+		}
+
+		end := start + 1
+		if a.config.ParallelTools && !a.isMutating(ts, toolCalls[start]) {
+			for end < len(toolCalls) && !a.isMutating(ts, toolCalls[end]) {
+				end++
+			}
+		}
+
+		var wg sync.WaitGroup
+		for i := start; i < end; i++ {
+			msgCh <- ToolCallMsg{Content: fmt.Sprintf("%s(%s)", toolCalls[i].Name, toolCalls[i].Arguments)}
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				results[i] = a.callTool(ctx, ts, toolCalls[i], msgCh)
+			}(i)
+		}
+		wg.Wait()
+
+		for i := start; i < end; i++ {
+			msgCh <- ToolResultMsg{Content: results[i].content}
 		}
+		start = end
 	}
 
-	msgCh <- FinalResultMsg{Content: "failed: max iterations reached"}
+	return results
 }
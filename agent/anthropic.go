@@ -0,0 +1,332 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/quniob/shellm/tools"
+)
+
+const (
+	defaultAnthropicBaseURL = "https://api.anthropic.com"
+	anthropicVersion        = "2023-06-01"
+)
+
+// AnthropicProvider talks to the native Anthropic Messages API.
+type AnthropicProvider struct {
+	apiKey    string
+	baseURL   string
+	maxTokens int
+	client    *http.Client
+}
+
+func NewAnthropicProvider(apiKey, baseURL string, maxTokens int) *AnthropicProvider {
+	if baseURL == "" {
+		baseURL = defaultAnthropicBaseURL
+	}
+	if maxTokens <= 0 {
+		maxTokens = 4096
+	}
+	return &AnthropicProvider{
+		apiKey:    apiKey,
+		baseURL:   strings.TrimRight(baseURL, "/"),
+		maxTokens: maxTokens,
+		client:    &http.Client{},
+	}
+}
+
+type anthropicBlock struct {
+	Type      string          `json:"type"`
+	Text      string          `json:"text,omitempty"`
+	ID        string          `json:"id,omitempty"`
+	Name      string          `json:"name,omitempty"`
+	Input     json.RawMessage `json:"input,omitempty"`
+	ToolUseID string          `json:"tool_use_id,omitempty"`
+	Content   string          `json:"content,omitempty"`
+}
+
+type anthropicMessage struct {
+	Role    string           `json:"role"`
+	Content []anthropicBlock `json:"content"`
+}
+
+type anthropicTool struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description"`
+	InputSchema map[string]any `json:"input_schema"`
+}
+
+type anthropicRequest struct {
+	Model     string             `json:"model"`
+	MaxTokens int                `json:"max_tokens"`
+	System    string             `json:"system,omitempty"`
+	Messages  []anthropicMessage `json:"messages"`
+	Tools     []anthropicTool    `json:"tools,omitempty"`
+	Stream    bool               `json:"stream,omitempty"`
+}
+
+type anthropicUsage struct {
+	InputTokens          int `json:"input_tokens"`
+	OutputTokens         int `json:"output_tokens"`
+	CacheReadInputTokens int `json:"cache_read_input_tokens"`
+}
+
+type anthropicResponse struct {
+	Model   string           `json:"model"`
+	Content []anthropicBlock `json:"content"`
+	Usage   anthropicUsage   `json:"usage"`
+}
+
+// anthropicMessages converts the conversation to the Messages API layout:
+// system messages move to the system parameter, tool results become
+// tool_result blocks of a user turn, and consecutive turns of the same role
+// are merged because the API expects user and assistant to alternate.
+func anthropicMessages(messages []Message) (string, []anthropicMessage) {
+	var system []string
+	var out []anthropicMessage
+
+	push := func(role string, blocks ...anthropicBlock) {
+		if n := len(out); n > 0 && out[n-1].Role == role {
+			out[n-1].Content = append(out[n-1].Content, blocks...)
+			return
+		}
+		out = append(out, anthropicMessage{Role: role, Content: blocks})
+	}
+
+	for _, m := range messages {
+		switch m.Role {
+		case RoleSystem:
+			system = append(system, m.Content)
+		case RoleUser:
+			push("user", anthropicBlock{Type: "text", Text: m.Content})
+		case RoleTool:
+			push("user", anthropicBlock{Type: "tool_result", ToolUseID: m.ToolCallID, Content: m.Content})
+		case RoleAssistant:
+			var blocks []anthropicBlock
+			if m.Content != "" {
+				blocks = append(blocks, anthropicBlock{Type: "text", Text: m.Content})
+			}
+			for _, tc := range m.ToolCalls {
+				input := json.RawMessage(tc.Arguments)
+				if !json.Valid(input) {
+					input = json.RawMessage("{}")
+				}
+				blocks = append(blocks, anthropicBlock{Type: "tool_use", ID: tc.ID, Name: tc.Name, Input: input})
+			}
+			if len(blocks) > 0 {
+				push("assistant", blocks...)
+			}
+		}
+	}
+
+	return strings.Join(system, "\n\n"), out
+}
+
+func anthropicTools(list []tools.Tool) []anthropicTool {
+	out := make([]anthropicTool, 0, len(list))
+	for _, t := range list {
+		out = append(out, anthropicTool{Name: t.Name(), Description: t.Description(), InputSchema: t.Schema()})
+	}
+	return out
+}
+
+func (r anthropicResponse) response() *Response {
+	msg := Message{Role: RoleAssistant}
+	var text []string
+	for _, block := range r.Content {
+		switch block.Type {
+		case "text":
+			text = append(text, block.Text)
+		case "tool_use":
+			args := string(block.Input)
+			if args == "" {
+				args = "{}"
+			}
+			msg.ToolCalls = append(msg.ToolCalls, ToolCall{ID: block.ID, Name: block.Name, Arguments: args})
+		}
+	}
+	msg.Content = strings.Join(text, "")
+
+	return &Response{
+		Message: msg,
+		Usage: Usage{
+			PromptTokens:     r.Usage.InputTokens + r.Usage.CacheReadInputTokens,
+			CompletionTokens: r.Usage.OutputTokens,
+			CachedTokens:     r.Usage.CacheReadInputTokens,
+			TotalTokens:      r.Usage.InputTokens + r.Usage.CacheReadInputTokens + r.Usage.OutputTokens,
+		},
+		Model: r.Model,
+	}
+}
+
+func (p *AnthropicProvider) Complete(ctx context.Context, req Request, onDelta func(Delta)) (*Response, error) {
+	system, messages := anthropicMessages(req.Messages)
+	body, err := json.Marshal(anthropicRequest{
+		Model:     req.Model,
+		MaxTokens: p.maxTokens,
+		System:    system,
+		Messages:  messages,
+		Tools:     anthropicTools(req.Tools),
+		Stream:    req.Stream,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, p.baseURL+"/v1/messages", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("X-Api-Key", p.apiKey)
+	httpReq.Header.Set("Anthropic-Version", anthropicVersion)
+
+	resp, err := p.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, anthropicError(resp)
+	}
+
+	if !req.Stream {
+		var out anthropicResponse
+		if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+			return nil, fmt.Errorf("anthropic: decoding response: %w", err)
+		}
+		return out.response(), nil
+	}
+
+	return p.readStream(resp.Body, onDelta)
+}
+
+func anthropicError(resp *http.Response) error {
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	e := &APIError{
+		Provider:   "anthropic",
+		StatusCode: resp.StatusCode,
+		Message:    strings.TrimSpace(string(data)),
+		RetryAfter: parseRetryAfter(resp.Header),
+	}
+	var body struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(data, &body) == nil && body.Error.Message != "" {
+		e.Message = body.Error.Message
+	}
+	return e
+}
+
+// anthropicStreamStatus maps the error type of a mid-stream error event to
+// the HTTP status the same error would have had before streaming started.
+func anthropicStreamStatus(errType string) int {
+	switch errType {
+	case "overloaded_error":
+		return 529
+	case "rate_limit_error":
+		return http.StatusTooManyRequests
+	case "invalid_request_error":
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+type anthropicStreamEvent struct {
+	Type         string             `json:"type"`
+	Index        int                `json:"index"`
+	Message      anthropicResponse  `json:"message"`
+	ContentBlock anthropicBlock     `json:"content_block"`
+	Usage        anthropicUsage     `json:"usage"`
+	Delta        anthropicBlockDiff `json:"delta"`
+	Error        struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+type anthropicBlockDiff struct {
+	Type        string `json:"type"`
+	Text        string `json:"text"`
+	PartialJSON string `json:"partial_json"`
+}
+
+// readStream consumes the server-sent events of a streamed message and
+// rebuilds the final message from its content blocks.
+func (p *AnthropicProvider) readStream(body io.Reader, onDelta func(Delta)) (*Response, error) {
+	var (
+		out    anthropicResponse
+		blocks = map[int]*anthropicBlock{}
+		inputs = map[int]*strings.Builder{}
+		order  []int
+	)
+
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 64<<10), 4<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+
+		var ev anthropicStreamEvent
+		if err := json.Unmarshal([]byte(strings.TrimSpace(strings.TrimPrefix(line, "data:"))), &ev); err != nil {
+			return nil, fmt.Errorf("anthropic: decoding stream event: %w", err)
+		}
+
+		switch ev.Type {
+		case "message_start":
+			out.Model = ev.Message.Model
+			out.Usage = ev.Message.Usage
+		case "content_block_start":
+			block := ev.ContentBlock
+			block.Input = nil
+			blocks[ev.Index] = &block
+			inputs[ev.Index] = &strings.Builder{}
+			order = append(order, ev.Index)
+		case "content_block_delta":
+			block, ok := blocks[ev.Index]
+			if !ok {
+				continue
+			}
+			switch ev.Delta.Type {
+			case "text_delta":
+				block.Text += ev.Delta.Text
+				if onDelta != nil {
+					onDelta(Delta{Text: ev.Delta.Text})
+				}
+			case "input_json_delta":
+				inputs[ev.Index].WriteString(ev.Delta.PartialJSON)
+				if onDelta != nil {
+					onDelta(Delta{ToolName: block.Name, ToolArguments: inputs[ev.Index].String()})
+				}
+			}
+		case "message_delta":
+			out.Usage.OutputTokens = ev.Usage.OutputTokens
+		case "error":
+			return nil, &APIError{Provider: "anthropic", StatusCode: anthropicStreamStatus(ev.Error.Type), Message: ev.Error.Message}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, i := range order {
+		block := blocks[i]
+		if block.Type == "tool_use" {
+			block.Input = json.RawMessage(inputs[i].String())
+		}
+		out.Content = append(out.Content, *block)
+	}
+	return out.response(), nil
+}
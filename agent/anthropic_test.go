@@ -0,0 +1,197 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/quniob/shellm/tools"
+)
+
+// anthropicFake serves /v1/messages with the given handler and records the
+// last request body.
+func anthropicFake(t *testing.T, handler func(w http.ResponseWriter, req anthropicRequest)) (*AnthropicProvider, *http.Header) {
+	t.Helper()
+	var header http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/messages" {
+			http.NotFound(w, r)
+			return
+		}
+		header = r.Header.Clone()
+		var req anthropicRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decoding request: %v", err)
+		}
+		handler(w, req)
+	}))
+	t.Cleanup(srv.Close)
+	return NewAnthropicProvider("key", srv.URL+"/", 1000), &header
+}
+
+func TestAnthropicComplete(t *testing.T) {
+	var got anthropicRequest
+	p, header := anthropicFake(t, func(w http.ResponseWriter, req anthropicRequest) {
+		got = req
+		fmt.Fprint(w, `{"model":"claude-test","content":[
+			{"type":"text","text":"Checking."},
+			{"type":"tool_use","id":"tu_2","name":"submit_plan","input":{"summary":"s"}}
+		],"usage":{"input_tokens":10,"cache_read_input_tokens":5,"output_tokens":3}}`)
+	})
+
+	resp, err := p.Complete(context.Background(), Request{
+		Model: "claude-test",
+		Messages: []Message{
+			SystemMessage("be careful"),
+			UserMessage("check disks"),
+			{Role: RoleAssistant, Content: "Looking.", ToolCalls: []ToolCall{
+				{ID: "tu_1a", Name: "ping", Arguments: `{"target":"a"}`},
+				{ID: "tu_1b", Name: "ping", Arguments: `not json`},
+			}},
+			ToolMessage("a is up", "tu_1a"),
+			ToolMessage("b is up", "tu_1b"),
+			UserMessage("and memory?"),
+		},
+		Tools: []tools.Tool{submitPlan{}},
+	}, nil)
+	if err != nil {
+		t.Fatalf("Complete() error = %v", err)
+	}
+
+	if header.Get("X-Api-Key") != "key" || header.Get("Anthropic-Version") != anthropicVersion {
+		t.Errorf("headers = %v", *header)
+	}
+	if got.System != "be careful" || got.Model != "claude-test" || got.MaxTokens != 1000 {
+		t.Errorf("system, model, max_tokens = %q, %q, %d", got.System, got.Model, got.MaxTokens)
+	}
+	if len(got.Tools) != 1 || got.Tools[0].Name != "submit_plan" || got.Tools[0].InputSchema == nil {
+		t.Errorf("tools = %+v", got.Tools)
+	}
+	want := []anthropicMessage{
+		{Role: "user", Content: []anthropicBlock{{Type: "text", Text: "check disks"}}},
+		{Role: "assistant", Content: []anthropicBlock{
+			{Type: "text", Text: "Looking."},
+			{Type: "tool_use", ID: "tu_1a", Name: "ping", Input: json.RawMessage(`{"target":"a"}`)},
+			{Type: "tool_use", ID: "tu_1b", Name: "ping", Input: json.RawMessage(`{}`)},
+		}},
+		{Role: "user", Content: []anthropicBlock{
+			{Type: "tool_result", ToolUseID: "tu_1a", Content: "a is up"},
+			{Type: "tool_result", ToolUseID: "tu_1b", Content: "b is up"},
+			{Type: "text", Text: "and memory?"},
+		}},
+	}
+	if !reflect.DeepEqual(got.Messages, want) {
+		t.Errorf("messages =\n%+v\nwant\n%+v", got.Messages, want)
+	}
+
+	wantMsg := Message{Role: RoleAssistant, Content: "Checking.", ToolCalls: []ToolCall{{ID: "tu_2", Name: "submit_plan", Arguments: `{"summary":"s"}`}}}
+	if !reflect.DeepEqual(resp.Message, wantMsg) {
+		t.Errorf("message = %+v, want %+v", resp.Message, wantMsg)
+	}
+	if resp.Model != "claude-test" || resp.Usage != (Usage{PromptTokens: 15, CompletionTokens: 3, CachedTokens: 5, TotalTokens: 18}) {
+		t.Errorf("model, usage = %q, %+v", resp.Model, resp.Usage)
+	}
+}
+
+func TestAnthropicStream(t *testing.T) {
+	events := []string{
+		`{"type":"message_start","message":{"model":"claude-test","usage":{"input_tokens":7,"output_tokens":1}}}`,
+		`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Writing "}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"report."}}`,
+		`{"type":"content_block_start","index":1,"content_block":{"type":"tool_use","id":"tu_1","name":"report","input":{}}}`,
+		`{"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"{\"text\": \"all "}}`,
+		`{"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"good\"}"}}`,
+		`{"type":"content_block_stop","index":1}`,
+		`{"type":"message_delta","usage":{"output_tokens":12}}`,
+		`{"type":"message_stop"}`,
+	}
+	var stream bool
+	p, _ := anthropicFake(t, func(w http.ResponseWriter, req anthropicRequest) {
+		stream = req.Stream
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, ev := range events {
+			fmt.Fprintf(w, "event: x\ndata: %s\n\n", ev)
+		}
+	})
+
+	var deltas []Delta
+	resp, err := p.Complete(context.Background(), Request{Messages: []Message{UserMessage("hi")}, Stream: true}, func(d Delta) {
+		deltas = append(deltas, d)
+	})
+	if err != nil {
+		t.Fatalf("Complete() error = %v", err)
+	}
+	if !stream {
+		t.Error("request did not ask for a stream")
+	}
+
+	wantDeltas := []Delta{
+		{Text: "Writing "},
+		{Text: "report."},
+		{ToolName: "report", ToolArguments: `{"text": "all `},
+		{ToolName: "report", ToolArguments: `{"text": "all good"}`},
+	}
+	if !reflect.DeepEqual(deltas, wantDeltas) {
+		t.Errorf("deltas = %+v, want %+v", deltas, wantDeltas)
+	}
+	wantMsg := Message{Role: RoleAssistant, Content: "Writing report.", ToolCalls: []ToolCall{{ID: "tu_1", Name: "report", Arguments: `{"text": "all good"}`}}}
+	if !reflect.DeepEqual(resp.Message, wantMsg) {
+		t.Errorf("message = %+v, want %+v", resp.Message, wantMsg)
+	}
+	if resp.Usage.PromptTokens != 7 || resp.Usage.CompletionTokens != 12 {
+		t.Errorf("usage = %+v", resp.Usage)
+	}
+}
+
+func TestAnthropicErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler func(w http.ResponseWriter, req anthropicRequest)
+		want    APIError
+	}{
+		{
+			name: "rate limit with retry-after",
+			handler: func(w http.ResponseWriter, _ anthropicRequest) {
+				w.Header().Set("Retry-After", "7")
+				w.WriteHeader(http.StatusTooManyRequests)
+				fmt.Fprint(w, `{"type":"error","error":{"type":"rate_limit_error","message":"slow down"}}`)
+			},
+			want: APIError{Provider: "anthropic", StatusCode: http.StatusTooManyRequests, Message: "slow down", RetryAfter: 7 * time.Second},
+		},
+		{
+			name: "plain text body",
+			handler: func(w http.ResponseWriter, _ anthropicRequest) {
+				http.Error(w, "bad gateway", http.StatusBadGateway)
+			},
+			want: APIError{Provider: "anthropic", StatusCode: http.StatusBadGateway, Message: "bad gateway"},
+		},
+		{
+			name: "error event mid-stream",
+			handler: func(w http.ResponseWriter, _ anthropicRequest) {
+				fmt.Fprint(w, "data: {\"type\":\"message_start\",\"message\":{\"model\":\"m\"}}\n\n")
+				fmt.Fprint(w, "data: {\"type\":\"error\",\"error\":{\"type\":\"overloaded_error\",\"message\":\"Overloaded\"}}\n\n")
+			},
+			want: APIError{Provider: "anthropic", StatusCode: 529, Message: "Overloaded"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, _ := anthropicFake(t, tt.handler)
+			_, err := p.Complete(context.Background(), Request{Messages: []Message{UserMessage("hi")}, Stream: true}, nil)
+			var apiErr *APIError
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("Complete() error = %v, want an APIError", err)
+			}
+			if *apiErr != tt.want {
+				t.Errorf("error = %+v, want %+v", *apiErr, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,35 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/quniob/shellm/tools"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// ApprovalRequestMsg asks the operator whether a call may be made. The call
+// waits until true or false is sent on Reply, which never blocks, or until
+// the run is cancelled.
+type ApprovalRequestMsg struct {
+	Tool    string
+	Preview string
+	Reply   chan<- bool
+}
+
+// approve asks the operator about a call that needs approval.
+func (a *Agent) approve(ctx context.Context, tool tools.Tool, toolCall ToolCall, msgCh chan<- tea.Msg) bool {
+	reply := make(chan bool, 1)
+	msgCh <- ApprovalRequestMsg{
+		Tool:    toolCall.Name,
+		Preview: tools.Preview(tool, json.RawMessage(toolCall.Arguments)),
+		Reply:   reply,
+	}
+	select {
+	case ok := <-reply:
+		return ok
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,180 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// ContextCompactedMsg reports that older messages were shrunk to keep the
+// conversation within the token budget.
+type ContextCompactedMsg struct {
+	Before     int
+	After      int
+	Summarized bool
+}
+
+const (
+	droppedToolOutput = "[tool output dropped to save context]"
+	summaryPrefix     = "Summary of the earlier conversation:\n"
+)
+
+const summaryPrompt = `Summarize the conversation below between an operator and a Linux administration agent.
+Keep every fact that may matter later: host IDs, commands that were run and their outcome, errors, decisions and open questions.
+Be concise and use plain bullet points.`
+
+// estimateTokens approximates the token count of a message from its JSON
+// size. Roughly four bytes per token holds well enough for budget purposes
+// across tokenizers, plus a small per-message overhead.
+func estimateTokens(m Message) int {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return 0
+	}
+	return len(b)/4 + 4
+}
+
+func estimateTotal(memory []Message) int {
+	total := 0
+	for _, m := range memory {
+		total += estimateTokens(m)
+	}
+	return total
+}
+
+// messageText renders a message as plain text for the summarization prompt.
+func messageText(m Message) string {
+	switch m.Role {
+	case RoleSystem:
+		return "system: " + m.Content
+	case RoleUser:
+		return "operator: " + m.Content
+	case RoleAssistant:
+		var b strings.Builder
+		b.WriteString("agent: " + m.Content)
+		for _, tc := range m.ToolCalls {
+			fmt.Fprintf(&b, "\n  call %s(%s)", tc.Name, tc.Arguments)
+		}
+		return b.String()
+	case RoleTool:
+		return "tool result: " + m.Content
+	default:
+		return ""
+	}
+}
+
+// lastUserIndex returns the index of the message that opened the current
+// exchange, or 0 when there is none.
+func lastUserIndex(memory []Message) int {
+	for i := len(memory) - 1; i > 0; i-- {
+		if memory[i].Role == RoleUser {
+			return i
+		}
+	}
+	return 0
+}
+
+// compactMemory keeps the memory within the configured token budget. The
+// system prompt and the current exchange are always kept. Tool outputs of
+// earlier turns are dropped first; if that is not enough, earlier turns are
+// summarized with an extra LLM call, or removed outright when summarization is
+// disabled or fails. Outputs of the current exchange go last.
+func (a *Agent) compactMemory(ctx context.Context, msgCh chan<- tea.Msg) {
+	budget := a.config.ContextMaxTokens
+	if budget <= 0 {
+		return
+	}
+
+	before := estimateTotal(a.memory)
+	if before <= budget {
+		return
+	}
+
+	current := lastUserIndex(a.memory)
+	summarized := false
+
+	total := a.dropToolOutputs(1, current, before, budget)
+
+	if total > budget && current > 1 && a.config.ContextStrategy == "summarize" {
+		if summary, err := a.summarize(ctx, a.memory[1:current]); err == nil {
+			compacted := append([]Message{a.memory[0], UserMessage(summaryPrefix + summary)}, a.memory[current:]...)
+			a.memory = compacted
+			current = 2
+			summarized = true
+			total = estimateTotal(a.memory)
+		}
+	}
+
+	// Remove whole turns, oldest first, so that no tool message loses the
+	// assistant message that requested it.
+	for total > budget && current > 1 {
+		next := current
+		for i := 2; i < current; i++ {
+			if a.memory[i].Role == RoleUser {
+				next = i
+				break
+			}
+		}
+		a.memory = append(a.memory[:1], a.memory[next:]...)
+		current -= next - 1
+		total = estimateTotal(a.memory)
+	}
+
+	// Only then give up outputs of the current exchange that the model has
+	// already reacted to. Those after the last assistant message are kept.
+	fresh := len(a.memory)
+	for fresh > 0 && a.memory[fresh-1].Role == RoleTool {
+		fresh--
+	}
+	total = a.dropToolOutputs(current, fresh, total, budget)
+
+	msgCh <- ContextCompactedMsg{Before: before, After: total, Summarized: summarized}
+}
+
+// dropToolOutputs replaces tool outputs in memory[from:to] with a placeholder,
+// oldest first, until the total fits the budget, and returns the new total.
+func (a *Agent) dropToolOutputs(from, to, total, budget int) int {
+	for i := from; i < to && total > budget; i++ {
+		tool := a.memory[i]
+		if tool.Role != RoleTool || tool.Content == droppedToolOutput {
+			continue
+		}
+		replacement := ToolMessage(droppedToolOutput, tool.ToolCallID)
+		total += estimateTokens(replacement) - estimateTokens(tool)
+		a.memory[i] = replacement
+	}
+	return total
+}
+
+func (a *Agent) summarize(ctx context.Context, messages []Message) (string, error) {
+	var transcript strings.Builder
+	for _, m := range messages {
+		transcript.WriteString(messageText(m))
+		transcript.WriteString("\n")
+	}
+
+	model := a.config.ContextSummaryModel
+	if model == "" {
+		model = a.config.ApiModel
+	}
+
+	completion, err := a.targets[0].provider.Complete(ctx, Request{
+		Model: model,
+		Messages: []Message{
+			SystemMessage(summaryPrompt),
+			UserMessage(transcript.String()),
+		},
+	}, nil)
+	if err != nil {
+		return "", err
+	}
+	if completion.Message.Content == "" {
+		return "", fmt.Errorf("empty summary")
+	}
+
+	a.recordUsage(model, completion.Usage)
+	return completion.Message.Content, nil
+}
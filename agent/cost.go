@@ -0,0 +1,254 @@
+package agent
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/quniob/shellm/config"
+)
+
+// maxStepHistory bounds how many per-step records UsageStats keeps.
+const maxStepHistory = 200
+
+// BudgetMsg is sent when a spending cap stops the agent.
+type BudgetMsg struct {
+	Scope string
+	Limit float64
+	Spent float64
+}
+
+// StepUsage is the usage of one model call.
+type StepUsage struct {
+	Time  time.Time
+	Model string
+	Usage Usage
+	Cost  float64
+}
+
+// ModelUsage sums the usage of one model.
+type ModelUsage struct {
+	Model string
+	Calls int
+	Usage Usage
+	Cost  float64
+}
+
+// price returns the configured price of a model, if any.
+func price(prices []config.ModelPrice, model string) (config.ModelPrice, bool) {
+	for _, p := range prices {
+		if p.Model == model {
+			return p, true
+		}
+	}
+	return config.ModelPrice{}, false
+}
+
+// cost computes the price of a call in dollars. Prices are per million
+// tokens; cached prompt tokens use the cached price when one is set.
+func cost(p config.ModelPrice, u Usage) float64 {
+	cachedPrice := p.CachedInput
+	if cachedPrice == 0 {
+		cachedPrice = p.Input
+	}
+	uncached := u.PromptTokens - u.CachedTokens
+	return (float64(uncached)*p.Input + float64(u.CachedTokens)*cachedPrice + float64(u.CompletionTokens)*p.Output) / 1e6
+}
+
+// record adds a model call to the stats.
+func (s *UsageStats) record(step StepUsage) {
+	s.tokenUsage += step.Usage.TotalTokens
+	s.promptTokens += step.Usage.PromptTokens
+	s.completionTokens += step.Usage.CompletionTokens
+	s.cachedTokens += step.Usage.CachedTokens
+	s.cost += step.Cost
+
+	if s.byModel == nil {
+		s.byModel = map[string]*ModelUsage{}
+	}
+	m, ok := s.byModel[step.Model]
+	if !ok {
+		m = &ModelUsage{Model: step.Model}
+		s.byModel[step.Model] = m
+	}
+	m.Calls++
+	m.Usage.PromptTokens += step.Usage.PromptTokens
+	m.Usage.CompletionTokens += step.Usage.CompletionTokens
+	m.Usage.CachedTokens += step.Usage.CachedTokens
+	m.Usage.TotalTokens += step.Usage.TotalTokens
+	m.Cost += step.Cost
+
+	s.steps = append(s.steps, step)
+	if len(s.steps) > maxStepHistory {
+		s.steps = s.steps[len(s.steps)-maxStepHistory:]
+	}
+}
+
+func (s UsageStats) clone() UsageStats {
+	c := s
+	c.byModel = make(map[string]*ModelUsage, len(s.byModel))
+	for k, m := range s.byModel {
+		mu := *m
+		c.byModel[k] = &mu
+	}
+	c.steps = append([]StepUsage{}, s.steps...)
+	return c
+}
+
+func (s UsageStats) PromptTokens() int     { return s.promptTokens }
+func (s UsageStats) CompletionTokens() int { return s.completionTokens }
+func (s UsageStats) CachedTokens() int     { return s.cachedTokens }
+
+// Cost is the spending of the session so far, in dollars.
+func (s UsageStats) Cost() float64 { return s.cost }
+
+// ByModel returns the usage per model, most expensive first.
+func (s UsageStats) ByModel() []ModelUsage {
+	out := make([]ModelUsage, 0, len(s.byModel))
+	for _, m := range s.byModel {
+		out = append(out, *m)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Cost != out[j].Cost {
+			return out[i].Cost > out[j].Cost
+		}
+		return out[i].Usage.TotalTokens > out[j].Usage.TotalTokens
+	})
+	return out
+}
+
+// Steps returns the most recent model calls, oldest first.
+func (s UsageStats) Steps() []StepUsage {
+	return append([]StepUsage{}, s.steps...)
+}
+
+// Ledger is an append-only record of model spending, one JSON line per call,
+// used to enforce the daily budget across runs and sessions.
+type Ledger struct {
+	path string
+	mu   sync.Mutex
+}
+
+type ledgerEntry struct {
+	Time   time.Time `json:"time"`
+	Model  string    `json:"model"`
+	Tokens int       `json:"tokens"`
+	Cost   float64   `json:"cost"`
+}
+
+func NewLedger(path string) *Ledger {
+	return &Ledger{path: path}
+}
+
+func (l *Ledger) Add(step StepUsage) error {
+	if l == nil || l.path == "" {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(l.path), 0o700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	data, err := json.Marshal(ledgerEntry{Time: step.Time, Model: step.Model, Tokens: step.Usage.TotalTokens, Cost: step.Cost})
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
+
+// Today returns what was spent since local midnight.
+func (l *Ledger) Today() (float64, error) {
+	if l == nil || l.path == "" {
+		return 0, nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	f, err := os.Open(l.path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	now := time.Now()
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+
+	var total float64
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e ledgerEntry
+		if json.Unmarshal(scanner.Bytes(), &e) != nil {
+			continue
+		}
+		if !e.Time.Before(midnight) {
+			total += e.Cost
+		}
+	}
+	return total, scanner.Err()
+}
+
+// recordUsage accounts for a model call in the stats and the ledger.
+func (a *Agent) recordUsage(model string, usage Usage) StepUsage {
+	step := StepUsage{Time: time.Now(), Model: model, Usage: usage}
+	if p, ok := price(a.config.Prices, model); ok {
+		step.Cost = cost(p, usage)
+	}
+	a.statsMu.Lock()
+	a.stats.record(step)
+	a.statsMu.Unlock()
+	if step.Cost > 0 {
+		if err := a.ledger.Add(step); err != nil {
+			log.Printf("usage ledger: %v", err)
+		}
+	}
+	return step
+}
+
+// overBudget checks the run, session and daily caps, returning the first one
+// that has been reached.
+func (a *Agent) overBudget(runStart float64) (BudgetMsg, bool) {
+	spent := a.GetStats().Cost()
+	if limit := a.config.BudgetRun; limit > 0 && spent-runStart >= limit {
+		return BudgetMsg{Scope: "run", Limit: limit, Spent: spent - runStart}, true
+	}
+	if limit := a.config.BudgetSession; limit > 0 && spent >= limit {
+		return BudgetMsg{Scope: "session", Limit: limit, Spent: spent}, true
+	}
+	if limit := a.config.BudgetDay; limit > 0 {
+		today, err := a.ledger.Today()
+		if err != nil {
+			log.Printf("usage ledger: %v", err)
+		}
+		if today >= limit {
+			return BudgetMsg{Scope: "day", Limit: limit, Spent: today}, true
+		}
+	}
+	return BudgetMsg{}, false
+}
+
+// SpentToday returns the spending recorded in the ledger since midnight.
+func (a *Agent) SpentToday() (float64, error) {
+	return a.ledger.Today()
+}
+
+func (m BudgetMsg) String() string {
+	return fmt.Sprintf("%s budget of $%s reached ($%.4f spent)", m.Scope, strconv.FormatFloat(m.Limit, 'f', -1, 64), m.Spent)
+}
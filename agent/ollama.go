@@ -0,0 +1,217 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/quniob/shellm/tools"
+)
+
+const defaultOllamaBaseURL = "http://localhost:11434"
+
+// OllamaProvider talks to the native Ollama chat API, which needs no API key
+// and streams newline-delimited JSON rather than server-sent events.
+type OllamaProvider struct {
+	baseURL   string
+	maxTokens int
+	client    *http.Client
+}
+
+func NewOllamaProvider(baseURL string, maxTokens int) *OllamaProvider {
+	if baseURL == "" {
+		baseURL = defaultOllamaBaseURL
+	}
+	return &OllamaProvider{
+		baseURL:   strings.TrimRight(baseURL, "/"),
+		maxTokens: maxTokens,
+		client:    &http.Client{},
+	}
+}
+
+type ollamaFunction struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Parameters  map[string]any  `json:"parameters,omitempty"`
+	Arguments   json.RawMessage `json:"arguments,omitempty"`
+}
+
+type ollamaToolCall struct {
+	Function ollamaFunction `json:"function"`
+}
+
+type ollamaTool struct {
+	Type     string         `json:"type"`
+	Function ollamaFunction `json:"function"`
+}
+
+type ollamaMessage struct {
+	Role      string           `json:"role"`
+	Content   string           `json:"content"`
+	ToolCalls []ollamaToolCall `json:"tool_calls,omitempty"`
+	ToolName  string           `json:"tool_name,omitempty"`
+}
+
+type ollamaRequest struct {
+	Model    string          `json:"model"`
+	Messages []ollamaMessage `json:"messages"`
+	Tools    []ollamaTool    `json:"tools,omitempty"`
+	Stream   bool            `json:"stream"`
+	Options  map[string]any  `json:"options,omitempty"`
+}
+
+type ollamaResponse struct {
+	Model           string        `json:"model"`
+	Message         ollamaMessage `json:"message"`
+	Done            bool          `json:"done"`
+	PromptEvalCount int           `json:"prompt_eval_count"`
+	EvalCount       int           `json:"eval_count"`
+	Error           string        `json:"error"`
+}
+
+// ollamaMessages converts the conversation to the Ollama layout. Tool calls
+// carry no IDs there, so tool results are matched by tool name instead.
+func ollamaMessages(messages []Message) []ollamaMessage {
+	names := map[string]string{}
+	out := make([]ollamaMessage, 0, len(messages))
+	for _, m := range messages {
+		msg := ollamaMessage{Role: string(m.Role), Content: m.Content}
+		for _, tc := range m.ToolCalls {
+			names[tc.ID] = tc.Name
+			args := json.RawMessage(tc.Arguments)
+			if !json.Valid(args) {
+				args = json.RawMessage("{}")
+			}
+			msg.ToolCalls = append(msg.ToolCalls, ollamaToolCall{Function: ollamaFunction{Name: tc.Name, Arguments: args}})
+		}
+		if m.Role == RoleTool {
+			msg.ToolName = names[m.ToolCallID]
+		}
+		out = append(out, msg)
+	}
+	return out
+}
+
+func ollamaTools(list []tools.Tool) []ollamaTool {
+	out := make([]ollamaTool, 0, len(list))
+	for _, t := range list {
+		out = append(out, ollamaTool{
+			Type:     "function",
+			Function: ollamaFunction{Name: t.Name(), Description: t.Description(), Parameters: t.Schema()},
+		})
+	}
+	return out
+}
+
+func (p *OllamaProvider) Complete(ctx context.Context, req Request, onDelta func(Delta)) (*Response, error) {
+	body := ollamaRequest{
+		Model:    req.Model,
+		Messages: ollamaMessages(req.Messages),
+		Tools:    ollamaTools(req.Tools),
+		Stream:   req.Stream,
+	}
+	if p.maxTokens > 0 {
+		body.Options = map[string]any{"num_predict": p.maxTokens}
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, p.baseURL+"/api/chat", bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, ollamaError(resp)
+	}
+
+	var (
+		out     = Response{Message: Message{Role: RoleAssistant}}
+		content strings.Builder
+	)
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64<<10), 4<<20)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		var chunk ollamaResponse
+		if err := json.Unmarshal(line, &chunk); err != nil {
+			return nil, fmt.Errorf("ollama: decoding response: %w", err)
+		}
+		if chunk.Error != "" {
+			return nil, &APIError{Provider: "ollama", StatusCode: http.StatusInternalServerError, Message: chunk.Error}
+		}
+
+		if chunk.Model != "" {
+			out.Model = chunk.Model
+		}
+		if chunk.Message.Content != "" {
+			content.WriteString(chunk.Message.Content)
+			if onDelta != nil {
+				onDelta(Delta{Text: chunk.Message.Content})
+			}
+		}
+		for _, tc := range chunk.Message.ToolCalls {
+			args := string(tc.Function.Arguments)
+			if args == "" || args == "null" {
+				args = "{}"
+			}
+			out.Message.ToolCalls = append(out.Message.ToolCalls, ToolCall{
+				ID:        fmt.Sprintf("call_%d", len(out.Message.ToolCalls)),
+				Name:      tc.Function.Name,
+				Arguments: args,
+			})
+			if onDelta != nil {
+				onDelta(Delta{ToolName: tc.Function.Name, ToolArguments: args})
+			}
+		}
+		if chunk.Done {
+			out.Usage = Usage{
+				PromptTokens:     chunk.PromptEvalCount,
+				CompletionTokens: chunk.EvalCount,
+				TotalTokens:      chunk.PromptEvalCount + chunk.EvalCount,
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	out.Message.Content = content.String()
+	return &out, nil
+}
+
+func ollamaError(resp *http.Response) error {
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	e := &APIError{
+		Provider:   "ollama",
+		StatusCode: resp.StatusCode,
+		Message:    strings.TrimSpace(string(data)),
+		RetryAfter: parseRetryAfter(resp.Header),
+	}
+	var body struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(data, &body) == nil && body.Error != "" {
+		e.Message = body.Error
+	}
+	return e
+}
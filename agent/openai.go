@@ -0,0 +1,238 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/quniob/shellm/tools"
+
+	"github.com/openai/openai-go/v2"
+	"github.com/openai/openai-go/v2/option"
+)
+
+const defaultOpenAIBaseURL = "https://openrouter.ai/api/v1"
+
+// OpenAIProvider talks to the OpenAI Chat Completions API or any server that
+// implements it, such as OpenRouter.
+type OpenAIProvider struct {
+	client *openai.Client
+}
+
+func NewOpenAIProvider(apiKey, baseURL string) *OpenAIProvider {
+	if baseURL == "" {
+		baseURL = defaultOpenAIBaseURL
+	}
+	client := openai.NewClient(
+		option.WithAPIKey(apiKey),
+		option.WithBaseURL(baseURL),
+		// Retries and fallbacks are handled by the agent.
+		option.WithMaxRetries(0),
+	)
+	return &OpenAIProvider{client: &client}
+}
+
+func openAITools(list []tools.Tool) []openai.ChatCompletionToolUnionParam {
+	out := make([]openai.ChatCompletionToolUnionParam, 0, len(list))
+	for _, t := range list {
+		out = append(out, openai.ChatCompletionToolUnionParam{
+			OfFunction: &openai.ChatCompletionFunctionToolParam{
+				Function: openai.FunctionDefinitionParam{
+					Name:        t.Name(),
+					Description: openai.String(t.Description()),
+					Parameters:  t.Schema(),
+				},
+			},
+		})
+	}
+	return out
+}
+
+func openAIMessages(messages []Message) []openai.ChatCompletionMessageParamUnion {
+	out := make([]openai.ChatCompletionMessageParamUnion, 0, len(messages))
+	for _, m := range messages {
+		switch m.Role {
+		case RoleSystem:
+			out = append(out, openai.SystemMessage(m.Content))
+		case RoleUser:
+			out = append(out, openai.UserMessage(m.Content))
+		case RoleTool:
+			out = append(out, openai.ToolMessage(m.Content, m.ToolCallID))
+		case RoleAssistant:
+			msg := openai.ChatCompletionAssistantMessageParam{}
+			if m.Content != "" {
+				msg.Content.OfString = openai.String(m.Content)
+			}
+			for _, tc := range m.ToolCalls {
+				msg.ToolCalls = append(msg.ToolCalls, openai.ChatCompletionMessageToolCallUnionParam{
+					OfFunction: &openai.ChatCompletionMessageFunctionToolCallParam{
+						ID: tc.ID,
+						Function: openai.ChatCompletionMessageFunctionToolCallFunctionParam{
+							Name:      tc.Name,
+							Arguments: tc.Arguments,
+						},
+					},
+				})
+			}
+			out = append(out, openai.ChatCompletionMessageParamUnion{OfAssistant: &msg})
+		}
+	}
+	return out
+}
+
+func openAIError(err error) error {
+	var apiErr *openai.Error
+	if !errors.As(err, &apiErr) {
+		return err
+	}
+	e := &APIError{Provider: "openai", StatusCode: apiErr.StatusCode, Message: apiErr.Message}
+	if e.Message == "" {
+		e.Message = apiErr.RawJSON()
+	}
+	if apiErr.Response != nil {
+		e.RetryAfter = parseRetryAfter(apiErr.Response.Header)
+	}
+	return e
+}
+
+func (p *OpenAIProvider) Complete(ctx context.Context, req Request, onDelta func(Delta)) (*Response, error) {
+	params := openai.ChatCompletionNewParams{
+		Messages: openAIMessages(req.Messages),
+		Model:    req.Model,
+	}
+	if len(req.Tools) > 0 {
+		params.Tools = openAITools(req.Tools)
+	}
+
+	if !req.Stream {
+		completion, err := p.client.Chat.Completions.New(ctx, params)
+		if err != nil {
+			return nil, openAIError(err)
+		}
+		if len(completion.Choices) == 0 {
+			return nil, errors.New("empty completion")
+		}
+		msg := completion.Choices[0].Message
+		resp := &Response{
+			Message: Message{Role: RoleAssistant, Content: msg.Content},
+			Usage: Usage{
+				PromptTokens:     int(completion.Usage.PromptTokens),
+				CompletionTokens: int(completion.Usage.CompletionTokens),
+				CachedTokens:     int(completion.Usage.PromptTokensDetails.CachedTokens),
+				TotalTokens:      int(completion.Usage.TotalTokens),
+			},
+			Model: completion.Model,
+		}
+		for _, tc := range msg.ToolCalls {
+			resp.Message.ToolCalls = append(resp.Message.ToolCalls, ToolCall{ID: tc.ID, Name: tc.Function.Name, Arguments: tc.Function.Arguments})
+		}
+		return resp, nil
+	}
+
+	params.StreamOptions = openai.ChatCompletionStreamOptionsParam{IncludeUsage: openai.Bool(true)}
+	stream := p.client.Chat.Completions.NewStreaming(ctx, params)
+	defer stream.Close()
+
+	acc := newStreamAccumulator()
+	for stream.Next() {
+		acc.add(stream.Current(), onDelta)
+	}
+	if err := stream.Err(); err != nil {
+		return nil, openAIError(err)
+	}
+	return acc.response(), nil
+}
+
+type streamedToolCall struct {
+	id        string
+	name      string
+	arguments strings.Builder
+}
+
+// streamAccumulator assembles a streamed Chat Completions turn. Tool call deltas are
+// keyed by their index, except that a delta carrying a new call ID at an index
+// that is already taken starts a new call: some OpenAI-compatible servers
+// send every call with index 0.
+type streamAccumulator struct {
+	content   strings.Builder
+	toolCalls []*streamedToolCall
+	slots     map[int64]int
+	usage     openai.CompletionUsage
+	model     string
+}
+
+func newStreamAccumulator() *streamAccumulator {
+	return &streamAccumulator{slots: map[int64]int{}}
+}
+
+func (s *streamAccumulator) addToolCallDelta(d openai.ChatCompletionChunkChoiceDeltaToolCall) *streamedToolCall {
+	slot, ok := s.slots[d.Index]
+	if !ok || (d.ID != "" && s.toolCalls[slot].id != "" && s.toolCalls[slot].id != d.ID) {
+		s.toolCalls = append(s.toolCalls, &streamedToolCall{})
+		slot = len(s.toolCalls) - 1
+		s.slots[d.Index] = slot
+	}
+
+	tc := s.toolCalls[slot]
+	if d.ID != "" {
+		tc.id = d.ID
+	}
+	tc.name += d.Function.Name
+	tc.arguments.WriteString(d.Function.Arguments)
+	return tc
+}
+
+// add folds a chunk into the accumulated turn and forwards the visible
+// deltas to onDelta.
+func (s *streamAccumulator) add(chunk openai.ChatCompletionChunk, onDelta func(Delta)) {
+	if chunk.Model != "" {
+		s.model = chunk.Model
+	}
+	if chunk.Usage.TotalTokens > 0 {
+		s.usage = chunk.Usage
+	}
+	if len(chunk.Choices) == 0 {
+		return
+	}
+
+	delta := chunk.Choices[0].Delta
+	if delta.Content != "" {
+		s.content.WriteString(delta.Content)
+		if onDelta != nil {
+			onDelta(Delta{Text: delta.Content})
+		}
+	}
+	for _, d := range delta.ToolCalls {
+		tc := s.addToolCallDelta(d)
+		if onDelta != nil && d.Function.Arguments != "" {
+			onDelta(Delta{ToolName: tc.name, ToolArguments: tc.arguments.String()})
+		}
+	}
+}
+
+func (s *streamAccumulator) response() *Response {
+	msg := Message{Role: RoleAssistant, Content: s.content.String()}
+	for i, tc := range s.toolCalls {
+		id := tc.id
+		if id == "" {
+			id = fmt.Sprintf("call_%d", i)
+		}
+		args := tc.arguments.String()
+		if args == "" {
+			args = "{}"
+		}
+		msg.ToolCalls = append(msg.ToolCalls, ToolCall{ID: id, Name: tc.name, Arguments: args})
+	}
+
+	return &Response{
+		Message: msg,
+		Usage: Usage{
+			PromptTokens:     int(s.usage.PromptTokens),
+			CompletionTokens: int(s.usage.CompletionTokens),
+			CachedTokens:     int(s.usage.PromptTokensDetails.CachedTokens),
+			TotalTokens:      int(s.usage.TotalTokens),
+		},
+		Model: s.model,
+	}
+}
@@ -0,0 +1,236 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/quniob/shellm/tools"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+type StepStatus string
+
+const (
+	StepPending StepStatus = ""
+	StepRunning StepStatus = "running"
+	StepDone    StepStatus = "done"
+	StepFailed  StepStatus = "failed"
+	StepSkipped StepStatus = "skipped"
+)
+
+// PlanStep is one action of a plan. Skip is set by the operator to strike
+// the step before the plan is executed.
+type PlanStep struct {
+	Description string     `json:"description"`
+	Host        string     `json:"host,omitempty"`
+	Command     string     `json:"command,omitempty"`
+	Expected    string     `json:"expected,omitempty"`
+	Skip        bool       `json:"skip,omitempty"`
+	Status      StepStatus `json:"status,omitempty"`
+	Result      string     `json:"result,omitempty"`
+}
+
+type Plan struct {
+	Summary string     `json:"summary"`
+	Steps   []PlanStep `json:"steps"`
+}
+
+// PlanMsg ends a planning run with the plan proposed by the model.
+type PlanMsg struct{ Plan Plan }
+
+// PlanStepMsg reports the progress of a step while a plan is executed.
+type PlanStepMsg struct {
+	Index int
+	Step  PlanStep
+}
+
+// Markdown renders the plan as a checklist.
+func (p Plan) Markdown() string {
+	var b strings.Builder
+	if p.Summary != "" {
+		b.WriteString(p.Summary + "\n\n")
+	}
+	for i, step := range p.Steps {
+		mark := "[ ]"
+		switch {
+		case step.Skip || step.Status == StepSkipped:
+			mark = "[-]"
+		case step.Status == StepDone:
+			mark = "[x]"
+		case step.Status == StepFailed:
+			mark = "[!]"
+		case step.Status == StepRunning:
+			mark = "[~]"
+		}
+		fmt.Fprintf(&b, "%s %d. %s", mark, i+1, step.Description)
+		if step.Host != "" {
+			fmt.Fprintf(&b, " on %s", step.Host)
+		}
+		if step.Command != "" {
+			fmt.Fprintf(&b, ": `%s`", step.Command)
+		}
+		if step.Expected != "" {
+			fmt.Fprintf(&b, " (expect: %s)", step.Expected)
+		}
+		b.WriteString("\n")
+	}
+	return strings.TrimRight(b.String(), "\n")
+}
+
+// submitPlan is the finishing tool of a planning run.
+type submitPlan struct{}
+
+func (submitPlan) Name() string                  { return "submit_plan" }
+func (submitPlan) Mutating(json.RawMessage) bool { return false }
+func (submitPlan) Description() string {
+	return "Submits the plan for the task to the operator for review. Nothing is executed; the operator approves, edits or rejects the plan."
+}
+func (submitPlan) Schema() map[string]any {
+	return map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"summary": map[string]any{"type": "string", "description": "what the plan achieves and its main risks"},
+			"steps": map[string]any{
+				"type": "array",
+				"items": map[string]any{
+					"type": "object",
+					"properties": map[string]any{
+						"description": map[string]any{"type": "string"},
+						"host":        map[string]any{"type": "string", "description": "inventory host ID"},
+						"command":     map[string]any{"type": "string", "description": "exact command to run, if any"},
+						"expected":    map[string]any{"type": "string", "description": "expected outcome used to judge the step"},
+					},
+					"required": []string{"description"},
+				},
+			},
+		},
+		"required": []string{"summary", "steps"},
+	}
+}
+
+func (submitPlan) Call(ctx context.Context, raw json.RawMessage) (string, error) {
+	plan, err := parsePlan(raw)
+	if err != nil {
+		return "", err
+	}
+	return "Plan submitted for review:\n" + plan.Markdown(), nil
+}
+
+func parsePlan(raw json.RawMessage) (Plan, error) {
+	var plan Plan
+	if err := json.Unmarshal(raw, &plan); err != nil {
+		return plan, err
+	}
+	if len(plan.Steps) == 0 {
+		return plan, errors.New("the plan has no steps")
+	}
+	for i := range plan.Steps {
+		plan.Steps[i].Skip, plan.Steps[i].Status, plan.Steps[i].Result = false, StepPending, ""
+	}
+	return plan, nil
+}
+
+const planInstructions = `Plan the following task without changing anything. You may use read-only tools to inspect hosts. When done, call submit_plan with ordered steps, each naming the host, the exact command and the expected outcome. The operator will review the plan before anything is executed.
+
+Task: `
+
+// Plan asks the model for a plan for the task. Every tool is offered, but only
+// calls classified as read-only are executed, and the run ends with a PlanMsg
+// instead of a final answer.
+func (a *Agent) Plan(ctx context.Context, task string, msgCh chan<- tea.Msg) {
+	runStart := a.begin(planInstructions + task)
+
+	list := []tools.Tool{submitPlan{}}
+	for _, t := range a.toolsRegistry.List() {
+		if t.Name() != "report" {
+			list = append(list, t)
+		}
+	}
+	ts := newToolset("submit_plan", list...)
+	ts.readOnly = true
+
+	_, call, err := a.run(ctx, ts, runStart, msgCh)
+	if err != nil {
+		a.fail(ctx, err, msgCh)
+		return
+	}
+	plan, err := parsePlan(json.RawMessage(call.Arguments))
+	if err != nil {
+		msgCh <- ErrMsg{Err: fmt.Errorf("invalid plan: %w", err)}
+		return
+	}
+	msgCh <- PlanMsg{Plan: plan}
+}
+
+// ExecutePlan runs the approved steps of a plan one at a time, each as its
+// own run that ends with a report, and stops at the first failed step. Calls
+// that may change a host other than the step's command are sent to the
+// operator for approval.
+func (a *Agent) ExecutePlan(ctx context.Context, plan Plan, msgCh chan<- tea.Msg) {
+	var runStart float64
+	started, failed := false, false
+	for i := range plan.Steps {
+		step := &plan.Steps[i]
+		if step.Skip || failed {
+			step.Status = StepSkipped
+			msgCh <- PlanStepMsg{Index: i, Step: *step}
+			continue
+		}
+
+		step.Status = StepRunning
+		msgCh <- PlanStepMsg{Index: i, Step: *step}
+
+		instructions := stepInstructions(i, len(plan.Steps), *step)
+		if !started {
+			runStart = a.begin("The operator approved this plan; it is executed one step at a time:\n" + plan.Markdown() + "\n\n" + instructions)
+			started = true
+		} else {
+			a.memory = append(a.memory, UserMessage(instructions))
+		}
+		ts := a.defaultTools()
+		ts.step = step
+		result, _, err := a.run(ctx, ts, runStart, msgCh)
+		if err != nil {
+			step.Status, step.Result = StepFailed, err.Error()
+			msgCh <- PlanStepMsg{Index: i, Step: *step}
+			for j := i + 1; j < len(plan.Steps); j++ {
+				plan.Steps[j].Status = StepSkipped
+				msgCh <- PlanStepMsg{Index: j, Step: plan.Steps[j]}
+			}
+			a.fail(ctx, err, msgCh)
+			return
+		}
+
+		step.Status, step.Result = StepDone, result
+		if strings.HasPrefix(strings.ToUpper(strings.TrimSpace(result)), "FAILED") {
+			step.Status, failed = StepFailed, true
+		}
+		msgCh <- PlanStepMsg{Index: i, Step: *step}
+	}
+
+	summary := "Plan executed:\n\n" + plan.Markdown()
+	if failed {
+		summary = "Plan stopped at a failed step:\n\n" + plan.Markdown()
+	}
+	msgCh <- FinalResultMsg{Content: summary}
+}
+
+func stepInstructions(i, n int, step PlanStep) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Execute step %d of %d only: %s", i+1, n, step.Description)
+	if step.Host != "" {
+		fmt.Fprintf(&b, "\nHost: %s", step.Host)
+	}
+	if step.Command != "" {
+		fmt.Fprintf(&b, "\nCommand: %s", step.Command)
+	}
+	if step.Expected != "" {
+		fmt.Fprintf(&b, "\nExpected: %s", step.Expected)
+	}
+	b.WriteString("\nThen call report with the outcome, starting with DONE if it matches the expectation or FAILED otherwise.")
+	return b.String()
+}
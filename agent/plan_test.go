@@ -0,0 +1,34 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/quniob/shellm/tools"
+)
+
+func TestOutsideStep(t *testing.T) {
+	a := &Agent{}
+	ts := newToolset("report", tools.NewDefaultRegistry(nil).List()...)
+	ts.step = &PlanStep{Host: "web1", Command: "systemctl restart nginx"}
+	tests := []struct {
+		name string
+		call ToolCall
+		want bool
+	}{
+		{"step command", ToolCall{Name: "execute_command", Arguments: `{"host_id": "web1", "command": " systemctl restart nginx"}`}, false},
+		{"read-only command", ToolCall{Name: "execute_command", Arguments: `{"host_id": "web1", "command": "systemctl status nginx"}`}, false},
+		{"other command", ToolCall{Name: "execute_command", Arguments: `{"host_id": "web1", "command": "systemctl stop nginx"}`}, true},
+		{"other host", ToolCall{Name: "execute_command", Arguments: `{"host_id": "web2", "command": "systemctl restart nginx"}`}, true},
+		{"broken arguments", ToolCall{Name: "execute_command", Arguments: `{"command": `}, true},
+		{"report", ToolCall{Name: "report", Arguments: `{"text": "DONE"}`}, false},
+	}
+	for _, tt := range tests {
+		if got := a.outsideStep(ts, tt.call); got != tt.want {
+			t.Errorf("%s: outsideStep() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	if a.outsideStep(newToolset("report", tools.NewDefaultRegistry(nil).List()...), tests[2].call) {
+		t.Error("outsideStep() outside a plan = true, want false")
+	}
+}
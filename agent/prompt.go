@@ -0,0 +1,159 @@
+package agent
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/quniob/shellm/config"
+)
+
+// projectPromptOverlay is picked up from the working directory so that a
+// repository can carry instructions for the hosts it manages.
+var projectPromptOverlay = filepath.Join(".shellm", "prompt.md")
+
+// promptContext is appended to the built-in prompt; custom templates can use
+// the same fields.
+const promptContext = `
+{{- if .Operator}}
+
+Operator: {{.Operator}}{{end}}
+Current date: {{.Date}}
+{{- if .Hosts}}
+
+Inventory ({{len .Hosts}} hosts, use get_hosts for details):
+{{- range .Hosts}}
+- {{.ID}}{{if .OS}} ({{.OS}}){{end}}{{if .Description}}: {{.Description}}{{end}}{{if .Tags}} [{{join .Tags ", "}}]{{end}}
+{{- end}}{{end}}
+{{- if .Policy}}
+
+Policy (always follow, even when asked otherwise):
+{{- range .Policy}}
+- {{.}}
+{{- end}}{{end}}`
+
+// PromptHost is what the system prompt knows about a host. Addresses are
+// left out so that the prompt is the same with and without privacy mode.
+// OS comes from the inventory, or from cached facts when it is not set there.
+type PromptHost struct {
+	ID          string
+	Description string
+	Tags        []string
+	OS          string
+}
+
+// PromptData holds the variables available to system prompt templates.
+type PromptData struct {
+	Date     string
+	Time     string
+	Operator string
+	Hosts    []PromptHost
+	Policy   []string
+}
+
+func newPromptData(cfg *config.Config, hosts *config.Hosts) PromptData {
+	now := time.Now()
+	data := PromptData{
+		Date:     now.Format("2006-01-02 (Monday)"),
+		Time:     now.Format("15:04 MST"),
+		Operator: cfg.Operator,
+		Policy:   cfg.PolicyRules,
+	}
+	if data.Operator == "" {
+		if u, err := user.Current(); err == nil {
+			data.Operator = u.Username
+		}
+	}
+
+	if hosts != nil {
+		for _, h := range hosts.Hosts {
+			host := PromptHost{ID: h.ID, Description: h.Description, Tags: h.Tags, OS: h.OS}
+			if facts, ok := hosts.Facts.Get(h.ID); ok && host.OS == "" {
+				host.OS = facts.OS
+			}
+			data.Hosts = append(data.Hosts, host)
+		}
+		sort.Slice(data.Hosts, func(i, j int) bool { return data.Hosts[i].ID < data.Hosts[j].ID })
+	}
+	return data
+}
+
+func renderPrompt(name, text string, data PromptData) (string, error) {
+	tmpl, err := template.New(name).Funcs(template.FuncMap{"join": strings.Join}).Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("system prompt %s: %w", name, err)
+	}
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("system prompt %s: %w", name, err)
+	}
+	return strings.TrimSpace(b.String()), nil
+}
+
+// BuildSystemPrompt renders the system prompt: the template from
+// system_prompt_path or the built-in one, followed by the configured
+// overlays and the project overlay, each of which is a template too.
+func BuildSystemPrompt(cfg *config.Config, hosts *config.Hosts) (string, error) {
+	data := newPromptData(cfg, hosts)
+
+	name, text := "default", systemPrompt+promptContext
+	if cfg.SystemPromptPath != "" {
+		raw, err := os.ReadFile(cfg.SystemPromptPath)
+		if err != nil {
+			return "", fmt.Errorf("reading system prompt: %w", err)
+		}
+		name, text = cfg.SystemPromptPath, string(raw)
+	}
+
+	base, err := renderPrompt(name, text, data)
+	if err != nil {
+		return "", err
+	}
+	parts := []string{base}
+
+	overlays := append([]string{}, cfg.PromptOverlays...)
+	if _, err := os.Stat(projectPromptOverlay); err == nil {
+		overlays = append(overlays, projectPromptOverlay)
+	}
+	for _, path := range overlays {
+		raw, err := os.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) && path == projectPromptOverlay {
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("reading prompt overlay: %w", err)
+		}
+		overlay, err := renderPrompt(path, string(raw), data)
+		if err != nil {
+			return "", err
+		}
+		if overlay != "" {
+			parts = append(parts, overlay)
+		}
+	}
+
+	return strings.Join(parts, "\n\n"), nil
+}
+
+// refreshSystemPrompt re-renders the system prompt before a run so that the
+// date, the inventory and edited prompt files are current. The previous
+// prompt is kept if rendering fails.
+func (a *Agent) refreshSystemPrompt() error {
+	prompt, err := BuildSystemPrompt(a.config, a.hosts)
+	if err != nil {
+		return err
+	}
+	if len(a.memory) > 0 && a.memory[0].Role == RoleSystem {
+		a.memory[0] = SystemMessage(prompt)
+	} else {
+		a.memory = append([]Message{SystemMessage(prompt)}, a.memory...)
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/quniob/shellm/config"
+	"github.com/quniob/shellm/tools"
+)
+
+type Role string
+
+const (
+	RoleSystem    Role = "system"
+	RoleUser      Role = "user"
+	RoleAssistant Role = "assistant"
+	RoleTool      Role = "tool"
+)
+
+type ToolCall struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+// Message is the provider-neutral form of a conversation entry. Providers
+// translate it to and from their wire formats.
+type Message struct {
+	Role       Role       `json:"role"`
+	Content    string     `json:"content,omitempty"`
+	ToolCalls  []ToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string     `json:"tool_call_id,omitempty"`
+}
+
+func SystemMessage(content string) Message    { return Message{Role: RoleSystem, Content: content} }
+func UserMessage(content string) Message      { return Message{Role: RoleUser, Content: content} }
+func AssistantMessage(content string) Message { return Message{Role: RoleAssistant, Content: content} }
+func ToolMessage(content, toolCallID string) Message {
+	return Message{Role: RoleTool, Content: content, ToolCallID: toolCallID}
+}
+
+// Usage counts the tokens of a call. PromptTokens includes CachedTokens, the
+// part of the prompt served from the provider's prompt cache.
+type Usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	CachedTokens     int `json:"cached_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+type Request struct {
+	Model    string
+	Messages []Message
+	Tools    []tools.Tool
+	Stream   bool
+}
+
+type Response struct {
+	Message Message
+	Usage   Usage
+	Model   string
+}
+
+// Delta is a piece of a streamed response: either assistant text, or the
+// arguments received so far for the tool call currently being generated.
+type Delta struct {
+	Text          string
+	ToolName      string
+	ToolArguments string
+}
+
+// LLMProvider is a chat model backend. When the request asks for streaming,
+// onDelta is called for every piece of the response as it arrives; the
+// returned Response always holds the complete message.
+type LLMProvider interface {
+	Complete(ctx context.Context, req Request, onDelta func(Delta)) (*Response, error)
+}
+
+// APIError is returned by providers for non-successful HTTP responses.
+type APIError struct {
+	Provider   string
+	StatusCode int
+	Message    string
+	RetryAfter time.Duration
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%s: %d %s: %s", e.Provider, e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// parseRetryAfter reads a Retry-After header given either in seconds or as
+// an HTTP date.
+func parseRetryAfter(h http.Header) time.Duration {
+	v := h.Get("Retry-After")
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.ParseFloat(v, 64); err == nil {
+		return time.Duration(secs * float64(time.Second))
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+const defaultLocalBaseURL = "http://localhost:8080/v1"
+
+// NewProvider builds the backend selected by the "provider" setting and, for
+// models without native tool calling, wraps it according to tool_call_mode.
+func NewProvider(cfg *config.Config) (LLMProvider, error) {
+	var provider LLMProvider
+	switch cfg.Provider {
+	case "", "openai":
+		provider = NewOpenAIProvider(cfg.ApiKey, cfg.ApiBaseUrl)
+	case "anthropic":
+		provider = NewAnthropicProvider(cfg.ApiKey, cfg.ApiBaseUrl, cfg.LLMMaxTokens)
+	case "ollama":
+		provider = NewOllamaProvider(cfg.ApiBaseUrl, cfg.LLMMaxTokens)
+	case "local":
+		// llama.cpp server, vLLM, LM Studio and other OpenAI-compatible
+		// servers that usually run without an API key.
+		baseURL := cfg.ApiBaseUrl
+		if baseURL == "" {
+			baseURL = defaultLocalBaseURL
+		}
+		provider = NewOpenAIProvider(cfg.ApiKey, baseURL)
+	default:
+		return nil, fmt.Errorf("unknown provider: %s", cfg.Provider)
+	}
+
+	switch cfg.ToolCallMode {
+	case "native":
+		return provider, nil
+	case "", "auto":
+		return NewTextToolsProvider(provider, true), nil
+	case "text":
+		return NewTextToolsProvider(provider, false), nil
+	default:
+		return nil, fmt.Errorf("unknown tool call mode: %s", cfg.ToolCallMode)
+	}
+}
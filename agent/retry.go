@@ -0,0 +1,155 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/quniob/shellm/config"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+const retryBaseDelay = 500 * time.Millisecond
+
+// RetryMsg is sent before a failed model call is retried.
+type RetryMsg struct {
+	Model   string
+	Attempt int
+	Delay   time.Duration
+	Err     error
+}
+
+// FallbackMsg is sent when a model gives up and the next one in the
+// fallback list takes over.
+type FallbackMsg struct {
+	From, To string
+	Err      error
+}
+
+// ModelMsg tells which model answered the current step.
+type ModelMsg struct {
+	Provider string
+	Model    string
+	Fallback bool
+}
+
+// modelTarget is one entry of the ordered list of models the agent tries.
+type modelTarget struct {
+	providerName string
+	model        string
+	provider     LLMProvider
+}
+
+func (t modelTarget) String() string {
+	return t.providerName + ":" + t.model
+}
+
+// newModelTargets returns the configured model followed by its fallbacks.
+// A fallback without a provider reuses the primary provider's endpoint and
+// key; one with a different provider only inherits what it sets itself.
+func newModelTargets(cfg *config.Config) ([]modelTarget, error) {
+	primary, err := NewProvider(cfg)
+	if err != nil {
+		return nil, err
+	}
+	targets := []modelTarget{{providerName: providerName(cfg.Provider), model: cfg.ApiModel, provider: primary}}
+
+	for _, fb := range cfg.FallbackModels {
+		fbCfg := *cfg
+		fbCfg.ApiModel = fb.Model
+		if fb.Provider != "" && providerName(fb.Provider) != providerName(cfg.Provider) {
+			fbCfg.Provider, fbCfg.ApiBaseUrl, fbCfg.ApiKey = fb.Provider, "", ""
+		}
+		if fb.ApiBaseUrl != "" {
+			fbCfg.ApiBaseUrl = fb.ApiBaseUrl
+		}
+		if fb.ApiKey != "" {
+			fbCfg.ApiKey = fb.ApiKey
+		}
+		if fbCfg.ApiModel == "" {
+			return nil, fmt.Errorf("fallback model without a model name")
+		}
+
+		provider, err := NewProvider(&fbCfg)
+		if err != nil {
+			return nil, fmt.Errorf("fallback %s: %w", fb.Model, err)
+		}
+		targets = append(targets, modelTarget{providerName: providerName(fbCfg.Provider), model: fbCfg.ApiModel, provider: provider})
+	}
+	return targets, nil
+}
+
+func providerName(name string) string {
+	if name == "" {
+		return "openai"
+	}
+	return name
+}
+
+// retryable reports whether a failed call may succeed when repeated:
+// rate limits, server errors, overloads and dropped connections.
+func retryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode == http.StatusTooManyRequests ||
+			apiErr.StatusCode == http.StatusRequestTimeout ||
+			apiErr.StatusCode >= 500
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// retryDelay returns how long to wait before the given retry (starting at
+// 0): the server's Retry-After when present, otherwise exponential backoff
+// with jitter. It returns false when the wait would exceed maxDelay.
+func retryDelay(attempt int, err error, maxDelay time.Duration) (time.Duration, bool) {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.RetryAfter > 0 {
+		return apiErr.RetryAfter, apiErr.RetryAfter <= maxDelay
+	}
+
+	delay := retryBaseDelay << attempt
+	if delay > maxDelay || delay <= 0 {
+		delay = maxDelay
+	}
+	// Equal jitter: keep half of the delay, randomize the rest.
+	delay = delay/2 + rand.N(delay/2+1)
+	return delay, true
+}
+
+// completeWithRetry calls one model, repeating transient failures up to the
+// configured number of retries.
+func (a *Agent) completeWithRetry(ctx context.Context, target modelTarget, req Request, msgCh chan<- tea.Msg) (*Response, error) {
+	maxDelay := time.Duration(a.config.LLMRetryMaxDelay) * time.Second
+	req.Model = target.model
+
+	for attempt := 0; ; attempt++ {
+		resp, err := target.provider.Complete(ctx, req, a.streamHandler(msgCh))
+		if err == nil || attempt >= a.config.LLMMaxRetries || !retryable(err) {
+			return resp, err
+		}
+
+		delay, ok := retryDelay(attempt, err, maxDelay)
+		if !ok {
+			return nil, err
+		}
+		msgCh <- RetryMsg{Model: target.String(), Attempt: attempt + 1, Delay: delay, Err: err}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
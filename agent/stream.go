@@ -0,0 +1,90 @@
+package agent
+
+import (
+	"strconv"
+	"strings"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// ThoughtDeltaMsg carries the next piece of the assistant's text while a
+// response is being streamed.
+type ThoughtDeltaMsg struct{ Content string }
+
+// ReportDeltaMsg carries the report text generated so far while the model is
+// still streaming the arguments of the report tool.
+type ReportDeltaMsg struct{ Content string }
+
+// streamHandler forwards streamed deltas to the UI: assistant text as
+// thought deltas and the partial text of a report as it is being written. The
+// report is redacted like the final one, each time as a whole, so a secret
+// split across deltas is still found.
+func (a *Agent) streamHandler(msgCh chan<- tea.Msg) func(Delta) {
+	return func(d Delta) {
+		switch {
+		case d.Text != "":
+			msgCh <- ThoughtDeltaMsg{Content: d.Text}
+		case d.ToolName == "report":
+			if text, ok := partialJSONString(d.ToolArguments, "text"); ok {
+				msgCh <- ReportDeltaMsg{Content: a.redactor.Redact(text)}
+			}
+		}
+	}
+}
+
+// partialJSONString extracts the value of a top-level string field from a
+// JSON object that may be cut off anywhere, decoding escapes as far as the
+// input goes.
+func partialJSONString(partial string, key string) (string, bool) {
+	i := strings.Index(partial, strconv.Quote(key))
+	if i < 0 {
+		return "", false
+	}
+	rest := strings.TrimLeft(partial[i+len(key)+2:], " \t\r\n")
+	if !strings.HasPrefix(rest, ":") {
+		return "", false
+	}
+	rest = strings.TrimLeft(rest[1:], " \t\r\n")
+	if !strings.HasPrefix(rest, `"`) {
+		return "", false
+	}
+	rest = rest[1:]
+
+	var b strings.Builder
+	for j := 0; j < len(rest); j++ {
+		c := rest[j]
+		switch {
+		case c == '"':
+			return b.String(), true
+		case c != '\\':
+			b.WriteByte(c)
+		case j+1 >= len(rest):
+			return b.String(), true
+		default:
+			j++
+			switch rest[j] {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'r':
+				b.WriteByte('\r')
+			case 'b':
+				b.WriteByte('\b')
+			case 'f':
+				b.WriteByte('\f')
+			case 'u':
+				if j+4 >= len(rest) {
+					return b.String(), true
+				}
+				if r, err := strconv.ParseUint(rest[j+1:j+5], 16, 32); err == nil {
+					b.WriteRune(rune(r))
+				}
+				j += 4
+			default:
+				b.WriteByte(rest[j])
+			}
+		}
+	}
+	return b.String(), true
+}
@@ -0,0 +1,302 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/quniob/shellm/tools"
+)
+
+const textToolsPrompt = `Tools cannot be called natively in this conversation. To use a tool, end your reply with an Action block holding exactly one JSON object that names the tool and its arguments:
+
+Action:
+` + "```json" + `
+{"tool": "<tool name>", "arguments": {<arguments following the tool's schema>}}
+` + "```" + `
+
+Tool results come back in messages starting with "Observation". Available tools:
+`
+
+// textActionMarkers start the part of a text-mode reply that holds the
+// action; nothing from there on is streamed as a thought.
+var textActionMarkers = []string{"Action:", "```", "{"}
+
+// TextToolsProvider lets models without native tool calling drive the ReAct
+// loop: tools are described in the system prompt, calls are parsed from the
+// Action blocks of the plain completion and results are fed back as
+// observations.
+// In auto mode requests go to the backend natively until it rejects the
+// tools parameter, after which text mode is used for the rest of the session.
+type TextToolsProvider struct {
+	inner    LLMProvider
+	auto     bool
+	textMode atomic.Bool
+}
+
+func NewTextToolsProvider(inner LLMProvider, auto bool) *TextToolsProvider {
+	p := &TextToolsProvider{inner: inner, auto: auto}
+	p.textMode.Store(!auto)
+	return p
+}
+
+func (p *TextToolsProvider) Complete(ctx context.Context, req Request, onDelta func(Delta)) (*Response, error) {
+	if len(req.Tools) == 0 {
+		return p.inner.Complete(ctx, req, onDelta)
+	}
+	if !p.textMode.Load() {
+		resp, err := p.inner.Complete(ctx, req, onDelta)
+		if err == nil || !nativeToolsUnsupported(err) {
+			return resp, err
+		}
+		p.textMode.Store(true)
+	}
+
+	known := map[string]bool{}
+	for _, t := range req.Tools {
+		known[t.Name()] = true
+	}
+
+	resp, err := p.inner.Complete(ctx, Request{
+		Model:    req.Model,
+		Messages: textToolMessages(req.Messages, req.Tools),
+		Stream:   req.Stream,
+	}, thoughtFilter(onDelta))
+	if err != nil {
+		return nil, err
+	}
+
+	content, calls := parseTextToolCalls(resp.Message.Content, known)
+	if len(calls) == 0 && known["report"] && content != "" {
+		// A plain answer without an action is taken as the final report so
+		// the loop still terminates.
+		args, _ := json.Marshal(map[string]string{"text": content})
+		content, calls = "", []ToolCall{{ID: "call_0", Name: "report", Arguments: string(args)}}
+	}
+	resp.Message = Message{Role: RoleAssistant, Content: content, ToolCalls: calls}
+	return resp, nil
+}
+
+// nativeToolsUnsupported reports whether the backend refused the request
+// because the model or server cannot handle the tools parameter.
+func nativeToolsUnsupported(err error) bool {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	msg := strings.ToLower(apiErr.Message)
+	for _, s := range []string{"does not support tools", "--jinja", "tool choice requires", "tool-call-parser"} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// textToolMessages rewrites the conversation for text mode: tool
+// descriptions are added to the system prompt, earlier tool calls are shown
+// as the Action blocks the model would have written and tool results become
+// user observations.
+func textToolMessages(messages []Message, list []tools.Tool) []Message {
+	var b strings.Builder
+	b.WriteString(textToolsPrompt)
+	for _, t := range list {
+		schema, _ := json.Marshal(t.Schema())
+		fmt.Fprintf(&b, "\n- %s: %s\n  arguments schema: %s", t.Name(), t.Description(), schema)
+	}
+	instructions := b.String()
+
+	names := map[string]string{}
+	out := make([]Message, 0, len(messages)+1)
+	if len(messages) == 0 || messages[0].Role != RoleSystem {
+		out = append(out, SystemMessage(instructions))
+	}
+
+	for i, m := range messages {
+		switch {
+		case m.Role == RoleSystem && i == 0:
+			out = append(out, SystemMessage(m.Content+"\n\n"+instructions))
+		case m.Role == RoleAssistant && len(m.ToolCalls) > 0:
+			var text strings.Builder
+			text.WriteString(m.Content)
+			for _, tc := range m.ToolCalls {
+				names[tc.ID] = tc.Name
+				args := json.RawMessage(tc.Arguments)
+				if !json.Valid(args) {
+					args = json.RawMessage("{}")
+				}
+				action, _ := json.Marshal(struct {
+					Tool      string          `json:"tool"`
+					Arguments json.RawMessage `json:"arguments"`
+				}{tc.Name, args})
+				fmt.Fprintf(&text, "\nAction:\n```json\n%s\n```", action)
+			}
+			out = append(out, AssistantMessage(strings.TrimSpace(text.String())))
+		case m.Role == RoleTool:
+			observation := fmt.Sprintf("Observation from %s:\n%s", names[m.ToolCallID], m.Content)
+			if n := len(out); n > 0 && out[n-1].Role == RoleUser && strings.HasPrefix(out[n-1].Content, "Observation") {
+				out[n-1].Content += "\n\n" + observation
+				continue
+			}
+			out = append(out, UserMessage(observation))
+		default:
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+// thoughtFilter forwards streamed text up to the start of the action, so
+// the raw JSON of a call is not shown as part of the thought.
+func thoughtFilter(onDelta func(Delta)) func(Delta) {
+	if onDelta == nil {
+		return nil
+	}
+
+	var (
+		text strings.Builder
+		sent int
+		done bool
+	)
+	return func(d Delta) {
+		if done || d.Text == "" {
+			return
+		}
+		text.WriteString(d.Text)
+		full := text.String()
+
+		end := len(full)
+		for _, marker := range textActionMarkers {
+			if i := strings.Index(full, marker); i >= 0 && i < end {
+				end, done = i, true
+			}
+		}
+		if !done {
+			// Hold back a tail that might be the beginning of a marker.
+			for _, marker := range textActionMarkers {
+				for n := len(marker) - 1; n > 0; n-- {
+					if strings.HasSuffix(full, marker[:n]) && len(full)-n < end {
+						end = len(full) - n
+					}
+				}
+			}
+		}
+
+		if end > sent {
+			onDelta(Delta{Text: full[sent:end]})
+			sent = end
+		}
+	}
+}
+
+// parseTextToolCalls extracts tool calls from a plain completion. Only JSON
+// objects right after an "Action:" marker or opening a json code fence count,
+// so an object the model merely quotes, e.g. from a tool output, is not run.
+// A reply that is nothing but one object is taken as a call too. The text
+// before the first call is returned as the thought.
+func parseTextToolCalls(text string, known map[string]bool) (string, []ToolCall) {
+	// markers maps the offset of each candidate object to the offset of the
+	// marker that introduced it.
+	markers := map[int]int{}
+	candidate := func(marker, pos int) {
+		pos += len(text[pos:]) - len(strings.TrimLeft(text[pos:], " \t\r\n"))
+		if pos < len(text) && text[pos] == '{' {
+			if m, ok := markers[pos]; !ok || marker < m {
+				markers[pos] = marker
+			}
+		}
+	}
+	for _, marker := range []string{"Action:", "```json"} {
+		for i := 0; ; {
+			j := strings.Index(text[i:], marker)
+			if j < 0 {
+				break
+			}
+			start, pos := i+j, i+j+len(marker)
+			if marker == "Action:" {
+				pos += len(text[pos:]) - len(strings.TrimLeft(text[pos:], " \t\r\n"))
+				if strings.HasPrefix(text[pos:], "```json") {
+					pos += len("```json")
+				} else if strings.HasPrefix(text[pos:], "```") {
+					pos += len("```")
+				}
+			}
+			candidate(start, pos)
+			i = pos
+		}
+	}
+	if len(markers) == 0 && wholeObject(text) {
+		candidate(0, 0)
+	}
+
+	offsets := make([]int, 0, len(markers))
+	for pos := range markers {
+		offsets = append(offsets, pos)
+	}
+	sort.Ints(offsets)
+
+	var calls []ToolCall
+	thoughtEnd := len(text)
+	for _, pos := range offsets {
+		var obj map[string]json.RawMessage
+		if err := json.NewDecoder(strings.NewReader(text[pos:])).Decode(&obj); err != nil {
+			continue
+		}
+		name, args, ok := textAction(obj)
+		if !ok || !known[name] {
+			continue
+		}
+		if len(calls) == 0 {
+			thoughtEnd = markers[pos]
+		}
+		calls = append(calls, ToolCall{ID: fmt.Sprintf("call_%d", len(calls)), Name: name, Arguments: args})
+	}
+
+	thought := strings.TrimSpace(text[:thoughtEnd])
+	thought = strings.TrimSpace(strings.TrimPrefix(thought, "Thought:"))
+	return thought, calls
+}
+
+// wholeObject reports whether text is a single JSON object and nothing else.
+func wholeObject(text string) bool {
+	text = strings.TrimSpace(text)
+	dec := json.NewDecoder(strings.NewReader(text))
+	var obj map[string]json.RawMessage
+	return dec.Decode(&obj) == nil && dec.InputOffset() == int64(len(text))
+}
+
+// textAction reads a tool call from a decoded object, accepting the key
+// names local models commonly use for it.
+func textAction(obj map[string]json.RawMessage) (string, string, bool) {
+	var name string
+	for _, key := range []string{"tool", "name", "action", "function"} {
+		if raw, ok := obj[key]; ok && json.Unmarshal(raw, &name) == nil && name != "" {
+			break
+		}
+	}
+	if name == "" {
+		return "", "", false
+	}
+
+	args := "{}"
+	for _, key := range []string{"arguments", "args", "parameters", "input", "action_input"} {
+		raw, ok := obj[key]
+		if !ok {
+			continue
+		}
+		// Some models encode the arguments as a JSON string.
+		var s string
+		if json.Unmarshal(raw, &s) == nil && json.Valid([]byte(s)) {
+			raw = json.RawMessage(s)
+		}
+		if strings.HasPrefix(strings.TrimSpace(string(raw)), "{") {
+			args = string(raw)
+		}
+		break
+	}
+	return name, args, true
+}
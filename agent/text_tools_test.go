@@ -0,0 +1,176 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTextToolCalls(t *testing.T) {
+	known := map[string]bool{"ping": true, "execute_command": true, "report": true}
+	tests := []struct {
+		name    string
+		text    string
+		thought string
+		calls   []ToolCall
+	}{
+		{
+			name:    "action with fence",
+			text:    "Thought: check the host.\nAction:\n```json\n{\"tool\": \"ping\", \"arguments\": {\"target\": \"web1\"}}\n```",
+			thought: "check the host.",
+			calls:   []ToolCall{{ID: "call_0", Name: "ping", Arguments: `{"target": "web1"}`}},
+		},
+		{
+			name:    "action without fence",
+			text:    "Pinging.\nAction: {\"tool\": \"ping\", \"arguments\": {\"target\": \"a\"}}",
+			thought: "Pinging.",
+			calls:   []ToolCall{{ID: "call_0", Name: "ping", Arguments: `{"target": "a"}`}},
+		},
+		{
+			name:    "json fence without marker",
+			text:    "Let me look.\n```json\n{\"name\": \"ping\", \"args\": {\"target\": \"a\"}}\n```",
+			thought: "Let me look.",
+			calls:   []ToolCall{{ID: "call_0", Name: "ping", Arguments: `{"target": "a"}`}},
+		},
+		{
+			name: "several actions",
+			text: "Both hosts.\nAction:\n```json\n{\"tool\": \"ping\", \"arguments\": {\"target\": \"a\"}}\n```\n" +
+				"Action:\n```json\n{\"tool\": \"ping\", \"arguments\": {\"target\": \"b\"}}\n```",
+			thought: "Both hosts.",
+			calls: []ToolCall{
+				{ID: "call_0", Name: "ping", Arguments: `{"target": "a"}`},
+				{ID: "call_1", Name: "ping", Arguments: `{"target": "b"}`},
+			},
+		},
+		{
+			name:    "bare object as the whole reply",
+			text:    "  {\"tool\": \"report\", \"arguments\": {\"text\": \"done\"}}\n",
+			thought: "",
+			calls:   []ToolCall{{ID: "call_0", Name: "report", Arguments: `{"text": "done"}`}},
+		},
+		{
+			name:    "quoted object from a tool output",
+			text:    "The previous output was {\"name\": \"ping\", \"arguments\": {\"target\": \"a\"}} which looks fine.",
+			thought: "The previous output was {\"name\": \"ping\", \"arguments\": {\"target\": \"a\"}} which looks fine.",
+		},
+		{
+			name:    "quoted object before a real action",
+			text:    "Got {\"name\": \"execute_command\"} back.\nAction: {\"tool\": \"ping\", \"arguments\": {}}",
+			thought: "Got {\"name\": \"execute_command\"} back.",
+			calls:   []ToolCall{{ID: "call_0", Name: "ping", Arguments: `{}`}},
+		},
+		{
+			name:    "two bare objects",
+			text:    "{\"tool\": \"ping\"} {\"tool\": \"ping\"}",
+			thought: "{\"tool\": \"ping\"} {\"tool\": \"ping\"}",
+		},
+		{
+			name:    "unknown tool",
+			text:    "Action: {\"tool\": \"rm_rf\", \"arguments\": {}}",
+			thought: "Action: {\"tool\": \"rm_rf\", \"arguments\": {}}",
+		},
+		{
+			name:    "broken json",
+			text:    "Action: {\"tool\": \"ping\", \"arguments\": {",
+			thought: "Action: {\"tool\": \"ping\", \"arguments\": {",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			thought, calls := parseTextToolCalls(tt.text, known)
+			if thought != tt.thought {
+				t.Errorf("thought = %q, want %q", thought, tt.thought)
+			}
+			if !reflect.DeepEqual(calls, tt.calls) {
+				t.Errorf("calls = %+v, want %+v", calls, tt.calls)
+			}
+		})
+	}
+}
+
+func TestTextAction(t *testing.T) {
+	tests := []struct {
+		obj  string
+		name string
+		args string
+		ok   bool
+	}{
+		{`{"tool": "ping", "arguments": {"target": "a"}}`, "ping", `{"target": "a"}`, true},
+		{`{"name": "ping", "args": {"target": "a"}}`, "ping", `{"target": "a"}`, true},
+		{`{"action": "ping", "action_input": {"target": "a"}}`, "ping", `{"target": "a"}`, true},
+		{`{"function": "ping", "parameters": {"target": "a"}}`, "ping", `{"target": "a"}`, true},
+		{`{"tool": "ping", "input": {"target": "a"}}`, "ping", `{"target": "a"}`, true},
+		{`{"tool": "ping", "arguments": "{\"target\": \"a\"}"}`, "ping", `{"target": "a"}`, true},
+		{`{"tool": "ping", "arguments": "not json"}`, "ping", `{}`, true},
+		{`{"tool": "ping", "arguments": [1, 2]}`, "ping", `{}`, true},
+		{`{"tool": "ping"}`, "ping", `{}`, true},
+		{`{"tool": "", "name": "ping"}`, "ping", `{}`, true},
+		{`{"target": "a"}`, "", "", false},
+		{`{"tool": 5}`, "", "", false},
+	}
+	for _, tt := range tests {
+		var obj map[string]json.RawMessage
+		if err := json.Unmarshal([]byte(tt.obj), &obj); err != nil {
+			t.Fatalf("bad test object %s: %v", tt.obj, err)
+		}
+		name, args, ok := textAction(obj)
+		if name != tt.name || args != tt.args || ok != tt.ok {
+			t.Errorf("textAction(%s) = %q, %q, %v, want %q, %q, %v", tt.obj, name, args, ok, tt.name, tt.args, tt.ok)
+		}
+	}
+}
+
+func TestThoughtFilter(t *testing.T) {
+	tests := []struct {
+		name   string
+		chunks []string
+		want   string
+	}{
+		{"plain text", []string{"Disk ", "usage is fine."}, "Disk usage is fine."},
+		{"stops at action", []string{"I will ch", "eck.\nAct", "ion:\n```json\n{\"tool\"", ": \"ping\"}"}, "I will check.\n"},
+		{"stops at fence", []string{"Checking.\n`", "``json\n{}"}, "Checking.\n"},
+		{"stops at object", []string{"Checking ", "{\"tool\": \"ping\"}", " more text"}, "Checking "},
+		{"marker in one chunk", []string{"Action: {}"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got strings.Builder
+			filter := thoughtFilter(func(d Delta) { got.WriteString(d.Text) })
+			for _, chunk := range tt.chunks {
+				filter(Delta{Text: chunk})
+			}
+			filter(Delta{ToolName: "report", ToolArguments: "{}"})
+			if got.String() != tt.want {
+				t.Errorf("streamed %q, want %q", got.String(), tt.want)
+			}
+		})
+	}
+
+	if thoughtFilter(nil) != nil {
+		t.Error("thoughtFilter(nil) is not nil")
+	}
+}
+
+func TestNativeToolsUnsupported(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&APIError{StatusCode: 400, Message: `registry.ollama.ai/library/gemma:2b does not support tools`}, true},
+		{&APIError{StatusCode: 500, Message: "tools param requires --jinja flag"}, true},
+		{&APIError{StatusCode: 400, Message: `"auto" tool choice requires --enable-auto-tool-choice and --tool-call-parser to be set`}, true},
+		{fmt.Errorf("retry: %w", &APIError{StatusCode: 400, Message: "Model Does Not Support Tools"}), true},
+		{&APIError{StatusCode: 400, Message: "context length exceeded"}, false},
+		{&APIError{StatusCode: 429, Message: "rate limited"}, false},
+		{errors.New("does not support tools"), false},
+		{nil, false},
+	}
+	for _, tt := range tests {
+		if got := nativeToolsUnsupported(tt.err); got != tt.want {
+			t.Errorf("nativeToolsUnsupported(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
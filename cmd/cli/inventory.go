@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/quniob/shellm/config"
+	"github.com/quniob/shellm/tools"
+)
+
+const inventoryUsage = `Usage: shellm inventory <list|check|add|remove> [flags]`
+
+// maxParallelChecks bounds the number of simultaneous SSH handshakes.
+const maxParallelChecks = 16
+
+type tagsFlag []string
+
+func (t *tagsFlag) String() string { return strings.Join(*t, ",") }
+func (t *tagsFlag) Set(v string) error {
+	for _, tag := range strings.Split(v, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			*t = append(*t, tag)
+		}
+	}
+	return nil
+}
+
+func runInventory(args []string) error {
+	if len(args) == 0 {
+		return errors.New(inventoryUsage)
+	}
+
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		return fmt.Errorf("loading config: %w", err)
+	}
+
+	switch args[0] {
+	case "list":
+		return inventoryList(cfg, args[1:])
+	case "check":
+		return inventoryCheck(cfg, args[1:])
+	case "add":
+		return inventoryAdd(cfg, args[1:])
+	case "remove", "rm":
+		return inventoryRemove(cfg, args[1:])
+	default:
+		return fmt.Errorf("unknown inventory command: %s\n%s", args[0], inventoryUsage)
+	}
+}
+
+func filterHosts(hosts []config.Host, tags []string) []config.Host {
+	out := make([]config.Host, 0, len(hosts))
+	for _, host := range hosts {
+		if host.HasTags(tags...) {
+			out = append(out, host)
+		}
+	}
+	return out
+}
+
+func printJSON(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func inventoryList(cfg *config.Config, args []string) error {
+	fs := flag.NewFlagSet("inventory list", flag.ContinueOnError)
+	var tags tagsFlag
+	fs.Var(&tags, "tag", "only show hosts carrying this tag (repeatable, comma separated)")
+	output := fs.String("output", "table", "output format: table or json")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	hosts, err := config.LoadInventory(cfg.InventoryPath)
+	if err != nil {
+		return err
+	}
+	hosts = filterHosts(hosts, tags)
+
+	switch *output {
+	case "json":
+		return printJSON(hosts)
+	case "table":
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tHOST\tPORT\tSECRET\tTAGS\tDESCRIPTION")
+		for _, h := range hosts {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\n", h.ID, h.Host, h.Port, h.SecretRef, strings.Join(h.Tags, ","), h.Description)
+		}
+		return w.Flush()
+	default:
+		return fmt.Errorf("unknown output format: %s", *output)
+	}
+}
+
+type checkResult struct {
+	ID      string `json:"id"`
+	Address string `json:"address"`
+	Status  string `json:"status"`
+	Latency string `json:"latency,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// classifyDialError maps an SSH connection error to a short status so that
+// operators can tell credential problems from network ones at a glance.
+func classifyDialError(err error) string {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return "timeout"
+	}
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "unable to authenticate"),
+		strings.Contains(msg, "Password environment variable"),
+		strings.Contains(msg, "private key"):
+		return "auth"
+	case strings.Contains(msg, "host key"), strings.Contains(msg, "knownhosts"):
+		return "host-key"
+	case strings.Contains(msg, "i/o timeout"), strings.Contains(msg, "deadline exceeded"):
+		return "timeout"
+	default:
+		return "unreachable"
+	}
+}
+
+func inventoryCheck(cfg *config.Config, args []string) error {
+	fs := flag.NewFlagSet("inventory check", flag.ContinueOnError)
+	var tags tagsFlag
+	fs.Var(&tags, "tag", "only check hosts carrying this tag (repeatable, comma separated)")
+	output := fs.String("output", "table", "output format: table or json")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	hosts, err := loadHosts(cfg)
+	if err != nil {
+		return err
+	}
+	list, err := config.LoadInventory(cfg.InventoryPath)
+	if err != nil {
+		return err
+	}
+	list = filterHosts(list, tags)
+
+	executor := tools.ExecuteCommand{HostsData: &hosts}
+	results := make([]checkResult, len(list))
+	sem := make(chan struct{}, maxParallelChecks)
+	var wg sync.WaitGroup
+
+	for i, host := range list {
+		results[i] = checkResult{ID: host.ID, Address: net.JoinHostPort(host.Host, fmt.Sprint(host.Port))}
+
+		if err := config.ValidateHost(host); err != nil {
+			results[i].Status = "invalid"
+			results[i].Error = err.Error()
+			continue
+		}
+		if _, ok := hosts.Secrets[host.SecretRef]; !ok {
+			results[i].Status = "invalid"
+			results[i].Error = fmt.Sprintf("secret '%s' does not exist", host.SecretRef)
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, host config.Host) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			start := time.Now()
+			client, err := executor.Dial(context.Background(), host)
+			if err != nil {
+				results[i].Status = classifyDialError(err)
+				results[i].Error = err.Error()
+				return
+			}
+			client.Close()
+			results[i].Status = "ok"
+			results[i].Latency = time.Since(start).Round(time.Millisecond).String()
+		}(i, host)
+	}
+	wg.Wait()
+
+	sort.SliceStable(results, func(i, j int) bool { return results[i].ID < results[j].ID })
+
+	failed := 0
+	for _, r := range results {
+		if r.Status != "ok" {
+			failed++
+		}
+	}
+
+	switch *output {
+	case "json":
+		if err := printJSON(results); err != nil {
+			return err
+		}
+	case "table":
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tADDRESS\tSTATUS\tLATENCY\tERROR")
+		for _, r := range results {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", r.ID, r.Address, r.Status, r.Latency, r.Error)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown output format: %s", *output)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d hosts failed the check", failed, len(results))
+	}
+	return nil
+}
+
+func inventoryAdd(cfg *config.Config, args []string) error {
+	fs := flag.NewFlagSet("inventory add", flag.ContinueOnError)
+	var host config.Host
+	var tags tagsFlag
+	fs.StringVar(&host.ID, "id", "", "host ID (required)")
+	fs.StringVar(&host.Host, "host", "", "hostname or IP address (required)")
+	fs.IntVar(&host.Port, "port", 22, "SSH port")
+	fs.StringVar(&host.SecretRef, "secret", "", "ID of the secret used to log in (required)")
+	fs.StringVar(&host.Description, "description", "", "free-form description")
+	fs.StringVar(&host.OS, "os", "", "operating system, e.g. \"Ubuntu 22.04\"")
+	fs.Var(&tags, "tag", "tag to attach (repeatable, comma separated)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	host.Tags = tags
+
+	if err := config.AddHost(cfg.InventoryPath, host); err != nil {
+		return err
+	}
+	fmt.Printf("Added host '%s' to %s\n", host.ID, cfg.InventoryPath)
+	return nil
+}
+
+func inventoryRemove(cfg *config.Config, args []string) error {
+	fs := flag.NewFlagSet("inventory remove", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("Usage: shellm inventory remove <host-id>")
+	}
+
+	id := fs.Arg(0)
+	if err := config.RemoveHost(cfg.InventoryPath, id); err != nil {
+		return err
+	}
+	fmt.Printf("Removed host '%s' from %s\n", id, cfg.InventoryPath)
+	return nil
+}
@@ -2,8 +2,45 @@ package main
 
 import (
 	"fmt"
+	"os"
 )
 
+const usage = `Usage: shellm <command> [arguments]
+
+Commands:
+  run                Run the agent on a task (use -session to resume a conversation)
+  inventory list     List hosts from the inventory
+  inventory check    Validate the inventory and test SSH access to every host
+  inventory add      Add a host to the inventory
+  inventory remove   Remove a host from the inventory
+  secrets encrypt    Encrypt the secrets file with age
+  secrets edit       Decrypt, edit and re-encrypt the secrets file
+`
+
 func main() {
-	fmt.Print("todo")
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "run":
+		err = runRun(os.Args[2:])
+	case "inventory":
+		err = runInventory(os.Args[2:])
+	case "secrets":
+		err = runSecrets(os.Args[2:])
+	case "help", "-h", "--help":
+		fmt.Print(usage)
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command: %s\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
 }
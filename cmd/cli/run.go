@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/quniob/shellm/agent"
+	"github.com/quniob/shellm/config"
+	"github.com/quniob/shellm/session"
+	"github.com/quniob/shellm/tools"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"golang.org/x/term"
+)
+
+// maxResultPreview limits how much of each tool result is echoed to stderr.
+const maxResultPreview = 400
+
+func runRun(args []string) error {
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	sessionID := fs.String("session", "", "resume the session with this ID, or start one under it")
+	quiet := fs.Bool("quiet", false, "only print the final answer")
+	dryRun := fs.Bool("dry-run", false, "describe commands that may change hosts instead of running them")
+	yes := fs.Bool("yes", false, "approve every call that needs approval without asking")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	prompt := strings.Join(fs.Args(), " ")
+	if prompt == "" || prompt == "-" {
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		prompt = string(data)
+	}
+	if strings.TrimSpace(prompt) == "" {
+		return errors.New("Usage: shellm run [flags] <task>")
+	}
+
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		return fmt.Errorf("loading config: %w", err)
+	}
+	hosts, err := loadHosts(cfg)
+	if err != nil {
+		return err
+	}
+	hosts.Privacy = cfg.PrivacyMode
+	hosts.ResolveAddresses(context.Background())
+	if *dryRun {
+		cfg.DryRun = true
+	}
+
+	ag, err := agent.NewAgent(tools.NewDefaultRegistry(&hosts), cfg, &hosts)
+	if err != nil {
+		return err
+	}
+
+	store, err := session.NewStore(cfg.SessionsPath)
+	if err != nil {
+		return err
+	}
+	sess, err := openSession(store, ag, cfg, *sessionID)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(cfg.LLMTimeOut))
+	defer cancel()
+	// The first interrupt cancels the run so the session is still saved; a
+	// second one kills the process.
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	msgCh := make(chan tea.Msg)
+	go func() {
+		defer close(msgCh)
+		ag.Start(ctx, prompt, msgCh)
+	}()
+	runStart := ag.GetStats()
+	runErr := printEvents(msgCh, *quiet, *yes)
+	printUsage(runStart, ag.GetStats())
+
+	sess.Update(ag.Memory(), cfg.ApiModel, ag.GetStats())
+	if err := store.Save(sess); err != nil {
+		return fmt.Errorf("saving session: %w", err)
+	}
+	fmt.Fprintf(os.Stderr, "session: %s\n", sess.ID)
+
+	return runErr
+}
+
+func openSession(store *session.Store, ag *agent.Agent, cfg *config.Config, id string) (*session.Session, error) {
+	if id == "" {
+		return session.New(cfg.ApiModel), nil
+	}
+
+	sess, err := store.Load(id)
+	if errors.Is(err, session.ErrNotFound) {
+		sess = session.New(cfg.ApiModel)
+		sess.ID = id
+		return sess, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ag.Restore(sess.Messages, sess.TokenUsage, sess.Cost)
+	return sess, nil
+}
+
+func preview(s string) string {
+	s = strings.TrimSpace(s)
+	if runes := []rune(s); len(runes) > maxResultPreview {
+		return string(runes[:maxResultPreview]) + "..."
+	}
+	return s
+}
+
+// printEvents renders agent events as plain text: progress goes to stderr and
+// the final answer to stdout, so the answer can be piped.
+func printEvents(msgCh <-chan tea.Msg, quiet, yes bool) error {
+	var runErr error
+	streaming, answeredBy := false, ""
+
+	for msg := range msgCh {
+		switch msg := msg.(type) {
+		case agent.ThoughtDeltaMsg:
+			if !quiet {
+				fmt.Fprint(os.Stderr, msg.Content)
+				streaming = true
+			}
+		case agent.ThoughtMsg:
+			if quiet {
+				continue
+			}
+			if streaming {
+				fmt.Fprintln(os.Stderr)
+				streaming = false
+			} else if msg.Content != "" {
+				fmt.Fprintln(os.Stderr, msg.Content)
+			}
+			if answeredBy != "" {
+				fmt.Fprintf(os.Stderr, "answered by %s\n", answeredBy)
+			}
+		case agent.ToolCallMsg:
+			if !quiet {
+				fmt.Fprintf(os.Stderr, "-> %s\n", msg.Content)
+			}
+		case agent.ToolResultMsg:
+			if !quiet {
+				fmt.Fprintf(os.Stderr, "<- %s\n", preview(msg.Content))
+			}
+		case agent.RetryMsg:
+			if !quiet {
+				if streaming {
+					fmt.Fprintln(os.Stderr)
+					streaming = false
+				}
+				fmt.Fprintf(os.Stderr, "retry: %s failed (%v), attempt %d in %s\n", msg.Model, msg.Err, msg.Attempt, msg.Delay.Round(time.Millisecond))
+			}
+		case agent.FallbackMsg:
+			if !quiet {
+				if streaming {
+					fmt.Fprintln(os.Stderr)
+					streaming = false
+				}
+				fmt.Fprintf(os.Stderr, "fallback: %s failed (%v), switching to %s\n", msg.From, msg.Err, msg.To)
+			}
+		case agent.ModelMsg:
+			// Shown after the thought the model streamed.
+			answeredBy = ""
+			if msg.Fallback {
+				answeredBy = msg.Provider + ":" + msg.Model
+			}
+		case agent.BudgetMsg:
+			fmt.Fprintf(os.Stderr, "budget: %s\n", msg)
+		case agent.ContextCompactedMsg:
+			if !quiet {
+				fmt.Fprintf(os.Stderr, "context compacted: ~%d -> ~%d tokens\n", msg.Before, msg.After)
+			}
+		case agent.ApprovalRequestMsg:
+			if streaming {
+				fmt.Fprintln(os.Stderr)
+				streaming = false
+			}
+			msg.Reply <- approveCall(msg, yes)
+		case agent.FinalResultMsg:
+			fmt.Println(msg.Content)
+		case agent.CancelledMsg:
+			if streaming {
+				fmt.Fprintln(os.Stderr)
+				streaming = false
+			}
+			runErr = fmt.Errorf("run cancelled: %w", msg.Err)
+		case agent.ErrMsg:
+			runErr = msg.Err
+		}
+	}
+
+	return runErr
+}
+
+// approveCall answers an approval request: -yes approves every call, and
+// otherwise the operator is asked on the terminal. Without a terminal the call
+// is declined.
+func approveCall(req agent.ApprovalRequestMsg, yes bool) bool {
+	if yes {
+		fmt.Fprintf(os.Stderr, "approved: %s\n", req.Preview)
+		return true
+	}
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		fmt.Fprintf(os.Stderr, "declined: %s (no terminal to ask on; pass -yes to approve)\n", req.Preview)
+		return false
+	}
+	fmt.Fprintf(os.Stderr, "approve: %s? [y/N] ", req.Preview)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// printUsage writes the token and cost summary of the run to stderr.
+func printUsage(before, after agent.UsageStats) {
+	fmt.Fprintf(os.Stderr, "usage: %d tokens (prompt %d, cached %d, completion %d)",
+		after.TotalTokens()-before.TotalTokens(),
+		after.PromptTokens()-before.PromptTokens(),
+		after.CachedTokens()-before.CachedTokens(),
+		after.CompletionTokens()-before.CompletionTokens())
+	if cost := after.Cost() - before.Cost(); cost > 0 || after.Cost() > 0 {
+		fmt.Fprintf(os.Stderr, ", $%.4f (session $%.4f)", cost, after.Cost())
+	}
+	fmt.Fprintln(os.Stderr)
+}
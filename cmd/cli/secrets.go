@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/quniob/shellm/config"
+
+	"filippo.io/age"
+	"golang.org/x/term"
+)
+
+const secretsUsage = `Usage: shellm secrets <encrypt|edit> [flags] [file]`
+
+type listFlag []string
+
+func (l *listFlag) String() string     { return strings.Join(*l, ",") }
+func (l *listFlag) Set(v string) error { *l = append(*l, v); return nil }
+
+func runSecrets(args []string) error {
+	if len(args) == 0 {
+		return errors.New(secretsUsage)
+	}
+
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		return fmt.Errorf("loading config: %w", err)
+	}
+
+	switch args[0] {
+	case "encrypt":
+		return secretsEncrypt(cfg, args[1:])
+	case "edit":
+		return secretsEdit(cfg, args[1:])
+	default:
+		return fmt.Errorf("unknown secrets command: %s\n%s", args[0], secretsUsage)
+	}
+}
+
+func readPassword(prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	defer fmt.Fprintln(os.Stderr)
+
+	pass, err := term.ReadPassword(int(os.Stdin.Fd()))
+	if err != nil {
+		return "", err
+	}
+	return string(pass), nil
+}
+
+// loadIdentities returns the identities from the configured key file, or asks
+// for a key or passphrase on the terminal when none is configured. The typed
+// passphrase is returned as well so that callers can re-encrypt with it.
+func loadIdentities(cfg *config.Config) ([]age.Identity, string, error) {
+	if cfg.IdentityPath != "" {
+		identities, err := config.LoadIdentities(cfg.IdentityPath)
+		return identities, "", err
+	}
+
+	input, err := readPassword("Age identity or passphrase: ")
+	if err != nil {
+		return nil, "", err
+	}
+	identity, err := config.ParseIdentityInput(input)
+	if err != nil {
+		return nil, "", err
+	}
+
+	passphrase := ""
+	if _, ok := identity.(*age.ScryptIdentity); ok {
+		passphrase = strings.TrimSpace(input)
+	}
+	return []age.Identity{identity}, passphrase, nil
+}
+
+// loadHosts loads the inventory and secrets, asking for an identity only when
+// the secrets file turns out to be age-encrypted, and attaches the secret
+// store used for provider-backed credentials.
+func loadHosts(cfg *config.Config) (config.Hosts, error) {
+	hosts, err := config.LoadHosts(cfg.InventoryPath, cfg.SecretsPath)
+	if errors.Is(err, config.ErrIdentityRequired) {
+		var identities []age.Identity
+		identities, _, err = loadIdentities(cfg)
+		if err != nil {
+			return hosts, err
+		}
+		hosts, err = config.LoadHosts(cfg.InventoryPath, cfg.SecretsPath, identities...)
+	}
+	if err != nil {
+		return hosts, err
+	}
+
+	hosts.Store = config.NewSecretStore(cfg)
+	hosts.Facts = config.NewFactsCache(cfg)
+	hosts.HostKeys = config.NewHostKeys(cfg)
+	return hosts, nil
+}
+
+func parseRecipients(recipients, recipientFiles []string) ([]age.Recipient, error) {
+	var out []age.Recipient
+	for _, r := range recipients {
+		recipient, err := age.ParseX25519Recipient(r)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, recipient)
+	}
+	for _, path := range recipientFiles {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		parsed, err := age.ParseRecipients(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("recipients file '%s': %w", path, err)
+		}
+		out = append(out, parsed...)
+	}
+	return out, nil
+}
+
+func writeFileAtomic(path string, data []byte, mode os.FileMode) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, mode); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func secretsEncrypt(cfg *config.Config, args []string) error {
+	fs := flag.NewFlagSet("secrets encrypt", flag.ContinueOnError)
+	var recipients, recipientFiles listFlag
+	fs.Var(&recipients, "r", "age recipient public key (repeatable)")
+	fs.Var(&recipientFiles, "R", "file with age recipients, one per line (repeatable)")
+	usePassphrase := fs.Bool("passphrase", false, "encrypt with a passphrase instead of recipients")
+	output := fs.String("o", "", "output file (defaults to overwriting the input)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	path := cfg.SecretsPath
+	if fs.NArg() > 0 {
+		path = fs.Arg(0)
+	}
+	if *output == "" {
+		*output = path
+	}
+
+	plain, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if enc := config.DetectSecretsEncryption(plain); enc != config.EncryptionNone {
+		return fmt.Errorf("'%s' is already %s-encrypted", path, enc)
+	}
+	if _, err := config.ParseSecrets(plain); err != nil {
+		return err
+	}
+
+	targets, err := parseRecipients(recipients, recipientFiles)
+	if err != nil {
+		return err
+	}
+	if *usePassphrase {
+		if len(targets) > 0 {
+			return errors.New("-passphrase cannot be combined with recipients")
+		}
+		pass, err := readPassword("Passphrase: ")
+		if err != nil {
+			return err
+		}
+		confirm, err := readPassword("Confirm passphrase: ")
+		if err != nil {
+			return err
+		}
+		if pass != confirm {
+			return errors.New("passphrases do not match")
+		}
+		recipient, err := age.NewScryptRecipient(pass)
+		if err != nil {
+			return err
+		}
+		targets = append(targets, recipient)
+	}
+
+	encrypted, err := config.EncryptSecrets(plain, targets...)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(*output, encrypted, 0o600); err != nil {
+		return err
+	}
+	fmt.Printf("Encrypted %s -> %s\n", path, *output)
+	return nil
+}
+
+func runEditor(path string) error {
+	editor := os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" {
+		editor = "vi"
+	}
+
+	parts := strings.Fields(editor)
+	cmd := exec.Command(parts[0], append(parts[1:], path)...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+func secretsEdit(cfg *config.Config, args []string) error {
+	fs := flag.NewFlagSet("secrets edit", flag.ContinueOnError)
+	var recipients, recipientFiles listFlag
+	fs.Var(&recipients, "r", "re-encrypt to this age recipient instead of the identity's own (repeatable)")
+	fs.Var(&recipientFiles, "R", "file with age recipients, one per line (repeatable)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	path := cfg.SecretsPath
+	if fs.NArg() > 0 {
+		path = fs.Arg(0)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	switch config.DetectSecretsEncryption(data) {
+	case config.EncryptionSops:
+		cmd := exec.Command("sops", path)
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		return cmd.Run()
+	case config.EncryptionNone:
+		return fmt.Errorf("'%s' is not encrypted, run 'shellm secrets encrypt' first", path)
+	}
+
+	identities, passphrase, err := loadIdentities(cfg)
+	if err != nil {
+		return err
+	}
+	plain, err := config.DecryptSecrets(path, data, identities...)
+	if err != nil {
+		return err
+	}
+
+	targets, err := parseRecipients(recipients, recipientFiles)
+	if err != nil {
+		return err
+	}
+	if len(targets) == 0 {
+		// Re-encrypting to our own identity would lock every other recipient
+		// out, and their public keys cannot be read back from the file.
+		count, err := config.AgeRecipientCount(data)
+		if err != nil {
+			return err
+		}
+		if count > 1 {
+			return fmt.Errorf("'%s' is encrypted to %d recipients, pass all of them with -r or -R so that none loses access", path, count)
+		}
+		for _, identity := range identities {
+			switch id := identity.(type) {
+			case *age.X25519Identity:
+				targets = append(targets, id.Recipient())
+			case *age.ScryptIdentity:
+				recipient, err := age.NewScryptRecipient(passphrase)
+				if err != nil {
+					return err
+				}
+				targets = append(targets, recipient)
+			}
+		}
+	}
+	if len(targets) == 0 {
+		return errors.New("cannot derive recipients from the identity, pass them with -r or -R")
+	}
+
+	dir, err := os.MkdirTemp("", "shellm-secrets-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	tmp := filepath.Join(dir, "secrets.yaml")
+	if err := os.WriteFile(tmp, plain, 0o600); err != nil {
+		return err
+	}
+
+	for {
+		if err := runEditor(tmp); err != nil {
+			return fmt.Errorf("editor: %w", err)
+		}
+		edited, err := os.ReadFile(tmp)
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(edited, plain) {
+			fmt.Println("No changes")
+			return nil
+		}
+		if _, err := config.ParseSecrets(edited); err != nil {
+			fmt.Fprintln(os.Stderr, "Invalid secrets:", err)
+			fmt.Fprint(os.Stderr, "Re-open the editor? [Y/n] ")
+			var answer string
+			fmt.Scanln(&answer)
+			if strings.HasPrefix(strings.ToLower(answer), "n") {
+				return errors.New("changes discarded")
+			}
+			continue
+		}
+
+		encrypted, err := config.EncryptSecrets(edited, targets...)
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(path, encrypted, 0o600); err != nil {
+			return err
+		}
+		fmt.Printf("Saved %s\n", path)
+		return nil
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"github.com/quniob/shellm/agent"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+const approvalHelp = "y approve · n decline"
+
+// askApproval shows a call that needs the operator's approval. The run waits
+// until it is answered.
+func (m *model) askApproval(req agent.ApprovalRequestMsg) {
+	m.approval = &req
+	m.chatMessages = append(m.chatMessages, ChatMessage{sender: "Approve? ", content: req.Preview + "\n" + approvalHelp, style: m.errorStyle})
+	m.approvalIdx = len(m.chatMessages) - 1
+	m.renderChatMessages()
+	m.textarea.Placeholder = "Approve the call: " + approvalHelp
+}
+
+// updateApproval handles keys while a call waits for approval; esc declines.
+func (m model) updateApproval(key tea.KeyMsg) (tea.Model, tea.Cmd) {
+	var approved bool
+	switch key.String() {
+	case "y", "Y":
+		approved = true
+	case "n", "N", "esc":
+		approved = false
+	default:
+		return m, nil
+	}
+
+	m.approval.Reply <- approved
+	verdict := "declined"
+	if approved {
+		verdict = "approved"
+	}
+	m.chatMessages[m.approvalIdx].content = m.approval.Preview + " (" + verdict + ")"
+	m.approval = nil
+	m.textarea.Placeholder = "Send a message..."
+	m.renderChatMessages()
+	return m, waitForAgentMsg(m.messagesChan)
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/quniob/shellm/agent"
+	"github.com/quniob/shellm/session"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/glamour"
+)
+
+func (m *model) renderMarkdown(content string) string {
+	r, _ := glamour.NewTermRenderer(
+		glamour.WithStylePath("dark"),
+		glamour.WithWordWrap(m.chatView.Width),
+	)
+	out, err := r.Render(content)
+	if err != nil {
+		out = content
+	}
+	out = strings.TrimPrefix(out, "\n")
+	out = strings.TrimSuffix(out, "\n")
+	out = strings.TrimSuffix(out, "\n")
+	return out
+}
+
+func (m *model) notice(content string) {
+	m.chatMessages = append(m.chatMessages, ChatMessage{sender: "shellm: ", content: content, style: m.toolStyle})
+	m.renderChatMessages()
+}
+
+func (m *model) logError(err error) {
+	m.logMessages = append(m.logMessages, ChatMessage{sender: "Error: ", content: err.Error(), style: m.errorStyle})
+	m.renderLogMessages()
+}
+
+// handleCommand runs a slash command typed in the input box. Commands that
+// start a run return the command waiting for its events.
+func (m *model) handleCommand(command string) tea.Cmd {
+	fields := strings.Fields(command)
+	switch fields[0] {
+	case "/plan":
+		return m.startPlan(strings.TrimSpace(strings.TrimPrefix(command, "/plan")))
+	case "/sessions":
+		m.listSessions()
+	case "/resume":
+		if len(fields) != 2 {
+			m.notice("usage: /resume <session-id>")
+			return nil
+		}
+		m.resumeSession(fields[1])
+	case "/fork":
+		m.forkSession()
+	case "/cost":
+		m.showCost()
+	case "/dry-run":
+		m.toggleDryRun(fields[1:])
+	default:
+		m.notice(fmt.Sprintf("unknown command %s (available: /plan <task>, /sessions, /resume <id>, /fork, /cost, /dry-run [on|off])", fields[0]))
+	}
+	return nil
+}
+
+// startRun shows the operator's input in the chat and runs the agent in the
+// background, returning the command that waits for its first event.
+func (m *model) startRun(input string, run func(ctx context.Context, msgCh chan<- tea.Msg)) tea.Cmd {
+	m.chatMessages = append(m.chatMessages, ChatMessage{sender: " : ", content: input, style: m.userStyle})
+	m.renderLogMessages()
+	m.renderChatMessages()
+	m.textarea.Reset()
+
+	m.thinking = true
+	m.textarea.Blur()
+
+	m.messagesChan = make(chan tea.Msg)
+	m.cancelRun = runAgent(m.Config.LLMTimeOut, m.messagesChan, run)
+	return waitForAgentMsg(m.messagesChan)
+}
+
+// saveSession stores the current conversation, starting a new session on
+// the first answer.
+func (m *model) saveSession() {
+	if m.Agent == nil {
+		return
+	}
+	if m.session == nil {
+		m.session = session.New(m.Config.ApiModel)
+	}
+	m.session.Update(m.Agent.Memory(), m.Config.ApiModel, m.Agent.GetStats())
+	if err := m.sessions.Save(m.session); err != nil {
+		m.logError(fmt.Errorf("saving session: %w", err))
+	}
+}
+
+func (m *model) listSessions() {
+	summaries, err := m.sessions.List()
+	if err != nil {
+		m.logError(err)
+		return
+	}
+	if len(summaries) == 0 {
+		m.notice("no saved sessions")
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString("saved sessions:\n")
+	for _, s := range summaries {
+		marker := " "
+		if m.session != nil && s.ID == m.session.ID {
+			marker = "*"
+		}
+		fmt.Fprintf(&b, "%s %s  %s  %-24s %6d tok  %s\n", marker, s.ID, s.UpdatedAt.Format("2006-01-02 15:04"), s.Model, s.TokenUsage, s.Title)
+	}
+	m.notice(b.String())
+}
+
+func (m *model) resumeSession(id string) {
+	if m.thinking {
+		m.notice("wait for the current run to finish")
+		return
+	}
+	s, err := m.sessions.Load(id)
+	if err != nil {
+		m.logError(err)
+		return
+	}
+
+	m.Agent.Restore(s.Messages, s.TokenUsage, s.Cost)
+	m.session = s
+	m.tokenUsage = s.TokenUsage
+	m.cost = s.Cost
+
+	// Rebuild the chat from operator messages and final answers; the
+	// intermediate steps are not replayed into the log pane.
+	m.chatMessages = m.chatMessages[:0]
+	for _, msg := range s.Messages {
+		switch {
+		case msg.Role == agent.RoleUser:
+			m.chatMessages = append(m.chatMessages, ChatMessage{sender: " : ", content: msg.Content, style: m.userStyle})
+		case msg.Role == agent.RoleAssistant && len(msg.ToolCalls) == 0 && msg.Content != "":
+			m.chatMessages = append(m.chatMessages, ChatMessage{sender: "󰚩 :", content: m.renderMarkdown(msg.Content), style: m.agentStyle})
+		}
+	}
+	m.notice(fmt.Sprintf("resumed session %s (%s)", s.ID, s.Model))
+}
+
+func (m *model) forkSession() {
+	if m.thinking {
+		m.notice("wait for the current run to finish")
+		return
+	}
+	if m.session == nil {
+		m.notice("nothing to fork yet")
+		return
+	}
+
+	m.session = m.session.Fork()
+	if err := m.sessions.Save(m.session); err != nil {
+		m.logError(err)
+		return
+	}
+	m.notice(fmt.Sprintf("forked into session %s", m.session.ID))
+}
+
+// toggleDryRun switches dry-run mode, or sets it with "on" or "off".
+func (m *model) toggleDryRun(args []string) {
+	if m.Agent == nil {
+		return
+	}
+	on := !m.Agent.DryRun()
+	if len(args) == 1 && (args[0] == "on" || args[0] == "off") {
+		on = args[0] == "on"
+	} else if len(args) > 0 {
+		m.notice("usage: /dry-run [on|off]")
+		return
+	}
+	m.Agent.SetDryRun(on)
+	if on {
+		m.notice("dry run on: calls that may change hosts are described instead of executed")
+	} else {
+		m.notice("dry run off")
+	}
+}
+
+// dropPartialStream discards what was streamed of a response that failed
+// before completing, since the retried call streams it again.
+func (m *model) dropPartialStream() {
+	if m.streamingLog {
+		m.logMessages = m.logMessages[:len(m.logMessages)-1]
+	}
+	if m.streamingAns {
+		m.chatMessages = m.chatMessages[:len(m.chatMessages)-1]
+	}
+	m.streamingLog, m.streamingAns = false, false
+}
+
+// showCost prints the token and cost breakdown of the session, today's
+// spending and the configured budgets.
+func (m *model) showCost() {
+	if m.Agent == nil {
+		return
+	}
+	stats := m.Agent.GetStats()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "session: %d tokens (prompt %d, cached %d, completion %d), $%.4f\n",
+		stats.TotalTokens(), stats.PromptTokens(), stats.CachedTokens(), stats.CompletionTokens(), stats.Cost())
+
+	if models := stats.ByModel(); len(models) > 0 {
+		fmt.Fprintf(&b, "\n%-32s %5s %9s %9s %9s %9s\n", "model", "calls", "prompt", "cached", "output", "cost")
+		for _, u := range models {
+			fmt.Fprintf(&b, "%-32s %5d %9d %9d %9d %9.4f\n", u.Model, u.Calls, u.Usage.PromptTokens, u.Usage.CachedTokens, u.Usage.CompletionTokens, u.Cost)
+		}
+	}
+
+	if steps := stats.Steps(); len(steps) > 0 {
+		b.WriteString("\nlast steps:\n")
+		for _, st := range steps[max(0, len(steps)-5):] {
+			fmt.Fprintf(&b, "  %s %-28s in %d (cached %d) out %d  $%.4f\n", st.Time.Format("15:04:05"), st.Model, st.Usage.PromptTokens, st.Usage.CachedTokens, st.Usage.CompletionTokens, st.Cost)
+		}
+	}
+
+	today, err := m.Agent.SpentToday()
+	if err != nil {
+		m.logError(err)
+	}
+	fmt.Fprintf(&b, "\ntoday: $%.4f\n", today)
+	fmt.Fprintf(&b, "budgets: run %s, session %s, day %s", budget(m.Config.BudgetRun), budget(m.Config.BudgetSession), budget(m.Config.BudgetDay))
+	if len(m.Config.Prices) == 0 {
+		b.WriteString("\nno prices configured, costs are not tracked")
+	}
+	m.notice(b.String())
+}
+
+func budget(limit float64) string {
+	if limit <= 0 {
+		return "none"
+	}
+	return "$" + strconv.FormatFloat(limit, 'f', -1, 64)
+}
+
+// finishRun returns the input to the operator once a run has ended.
+func (m *model) finishRun() {
+	m.streamingLog, m.streamingAns = false, false
+	m.thinking = false
+	m.cancelRun = nil
+	m.textarea.Placeholder = "Send a message..."
+	m.textarea.Focus()
+	m.saveSession()
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"strings"
@@ -9,14 +10,17 @@ import (
 
 	"github.com/quniob/shellm/agent"
 	"github.com/quniob/shellm/config"
+	"github.com/quniob/shellm/session"
 	"github.com/quniob/shellm/tools"
 
 	"github.com/charmbracelet/bubbles/spinner"
 	"github.com/charmbracelet/bubbles/textarea"
+	"github.com/charmbracelet/bubbles/textinput"
 	"github.com/charmbracelet/bubbles/viewport"
 	tea "github.com/charmbracelet/bubbletea"
-	"github.com/charmbracelet/glamour"
 	"github.com/charmbracelet/lipgloss"
+
+	"filippo.io/age"
 )
 
 func waitForAgentMsg(msgCh chan tea.Msg) tea.Cmd {
@@ -29,13 +33,21 @@ func waitForAgentMsg(msgCh chan tea.Msg) tea.Cmd {
 	}
 }
 
-func runAgent(timeout int, ag *agent.Agent, userInput string, msgCh chan tea.Msg) {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(timeout))
+// errCancelled is the cause reported when the operator cancels a run.
+var errCancelled = errors.New("cancelled by operator")
+
+// runAgent starts a run in the background and returns a function that
+// cancels it.
+func runAgent(timeout int, msgCh chan tea.Msg, run func(ctx context.Context, msgCh chan<- tea.Msg)) context.CancelCauseFunc {
+	ctx, cancelTimeout := context.WithTimeout(context.Background(), time.Second*time.Duration(timeout))
+	ctx, cancel := context.WithCancelCause(ctx)
 	go func() {
 		defer close(msgCh)
-		defer cancel()
-		ag.Start(ctx, userInput, msgCh)
+		defer cancelTimeout()
+		defer cancel(nil)
+		run(ctx, msgCh)
 	}()
+	return cancel
 }
 
 type ChatMessage struct {
@@ -48,14 +60,31 @@ type model struct {
 	logView      viewport.Model
 	chatView     viewport.Model
 	textarea     textarea.Model
+	unlockInput  textinput.Model
 	spinner      spinner.Model
 	thinking     bool
+	streamingLog bool
+	streamingAns bool
+	locked       bool
+	unlockErr    string
 	logMessages  []ChatMessage
 	chatMessages []ChatMessage
 	Agent        *agent.Agent
 	Config       *config.Config
+	sessions     *session.Store
+	session      *session.Session
 	tokenUsage   int
+	cost         float64
+	modelName    string
 	messagesChan chan tea.Msg
+	cancelRun    context.CancelCauseFunc
+	plan         *agent.Plan
+	planIdx      int
+	planCursor   int
+	planReview   bool
+	planEditing  bool
+	approval     *agent.ApprovalRequestMsg
+	approvalIdx  int
 	userStyle    lipgloss.Style
 	agentStyle   lipgloss.Style
 	toolStyle    lipgloss.Style
@@ -93,19 +122,49 @@ func (m *model) renderChatMessages() {
 	m.chatView.GotoBottom()
 }
 
+// setupAgent wires the tools and the agent once the inventory and secrets
+// have been loaded.
+func (m *model) setupAgent(hosts config.Hosts) error {
+	hosts.Store = config.NewSecretStore(m.Config)
+	hosts.Facts = config.NewFactsCache(m.Config)
+	hosts.HostKeys = config.NewHostKeys(m.Config)
+	hosts.Privacy = m.Config.PrivacyMode
+	hosts.ResolveAddresses(context.Background())
+	reg := tools.NewDefaultRegistry(&hosts)
+	ag, err := agent.NewAgent(reg, m.Config, &hosts)
+	if err != nil {
+		return err
+	}
+	m.Agent = ag
+	return nil
+}
+
 func initialModel() model {
 	cfg, err := config.LoadConfig()
 	if err != nil {
 		fmt.Println("Error loading config:", err)
 		return model{}
 	}
-	hosts, err := config.LoadHosts(cfg.InventoryPath, cfg.SecretsPath)
-	if err != nil {
+	var identities []age.Identity
+	if cfg.IdentityPath != "" {
+		identities, err = config.LoadIdentities(cfg.IdentityPath)
+		if err != nil {
+			fmt.Println("Error loading secrets identity:", err)
+			return model{}
+		}
+	}
+	hosts, err := config.LoadHosts(cfg.InventoryPath, cfg.SecretsPath, identities...)
+	locked := errors.Is(err, config.ErrIdentityRequired)
+	if err != nil && !locked {
 		fmt.Println("Error loading hosts:", err)
 		return model{}
 	}
-	reg := tools.NewRegistry(tools.Report{}, tools.Ping{}, tools.GetHosts{HostsData: &hosts}, tools.ExecuteCommand{HostsData: &hosts})
-	ag := agent.NewAgent(reg, cfg)
+
+	sessions, err := session.NewStore(cfg.SessionsPath)
+	if err != nil {
+		fmt.Println("Error opening sessions store:", err)
+		return model{}
+	}
 
 	ta := textarea.New()
 	ta.Placeholder = "Send a message..."
@@ -127,6 +186,15 @@ func initialModel() model {
 		Foreground(lipgloss.Color("8"))
 	ta.ShowLineNumbers = false
 
+	ui := textinput.New()
+	ui.Prompt = "Secrets are encrypted. Age identity or passphrase: "
+	ui.EchoMode = textinput.EchoPassword
+	ui.EchoCharacter = '*'
+	if locked {
+		ta.Blur()
+		ui.Focus()
+	}
+
 	lv := viewport.New(40, 20)
 	lv.SetContent("Logs")
 	cv := viewport.New(40, 20)
@@ -136,14 +204,16 @@ func initialModel() model {
 	s.Spinner = spinner.Dot
 	s.Style = lipgloss.NewStyle().Foreground(lipgloss.Color("205"))
 
-	return model{
+	m := model{
 		textarea:     ta,
+		unlockInput:  ui,
 		logView:      lv,
 		chatView:     cv,
 		spinner:      s,
+		locked:       locked,
+		sessions:     sessions,
 		logMessages:  []ChatMessage{},
 		chatMessages: []ChatMessage{},
-		Agent:        ag,
 		Config:       cfg,
 		tokenUsage:   0,
 		userStyle:    lipgloss.NewStyle().Foreground(lipgloss.Color("5")).Bold(true),
@@ -152,6 +222,45 @@ func initialModel() model {
 		thoughtStyle: lipgloss.NewStyle().Foreground(lipgloss.Color("8")).Italic(true),
 		errorStyle:   lipgloss.NewStyle().Foreground(lipgloss.Color("9")).Bold(true),
 	}
+	if !locked {
+		if err := m.setupAgent(hosts); err != nil {
+			fmt.Println("Error creating agent:", err)
+			return model{}
+		}
+	}
+	return m
+}
+
+// updateUnlock handles input while the secrets file is waiting for an age
+// identity. The agent is only created once decryption succeeds.
+func (m model) updateUnlock(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	if msg.Type != tea.KeyEnter {
+		var cmd tea.Cmd
+		m.unlockInput, cmd = m.unlockInput.Update(msg)
+		return m, cmd
+	}
+
+	identity, err := config.ParseIdentityInput(m.unlockInput.Value())
+	m.unlockInput.Reset()
+	if err != nil {
+		m.unlockErr = err.Error()
+		return m, nil
+	}
+	hosts, err := config.LoadHosts(m.Config.InventoryPath, m.Config.SecretsPath, identity)
+	if err != nil {
+		m.unlockErr = err.Error()
+		return m, nil
+	}
+
+	if err := m.setupAgent(hosts); err != nil {
+		m.unlockErr = err.Error()
+		return m, nil
+	}
+	m.locked = false
+	m.unlockErr = ""
+	m.unlockInput.Blur()
+	m.textarea.Focus()
+	return m, textarea.Blink
 }
 
 func (m model) Init() tea.Cmd {
@@ -171,6 +280,16 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		return m, nil
 	}
 
+	if key, ok := msg.(tea.KeyMsg); ok && m.locked && key.Type != tea.KeyCtrlC {
+		return m.updateUnlock(key)
+	}
+	if key, ok := msg.(tea.KeyMsg); ok && m.approval != nil && key.Type != tea.KeyCtrlC {
+		return m.updateApproval(key)
+	}
+	if key, ok := msg.(tea.KeyMsg); ok && m.planReview && !m.planEditing && key.Type != tea.KeyCtrlC {
+		return m.updatePlanReview(key)
+	}
+
 	m.textarea, tiCmd = m.textarea.Update(msg)
 	m.logView, lvCmd = m.logView.Update(msg)
 	m.chatView, cvCmd = m.chatView.Update(msg)
@@ -191,36 +310,111 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 
 	case tea.KeyMsg:
 		switch msg.Type {
-		case tea.KeyCtrlC, tea.KeyEsc:
+		case tea.KeyCtrlC:
+			if m.cancelRun != nil {
+				m.cancelRun(errCancelled)
+			}
 			return m, tea.Quit
+		case tea.KeyEsc:
+			if m.planEditing {
+				m.finishPlanEdit(false)
+				return m, nil
+			}
+			if !m.thinking {
+				return m, tea.Quit
+			}
+			if m.cancelRun != nil {
+				m.cancelRun(errCancelled)
+				m.textarea.Placeholder = "Cancelling..."
+			}
+			return m, nil
 		case tea.KeyEnter:
 			if m.thinking {
 				return m, nil
 			}
+			if m.planEditing {
+				m.finishPlanEdit(true)
+				return m, nil
+			}
+			if command := strings.TrimSpace(m.textarea.Value()); strings.HasPrefix(command, "/") {
+				m.textarea.Reset()
+				return m, m.handleCommand(command)
+			}
 			userInput := m.textarea.Value() + "\n"
 			if userInput == "" {
 				return m, nil
 			}
-			userMessage := ChatMessage{sender: " : ", content: userInput, style: m.userStyle}
-			m.chatMessages = append(m.chatMessages, userMessage)
-			m.renderLogMessages()
-			m.renderChatMessages()
-			m.textarea.Reset()
-
-			m.thinking = true
-			m.textarea.Blur()
-
-			m.messagesChan = make(chan tea.Msg)
-			runAgent(m.Config.LLMTimeOut, m.Agent, userInput, m.messagesChan)
-
-			return m, waitForAgentMsg(m.messagesChan)
+			ag := m.Agent
+			return m, m.startRun(userInput, func(ctx context.Context, msgCh chan<- tea.Msg) {
+				ag.Start(ctx, userInput, msgCh)
+			})
 		}
 
 	case agent.TokenUsageMsg:
 		m.tokenUsage = msg.Tokens
+		m.cost = msg.Cost
+		return m, waitForAgentMsg(m.messagesChan)
+	case agent.ThoughtDeltaMsg:
+		if !m.streamingLog {
+			m.logMessages = append(m.logMessages, ChatMessage{sender: "Thought: ", style: m.thoughtStyle})
+			m.streamingLog = true
+		}
+		m.logMessages[len(m.logMessages)-1].content += msg.Content
+		m.renderLogMessages()
 		return m, waitForAgentMsg(m.messagesChan)
 	case agent.ThoughtMsg:
-		m.logMessages = append(m.logMessages, ChatMessage{sender: "Thought: ", content: msg.Content, style: m.thoughtStyle})
+		if m.streamingLog {
+			m.logMessages[len(m.logMessages)-1].content = msg.Content
+			m.streamingLog = false
+		} else {
+			m.logMessages = append(m.logMessages, ChatMessage{sender: "Thought: ", content: msg.Content, style: m.thoughtStyle})
+		}
+		m.renderLogMessages()
+		return m, waitForAgentMsg(m.messagesChan)
+	case agent.ReportDeltaMsg:
+		if !m.streamingAns {
+			m.chatMessages = append(m.chatMessages, ChatMessage{sender: "󰚩 :", style: m.agentStyle})
+			m.streamingAns = true
+		}
+		m.chatMessages[len(m.chatMessages)-1].content = msg.Content
+		m.renderChatMessages()
+		return m, waitForAgentMsg(m.messagesChan)
+	case agent.BudgetMsg:
+		m.logMessages = append(m.logMessages, ChatMessage{sender: "Budget: ", content: msg.String(), style: m.errorStyle})
+		m.renderLogMessages()
+		return m, waitForAgentMsg(m.messagesChan)
+	case agent.RetryMsg:
+		m.dropPartialStream()
+		content := fmt.Sprintf("%s failed (%v), attempt %d in %s", msg.Model, msg.Err, msg.Attempt, msg.Delay.Round(time.Millisecond))
+		m.logMessages = append(m.logMessages, ChatMessage{sender: "Retry: ", content: content, style: m.errorStyle})
+		m.renderLogMessages()
+		m.renderChatMessages()
+		return m, waitForAgentMsg(m.messagesChan)
+	case agent.FallbackMsg:
+		m.dropPartialStream()
+		content := fmt.Sprintf("%s failed (%v), switching to %s", msg.From, msg.Err, msg.To)
+		m.logMessages = append(m.logMessages, ChatMessage{sender: "Fallback: ", content: content, style: m.errorStyle})
+		m.renderLogMessages()
+		m.renderChatMessages()
+		return m, waitForAgentMsg(m.messagesChan)
+	case agent.ModelMsg:
+		name := msg.Provider + ":" + msg.Model
+		if msg.Fallback {
+			name += " (fallback)"
+		}
+		if name != m.modelName && m.modelName != "" {
+			m.logMessages = append(m.logMessages, ChatMessage{sender: "Model: ", content: name, style: m.thoughtStyle})
+			m.renderLogMessages()
+		}
+		m.modelName = name
+		return m, waitForAgentMsg(m.messagesChan)
+	case agent.ContextCompactedMsg:
+		how := "dropped old messages"
+		if msg.Summarized {
+			how = "summarized earlier turns"
+		}
+		content := fmt.Sprintf("%s, ~%d -> ~%d tokens", how, msg.Before, msg.After)
+		m.logMessages = append(m.logMessages, ChatMessage{sender: "Context: ", content: content, style: m.thoughtStyle})
 		m.renderLogMessages()
 		return m, waitForAgentMsg(m.messagesChan)
 	case agent.ToolCallMsg:
@@ -232,31 +426,48 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		m.renderLogMessages()
 		return m, waitForAgentMsg(m.messagesChan)
 	case agent.FinalResultMsg:
-		r, _ := glamour.NewTermRenderer(
-			glamour.WithStylePath("dark"),
-			glamour.WithWordWrap(m.chatView.Width),
-		)
-		out, err := r.Render(msg.Content)
-		if err != nil {
-			out = msg.Content
-		}
-		out = strings.TrimPrefix(out, "\n")
-		out = strings.TrimSuffix(out, "\n")
-		out = strings.TrimSuffix(out, "\n")
+		out := m.renderMarkdown(msg.Content)
 
 		agentMessage := ChatMessage{sender: "󰚩 :", content: out, style: m.agentStyle}
-		m.chatMessages = append(m.chatMessages, agentMessage)
-		m.thinking = false
-		m.textarea.Placeholder = "Send a message..."
-		m.textarea.Focus()
+		if m.streamingAns {
+			m.chatMessages[len(m.chatMessages)-1] = agentMessage
+		} else {
+			m.chatMessages = append(m.chatMessages, agentMessage)
+		}
+		m.finishRun()
+		m.renderLogMessages()
+		m.renderChatMessages()
+		return m, nil
+	case agent.PlanMsg:
+		m.finishRun()
+		m.showPlan(msg.Plan)
+		m.renderLogMessages()
+		return m, nil
+	case agent.PlanStepMsg:
+		if m.plan != nil && msg.Index < len(m.plan.Steps) {
+			m.plan.Steps[msg.Index] = msg.Step
+			m.renderPlan()
+		}
+		return m, waitForAgentMsg(m.messagesChan)
+	case agent.ApprovalRequestMsg:
+		m.askApproval(msg)
+		return m, nil
+	case agent.CancelledMsg:
+		m.dropPartialStream()
+		reason := "cancelled"
+		if errors.Is(msg.Err, context.DeadlineExceeded) {
+			reason = fmt.Sprintf("timed out after %ds", m.Config.LLMTimeOut)
+		} else if msg.Err != nil {
+			reason = msg.Err.Error()
+		}
+		m.logMessages = append(m.logMessages, ChatMessage{sender: "Cancelled: ", content: reason, style: m.errorStyle})
+		m.finishRun()
 		m.renderLogMessages()
 		m.renderChatMessages()
 		return m, nil
 	case agent.ErrMsg:
 		m.logMessages = append(m.logMessages, ChatMessage{sender: "Error: ", content: msg.Err.Error(), style: m.errorStyle})
-		m.thinking = false
-		m.textarea.Placeholder = "Send a message..."
-		m.textarea.Focus()
+		m.finishRun()
 		m.renderLogMessages()
 
 		return m, nil
@@ -268,10 +479,27 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 func (m model) View() string {
 	var thinkingIndicator string
 	if m.thinking {
-		thinkingIndicator = m.spinner.View() + " Agent is thinking..."
+		thinkingIndicator = m.spinner.View() + " Agent is thinking... (esc to cancel)"
 	}
 
 	tokenUsageIndicator := fmt.Sprintf("Tokens usage: %d", m.tokenUsage)
+	if m.cost > 0 {
+		tokenUsageIndicator += fmt.Sprintf(" | Cost: $%.4f", m.cost)
+	}
+	if m.modelName != "" {
+		tokenUsageIndicator += " | Model: " + m.modelName
+	}
+	if m.Agent != nil && m.Agent.DryRun() {
+		tokenUsageIndicator += " | DRY RUN"
+	}
+
+	input := m.textarea.View()
+	if m.locked {
+		input = m.unlockInput.View()
+		if m.unlockErr != "" {
+			input += "\n" + m.errorStyle.Render(m.unlockErr)
+		}
+	}
 
 	separator := lipgloss.NewStyle().
 		Height(m.logView.Height).
@@ -290,7 +518,7 @@ func (m model) View() string {
 	return fmt.Sprintf(
 		"%s\n%s\n%s\n%s",
 		mainView,
-		m.textarea.View(),
+		input,
 		tokenUsageIndicator,
 		thinkingIndicator,
 	)
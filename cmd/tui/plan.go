@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/quniob/shellm/agent"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+const planHelp = "↑/↓ select · K/J move up/down · x strike · e edit command · enter run · q discard"
+
+var struckStyle = lipgloss.NewStyle().Strikethrough(true).Foreground(lipgloss.Color("240"))
+
+// startPlan asks the agent for a plan instead of running the task.
+func (m *model) startPlan(task string) tea.Cmd {
+	if task == "" {
+		m.notice("usage: /plan <task>")
+		return nil
+	}
+	ag := m.Agent
+	return m.startRun("/plan "+task, func(ctx context.Context, msgCh chan<- tea.Msg) {
+		ag.Plan(ctx, task, msgCh)
+	})
+}
+
+// showPlan puts a proposed plan up for review.
+func (m *model) showPlan(plan agent.Plan) {
+	m.plan = &plan
+	m.planCursor = 0
+	m.planReview = true
+	m.chatMessages = append(m.chatMessages, ChatMessage{sender: "Plan: ", style: m.toolStyle})
+	m.planIdx = len(m.chatMessages) - 1
+	m.renderPlan()
+	m.textarea.Blur()
+	m.textarea.Placeholder = "Review the plan: " + planHelp
+}
+
+// renderPlan redraws the plan block in the chat with the current statuses
+// and, during review, the selection.
+func (m *model) renderPlan() {
+	if m.plan == nil || m.planIdx >= len(m.chatMessages) {
+		return
+	}
+
+	var b strings.Builder
+	if m.plan.Summary != "" {
+		b.WriteString(m.plan.Summary + "\n\n")
+	}
+	for i, step := range m.plan.Steps {
+		cursor := "  "
+		if m.planReview && i == m.planCursor {
+			cursor = "› "
+		}
+
+		mark := "[ ]"
+		switch {
+		case step.Skip || step.Status == agent.StepSkipped:
+			mark = "[-]"
+		case step.Status == agent.StepRunning:
+			mark = "[~]"
+		case step.Status == agent.StepDone:
+			mark = "[✓]"
+		case step.Status == agent.StepFailed:
+			mark = "[✗]"
+		}
+
+		line := fmt.Sprintf("%d. %s", i+1, step.Description)
+		if step.Host != "" {
+			line += " @ " + step.Host
+		}
+		if step.Command != "" {
+			line += "\n      $ " + step.Command
+		}
+		if step.Expected != "" {
+			line += "\n      expect: " + step.Expected
+		}
+		if step.Skip {
+			line = struckStyle.Render(line)
+		}
+		fmt.Fprintf(&b, "%s%s %s\n", cursor, mark, line)
+		if step.Result != "" && step.Status != agent.StepRunning {
+			fmt.Fprintf(&b, "      → %s\n", firstLine(step.Result))
+		}
+	}
+	if m.planReview {
+		b.WriteString("\n" + planHelp)
+	}
+
+	m.chatMessages[m.planIdx].content = strings.TrimRight(b.String(), "\n")
+	m.renderChatMessages()
+}
+
+func firstLine(s string) string {
+	s = strings.TrimSpace(s)
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		return s[:i] + " …"
+	}
+	return s
+}
+
+// updatePlanReview handles keys while the operator reviews a plan.
+func (m model) updatePlanReview(key tea.KeyMsg) (tea.Model, tea.Cmd) {
+	steps := m.plan.Steps
+	switch key.String() {
+	case "up", "k":
+		if m.planCursor > 0 {
+			m.planCursor--
+		}
+	case "down", "j":
+		if m.planCursor < len(steps)-1 {
+			m.planCursor++
+		}
+	case "K", "shift+up":
+		if m.planCursor > 0 {
+			steps[m.planCursor-1], steps[m.planCursor] = steps[m.planCursor], steps[m.planCursor-1]
+			m.planCursor--
+		}
+	case "J", "shift+down":
+		if m.planCursor < len(steps)-1 {
+			steps[m.planCursor+1], steps[m.planCursor] = steps[m.planCursor], steps[m.planCursor+1]
+			m.planCursor++
+		}
+	case "x", " ":
+		steps[m.planCursor].Skip = !steps[m.planCursor].Skip
+	case "e":
+		m.planEditing = true
+		m.textarea.SetValue(steps[m.planCursor].Command)
+		m.textarea.Placeholder = "Command for this step; enter saves, esc cancels"
+		m.textarea.Focus()
+		return m, nil
+	case "enter", "a":
+		return m, m.executePlan()
+	case "q", "esc":
+		m.planReview = false
+		m.renderPlan()
+		m.plan = nil
+		m.textarea.Placeholder = "Send a message..."
+		m.textarea.Focus()
+		m.notice("plan discarded")
+		return m, nil
+	}
+	m.renderPlan()
+	return m, nil
+}
+
+// finishPlanEdit stores or discards the command typed for the selected step.
+func (m *model) finishPlanEdit(save bool) {
+	if save {
+		m.plan.Steps[m.planCursor].Command = strings.TrimSpace(m.textarea.Value())
+	}
+	m.planEditing = false
+	m.textarea.Reset()
+	m.textarea.Blur()
+	m.textarea.Placeholder = "Review the plan: " + planHelp
+	m.renderPlan()
+}
+
+// executePlan runs the reviewed plan.
+func (m *model) executePlan() tea.Cmd {
+	plan := *m.plan
+	plan.Steps = append([]agent.PlanStep{}, m.plan.Steps...)
+
+	m.planReview = false
+	m.renderPlan()
+	ag := m.Agent
+	return m.startRun("run the plan", func(ctx context.Context, msgCh chan<- tea.Msg) {
+		ag.ExecutePlan(ctx, plan, msgCh)
+	})
+}
@@ -1,41 +1,198 @@
 package config
 
 import (
+	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/spf13/viper"
 )
 
 type Config struct {
-	ApiKey           string `mapstructure:"api_key"`
-	ApiBaseUrl       string `mapstructure:"api_base_url"`
-	ApiModel         string `mapstructure:"api_model"`
-	InventoryPath    string `mapstructure:"inventory_path"`
-	SecretsPath      string `mapstructure:"secrets_path"`
-	LLMMaxIterations int    `mapstructure:"llm_max_iterations"`
-	LLMTimeOut       int    `mapstructure:"llm_timeout"`
+	ApiKey              string          `mapstructure:"api_key"`
+	ApiBaseUrl          string          `mapstructure:"api_base_url"`
+	ApiModel            string          `mapstructure:"api_model"`
+	InventoryPath       string          `mapstructure:"inventory_path"`
+	SecretsPath         string          `mapstructure:"secrets_path"`
+	IdentityPath        string          `mapstructure:"secrets_identity_path"`
+	LLMMaxIterations    int             `mapstructure:"llm_max_iterations"`
+	LLMTimeOut          int             `mapstructure:"llm_timeout"`
+	LLMStream           bool            `mapstructure:"llm_stream"`
+	ContextMaxTokens    int             `mapstructure:"context_max_tokens"`
+	ContextStrategy     string          `mapstructure:"context_strategy"`
+	ContextSummaryModel string          `mapstructure:"context_summary_model"`
+	SecretsCacheTTL     int             `mapstructure:"secrets_cache_ttl"`
+	VaultAddr           string          `mapstructure:"vault_addr"`
+	VaultToken          string          `mapstructure:"vault_token"`
+	VaultMount          string          `mapstructure:"vault_mount"`
+	VaultNamespace      string          `mapstructure:"vault_namespace"`
+	RedactDefaults      bool            `mapstructure:"redact_defaults"`
+	RedactPatterns      []string        `mapstructure:"redact_patterns"`
+	PrivacyMode         bool            `mapstructure:"privacy_mode"`
+	ParallelTools       bool            `mapstructure:"parallel_tool_calls"`
+	SessionsPath        string          `mapstructure:"sessions_path"`
+	Provider            string          `mapstructure:"provider"`
+	LLMMaxTokens        int             `mapstructure:"llm_max_tokens"`
+	ToolCallMode        string          `mapstructure:"tool_call_mode"`
+	LLMMaxRetries       int             `mapstructure:"llm_max_retries"`
+	LLMRetryMaxDelay    int             `mapstructure:"llm_retry_max_delay"`
+	FallbackModels      []FallbackModel `mapstructure:"fallback_models"`
+	Prices              []ModelPrice    `mapstructure:"prices"`
+	BudgetRun           float64         `mapstructure:"budget_run"`
+	BudgetSession       float64         `mapstructure:"budget_session"`
+	BudgetDay           float64         `mapstructure:"budget_day"`
+	UsageLedgerPath     string          `mapstructure:"usage_ledger_path"`
+	SystemPromptPath    string          `mapstructure:"system_prompt_path"`
+	PromptOverlays      []string        `mapstructure:"prompt_overlays"`
+	Operator            string          `mapstructure:"operator"`
+	PolicyRules         []string        `mapstructure:"policy_rules"`
+	DryRun              bool            `mapstructure:"dry_run"`
+	DryRunReadOnly      bool            `mapstructure:"dry_run_read_only"`
+	FactsCachePath      string          `mapstructure:"facts_cache_path"`
+	FactsCacheTTL       int             `mapstructure:"facts_cache_ttl"`
+	SSHKnownHostsPath   string          `mapstructure:"ssh_known_hosts_path"`
+	SSHIgnoreHostKeys   bool            `mapstructure:"ssh_ignore_host_keys"`
+}
+
+// FallbackModel is a model tried when the previous one in the list keeps
+// failing. Provider, base URL and key default to those of the main model.
+type FallbackModel struct {
+	Provider   string `mapstructure:"provider"`
+	Model      string `mapstructure:"model"`
+	ApiBaseUrl string `mapstructure:"api_base_url"`
+	ApiKey     string `mapstructure:"api_key"`
+}
+
+// ModelPrice is the price of a model in dollars per million tokens.
+// CachedInput applies to prompt tokens read from the provider's cache and
+// defaults to Input.
+type ModelPrice struct {
+	Model       string  `mapstructure:"model"`
+	Input       float64 `mapstructure:"input"`
+	Output      float64 `mapstructure:"output"`
+	CachedInput float64 `mapstructure:"cached_input"`
+}
+
+// defaultDataPath returns a location under the user's data directory
+// ($XDG_DATA_HOME/shellm, falling back to ~/.local/share/shellm).
+func defaultDataPath(name string) string {
+	base := os.Getenv("XDG_DATA_HOME")
+	if base == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return filepath.Join(".shellm", name)
+		}
+		base = filepath.Join(home, ".local", "share")
+	}
+	return filepath.Join(base, "shellm", name)
+}
+
+// defaultKnownHostsPath returns the known_hosts file of OpenSSH.
+func defaultKnownHostsPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join(".ssh", "known_hosts")
+	}
+	return filepath.Join(home, ".ssh", "known_hosts")
 }
 
 func LoadConfig() (*Config, error) {
 	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
 	viper.SetEnvPrefix("shellm")
 
-	viper.SetDefault("api_base_url", "https://openrouter.ai/api/v1")
+	viper.SetDefault("api_base_url", "")
 	viper.SetDefault("api_model", "google/gemini-2.5-pro")
 	viper.SetDefault("inventory_path", "./inventory")
 	viper.SetDefault("secrets_path", "./secrets")
 	viper.SetDefault("llm_max_iterations", 10)
 	viper.SetDefault("llm_timeout", 60)
+	viper.SetDefault("llm_stream", true)
+	viper.SetDefault("context_max_tokens", 100000)
+	viper.SetDefault("context_strategy", "summarize")
+	viper.SetDefault("context_summary_model", "")
+	viper.SetDefault("secrets_cache_ttl", 300)
+	viper.SetDefault("vault_addr", os.Getenv("VAULT_ADDR"))
+	viper.SetDefault("vault_token", os.Getenv("VAULT_TOKEN"))
+	viper.SetDefault("vault_mount", "secret")
+	viper.SetDefault("vault_namespace", os.Getenv("VAULT_NAMESPACE"))
+	viper.SetDefault("redact_defaults", true)
+	viper.SetDefault("redact_patterns", []string{})
+	viper.SetDefault("privacy_mode", false)
+	viper.SetDefault("parallel_tool_calls", true)
+	viper.SetDefault("sessions_path", defaultDataPath("sessions"))
+	viper.SetDefault("provider", "openai")
+	viper.SetDefault("llm_max_tokens", 4096)
+	viper.SetDefault("tool_call_mode", "auto")
+	viper.SetDefault("llm_max_retries", 3)
+	viper.SetDefault("llm_retry_max_delay", 30)
+	viper.SetDefault("budget_run", 0)
+	viper.SetDefault("budget_session", 0)
+	viper.SetDefault("budget_day", 0)
+	viper.SetDefault("usage_ledger_path", defaultDataPath("usage.jsonl"))
+	viper.SetDefault("system_prompt_path", "")
+	viper.SetDefault("prompt_overlays", []string{})
+	viper.SetDefault("operator", "")
+	viper.SetDefault("policy_rules", []string{})
+	viper.SetDefault("dry_run", false)
+	viper.SetDefault("dry_run_read_only", true)
+	viper.SetDefault("facts_cache_path", defaultDataPath("facts.json"))
+	viper.SetDefault("facts_cache_ttl", 86400)
+	viper.SetDefault("ssh_known_hosts_path", defaultKnownHostsPath())
+	viper.SetDefault("ssh_ignore_host_keys", false)
 
 	viper.BindEnv("api_key")
 	viper.BindEnv("api_base_url")
 	viper.BindEnv("api_model")
 	viper.BindEnv("inventory_path")
 	viper.BindEnv("secrets_path")
+	viper.BindEnv("secrets_identity_path")
 	viper.BindEnv("llm_max_iterations")
 	viper.BindEnv("llm_timeout")
+	viper.BindEnv("llm_stream")
+	viper.BindEnv("context_max_tokens")
+	viper.BindEnv("context_strategy")
+	viper.BindEnv("context_summary_model")
+	viper.BindEnv("secrets_cache_ttl")
+	viper.BindEnv("vault_addr")
+	viper.BindEnv("vault_token")
+	viper.BindEnv("vault_mount")
+	viper.BindEnv("vault_namespace")
+	viper.BindEnv("redact_defaults")
+	viper.BindEnv("privacy_mode")
+	viper.BindEnv("parallel_tool_calls")
+	viper.BindEnv("sessions_path")
+	viper.BindEnv("provider")
+	viper.BindEnv("llm_max_tokens")
+	viper.BindEnv("tool_call_mode")
+	viper.BindEnv("llm_max_retries")
+	viper.BindEnv("llm_retry_max_delay")
+	viper.BindEnv("budget_run")
+	viper.BindEnv("budget_session")
+	viper.BindEnv("budget_day")
+	viper.BindEnv("usage_ledger_path")
+	viper.BindEnv("system_prompt_path")
+	viper.BindEnv("operator")
+	viper.BindEnv("dry_run")
+	viper.BindEnv("dry_run_read_only")
+	viper.BindEnv("facts_cache_path")
+	viper.BindEnv("facts_cache_ttl")
 
 	viper.AutomaticEnv()
+
+	if path := os.Getenv("SHELLM_CONFIG"); path != "" {
+		viper.SetConfigFile(path)
+	} else {
+		viper.SetConfigName("shellm")
+		viper.SetConfigType("yaml")
+		viper.AddConfigPath(".")
+		viper.AddConfigPath("$HOME/.config/shellm")
+	}
+	if err := viper.ReadInConfig(); err != nil {
+		if _, ok := err.(viper.ConfigFileNotFoundError); !ok {
+			return nil, err
+		}
+	}
+
 	var cfg Config
 	if err := viper.Unmarshal(&cfg); err != nil {
 		return nil, err
@@ -0,0 +1,140 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HostFacts describes a host as gathered over SSH by the get_host_facts tool.
+type HostFacts struct {
+	CollectedAt    time.Time `json:"collected_at"`
+	OS             string    `json:"os,omitempty"`
+	Distro         string    `json:"distro,omitempty"`
+	DistroVersion  string    `json:"distro_version,omitempty"`
+	Kernel         string    `json:"kernel,omitempty"`
+	Arch           string    `json:"arch,omitempty"`
+	PackageManager string    `json:"package_manager,omitempty"`
+	InitSystem     string    `json:"init_system,omitempty"`
+	CPUs           int       `json:"cpus,omitempty"`
+	CPUModel       string    `json:"cpu_model,omitempty"`
+	MemoryMB       int64     `json:"memory_mb,omitempty"`
+	SwapMB         int64     `json:"swap_mb,omitempty"`
+	Disks          []Disk    `json:"disks,omitempty"`
+	IPs            []string  `json:"ips,omitempty"`
+}
+
+type Disk struct {
+	Mount      string `json:"mount"`
+	Device     string `json:"device"`
+	FSType     string `json:"fs_type,omitempty"`
+	SizeMB     int64  `json:"size_mb"`
+	UsedMB     int64  `json:"used_mb"`
+	UsePercent int    `json:"use_percent"`
+}
+
+// Summary is a one-line description of the host, e.g.
+// "Ubuntu 22.04.4 LTS, kernel 5.15.0-91-generic x86_64, 4 CPUs, 7.7 GiB RAM, apt, systemd".
+func (f HostFacts) Summary() string {
+	var parts []string
+	if f.OS != "" {
+		parts = append(parts, f.OS)
+	}
+	if f.Kernel != "" {
+		parts = append(parts, strings.TrimSpace("kernel "+f.Kernel+" "+f.Arch))
+	}
+	if f.CPUs > 0 {
+		parts = append(parts, fmt.Sprintf("%d CPUs", f.CPUs))
+	}
+	if f.MemoryMB > 0 {
+		parts = append(parts, fmt.Sprintf("%.1f GiB RAM", float64(f.MemoryMB)/1024))
+	}
+	for _, s := range []string{f.PackageManager, f.InitSystem} {
+		if s != "" {
+			parts = append(parts, s)
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// FactsCache keeps host facts in a JSON file so that they survive across
+// runs. Facts older than the TTL are not returned.
+type FactsCache struct {
+	path string
+	ttl  time.Duration
+
+	mu     sync.Mutex
+	facts  map[string]HostFacts
+	loaded bool
+}
+
+func NewFactsCache(cfg *Config) *FactsCache {
+	return &FactsCache{
+		path: cfg.FactsCachePath,
+		ttl:  time.Duration(cfg.FactsCacheTTL) * time.Second,
+	}
+}
+
+// load reads the cache file once; a missing or corrupt file starts an empty
+// cache. The caller holds the lock.
+func (c *FactsCache) load() {
+	if c.loaded {
+		return
+	}
+	c.loaded = true
+	c.facts = make(map[string]HostFacts)
+	if c.path == "" {
+		return
+	}
+	if data, err := os.ReadFile(c.path); err == nil {
+		json.Unmarshal(data, &c.facts)
+	}
+}
+
+// Get returns the cached facts of a host if they are still fresh.
+func (c *FactsCache) Get(hostID string) (HostFacts, bool) {
+	if c == nil {
+		return HostFacts{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.load()
+
+	f, ok := c.facts[hostID]
+	if !ok || (c.ttl > 0 && time.Since(f.CollectedAt) > c.ttl) {
+		return HostFacts{}, false
+	}
+	return f, true
+}
+
+// Put stores the facts of a host and writes the cache file.
+func (c *FactsCache) Put(hostID string, facts HostFacts) error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.load()
+
+	c.facts[hostID] = facts
+	if c.path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(c.facts, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0o700); err != nil {
+		return err
+	}
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
@@ -1,43 +1,50 @@
 package config
 
 import (
+	"fmt"
 	"os"
 
+	"filippo.io/age"
+	"github.com/go-playground/validator/v10"
 	"gopkg.in/yaml.v3"
 )
 
+const defaultSSHPort = 22
+
 type Host struct {
-	ID          string   `yaml:"id" validate:"required,alphanumeric"`
-	Host        string   `yaml:"host" validate:"hostname,required"`
-	Port        int      `yaml:"port" validate:"hostname_port"`
-	SecretRef   string   `yaml:"secretRef" validate:"alphanumeric"`
-	Description string   `yaml:"description" validate:"alphanumeric,omitempty"`
-	Tags        []string `yaml:"tags"`
+	ID          string   `yaml:"id" json:"id" validate:"required"`
+	Host        string   `yaml:"host" json:"host" validate:"required,hostname_rfc1123|ip"`
+	Port        int      `yaml:"port" json:"port" validate:"omitempty,min=1,max=65535"`
+	SecretRef   string   `yaml:"secretRef" json:"secretRef" validate:"required"`
+	Description string   `yaml:"description,omitempty" json:"description,omitempty"`
+	Tags        []string `yaml:"tags,omitempty" json:"tags,omitempty"`
+	OS          string   `yaml:"os,omitempty" json:"os,omitempty"`
 }
 
 type Hosts struct {
-	Hosts   map[string]Host `yaml:"hosts"`
-	Secrets map[string]Secret
+	Hosts    map[string]Host `yaml:"hosts"`
+	Secrets  map[string]Secret
+	Store    *SecretStore
+	Facts    *FactsCache
+	HostKeys *HostKeys
+	Privacy  bool
+
+	// resolved maps the IP addresses of hosts given by name to their IDs.
+	resolved map[string]string
 }
 
-func LoadHosts(inventoryPath string, secretsPath string) (Hosts, error) {
-	hostsData := []Host{}
+func LoadHosts(inventoryPath string, secretsPath string, identities ...age.Identity) (Hosts, error) {
 	hosts := Hosts{
 		Hosts:   make(map[string]Host),
 		Secrets: make(map[string]Secret),
 	}
 
-	fileContent, err := os.ReadFile(inventoryPath)
-	if err != nil {
-		return hosts, err
-	}
-
-	err = yaml.Unmarshal(fileContent, &hostsData)
+	hostsData, err := LoadInventory(inventoryPath)
 	if err != nil {
 		return hosts, err
 	}
 
-	secrets, err := LoadSecrets(secretsPath)
+	secrets, err := LoadSecrets(secretsPath, identities...)
 	if err != nil {
 		return hosts, err
 	}
@@ -50,10 +57,68 @@ func LoadHosts(inventoryPath string, secretsPath string) (Hosts, error) {
 	return hosts, nil
 }
 
+// LoadInventory reads the inventory file as an ordered list of hosts. Hosts
+// without an explicit port get the default SSH port.
+func LoadInventory(path string) ([]Host, error) {
+	var hostsData []Host
+
+	fileContent, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := yaml.Unmarshal(fileContent, &hostsData); err != nil {
+		return nil, err
+	}
+
+	for i := range hostsData {
+		if hostsData[i].Port == 0 {
+			hostsData[i].Port = defaultSSHPort
+		}
+	}
+
+	return hostsData, nil
+}
+
+// ValidateHost checks a single inventory entry against its validation tags.
+func ValidateHost(host Host) error {
+	v := validator.New()
+	if err := v.Struct(host); err != nil {
+		if validationErrors, ok := err.(validator.ValidationErrors); ok {
+			fieldError := validationErrors[0]
+			return fmt.Errorf(
+				"host '%s': validation failed for field '%s' on tag '%s'",
+				host.ID,
+				fieldError.Field(),
+				fieldError.Tag(),
+			)
+		}
+		return err
+	}
+	return nil
+}
+
 func (h *Hosts) List() []string {
-	list := make([]string, len(h.Hosts))
+	list := make([]string, 0, len(h.Hosts))
 	for _, host := range h.Hosts {
 		list = append(list, host.Host)
 	}
 	return list
 }
+
+// HasTags reports whether the host carries every one of the given tags.
+func (h Host) HasTags(tags ...string) bool {
+	for _, want := range tags {
+		found := false
+		for _, tag := range h.Tags {
+			if tag == want {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
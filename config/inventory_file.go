@@ -0,0 +1,120 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The inventory is edited through yaml.Node rather than []Host so that
+// comments and the order of existing entries survive a round trip.
+
+func readInventoryNode(path string) (*yaml.Node, *yaml.Node, error) {
+	var doc yaml.Node
+
+	fileContent, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+
+	if len(bytes.TrimSpace(fileContent)) > 0 {
+		if err := yaml.Unmarshal(fileContent, &doc); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if doc.Kind == 0 {
+		doc.Kind = yaml.DocumentNode
+	}
+	if len(doc.Content) == 0 {
+		doc.Content = append(doc.Content, &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"})
+	}
+
+	list := doc.Content[0]
+	if list.Kind != yaml.SequenceNode {
+		return nil, nil, fmt.Errorf("inventory '%s': expected a list of hosts", path)
+	}
+
+	return &doc, list, nil
+}
+
+func writeInventoryNode(path string, doc *yaml.Node) error {
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(doc); err != nil {
+		return err
+	}
+	if err := enc.Close(); err != nil {
+		return err
+	}
+
+	mode := os.FileMode(0o644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), mode); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func hostNodeID(node *yaml.Node) string {
+	if node.Kind != yaml.MappingNode {
+		return ""
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == "id" {
+			return node.Content[i+1].Value
+		}
+	}
+	return ""
+}
+
+// AddHost appends a host to the inventory file, keeping existing entries and
+// comments intact. It fails if a host with the same ID is already present.
+func AddHost(path string, host Host) error {
+	if err := ValidateHost(host); err != nil {
+		return err
+	}
+
+	doc, list, err := readInventoryNode(path)
+	if err != nil {
+		return err
+	}
+
+	for _, item := range list.Content {
+		if hostNodeID(item) == host.ID {
+			return fmt.Errorf("host '%s' already exists", host.ID)
+		}
+	}
+
+	var node yaml.Node
+	if err := node.Encode(host); err != nil {
+		return err
+	}
+	list.Content = append(list.Content, &node)
+
+	return writeInventoryNode(path, doc)
+}
+
+// RemoveHost deletes the host with the given ID from the inventory file.
+func RemoveHost(path string, id string) error {
+	doc, list, err := readInventoryNode(path)
+	if err != nil {
+		return err
+	}
+
+	for i, item := range list.Content {
+		if hostNodeID(item) == id {
+			list.Content = append(list.Content[:i], list.Content[i+1:]...)
+			return writeInventoryNode(path, doc)
+		}
+	}
+
+	return fmt.Errorf("host '%s' does not exist", id)
+}
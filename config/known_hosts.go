@@ -0,0 +1,83 @@
+package config
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"net"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// HostKeys verifies the keys presented by SSH servers against a known_hosts
+// file. A nil HostKeys refuses every key.
+type HostKeys struct {
+	path     string
+	check    ssh.HostKeyCallback
+	err      error
+	insecure bool
+}
+
+func NewHostKeys(cfg *Config) *HostKeys {
+	if cfg.SSHIgnoreHostKeys {
+		return &HostKeys{insecure: true}
+	}
+	check, err := knownhosts.New(cfg.SSHKnownHostsPath)
+	return &HostKeys{path: cfg.SSHKnownHostsPath, check: check, err: err}
+}
+
+// Callback returns the host key callback for an SSH client config. Its errors
+// all mention the host key, so that callers can tell them from others.
+func (k *HostKeys) Callback() ssh.HostKeyCallback {
+	switch {
+	case k == nil:
+		return func(string, net.Addr, ssh.PublicKey) error {
+			return errors.New("host key checking is not configured")
+		}
+	case k.insecure:
+		return ssh.InsecureIgnoreHostKey()
+	case k.err != nil:
+		return func(string, net.Addr, ssh.PublicKey) error {
+			return fmt.Errorf("cannot verify the host key: %w; set ssh_known_hosts_path or ssh_ignore_host_keys", k.err)
+		}
+	}
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := k.check(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		switch {
+		case errors.As(err, &keyErr) && len(keyErr.Want) == 0:
+			return fmt.Errorf("host key of %s is not in %s; add it with ssh-keyscan", hostname, k.path)
+		case errors.As(err, &keyErr):
+			return fmt.Errorf("host key of %s does not match %s:%d; it may have been replaced or the connection intercepted",
+				hostname, keyErr.Want[0].Filename, keyErr.Want[0].Line)
+		case err != nil:
+			return fmt.Errorf("host key of %s: %w", hostname, err)
+		}
+		return nil
+	}
+}
+
+// noKey is a key no host has, used to list the keys known for a host.
+var noKey, _ = ssh.NewPublicKey(ed25519.PublicKey(make([]byte, ed25519.PublicKeySize)))
+
+// Algorithms returns the host key algorithms of the keys known for a host, so
+// that the server is asked for a key that can be verified rather than one of
+// another type. It returns nil when any algorithm will do.
+func (k *HostKeys) Algorithms(hostname string, remote net.Addr) []string {
+	if k == nil || k.insecure || k.err != nil {
+		return nil
+	}
+	var keyErr *knownhosts.KeyError
+	if !errors.As(k.check(hostname, remote, noKey), &keyErr) {
+		return nil
+	}
+	var algorithms []string
+	for _, known := range keyErr.Want {
+		if known.Key.Type() == ssh.KeyAlgoRSA {
+			algorithms = append(algorithms, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256)
+		}
+		algorithms = append(algorithms, known.Key.Type())
+	}
+	return algorithms
+}
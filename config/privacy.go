@@ -0,0 +1,131 @@
+package config
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// In privacy mode the model never sees real host addresses. Tools replace
+// addresses in their output with placeholders and map placeholders back to
+// addresses locally before anything is executed.
+
+const (
+	placeholderPrefix = "<host:"
+	placeholderSuffix = ">"
+
+	resolveTimeout = 3 * time.Second
+)
+
+// Placeholder returns the token that stands in for the address of a host.
+func Placeholder(id string) string {
+	return placeholderPrefix + id + placeholderSuffix
+}
+
+// Mask replaces the addresses of inventory hosts in s with their placeholders,
+// including the IP addresses found by ResolveAddresses. It is a no-op unless
+// privacy mode is enabled.
+func (h *Hosts) Mask(s string) string {
+	if h == nil || !h.Privacy || s == "" {
+		return s
+	}
+
+	type address struct{ addr, id string }
+	addresses := make([]address, 0, len(h.Hosts)+len(h.resolved))
+	for _, host := range h.Hosts {
+		if host.Host != "" {
+			addresses = append(addresses, address{host.Host, host.ID})
+		}
+	}
+	for ip, id := range h.resolved {
+		addresses = append(addresses, address{ip, id})
+	}
+	// Longer addresses first so that "db.example.com" is not partially
+	// replaced by a host called "example.com".
+	sort.Slice(addresses, func(i, j int) bool { return len(addresses[i].addr) > len(addresses[j].addr) })
+
+	for _, a := range addresses {
+		s = replaceWord(s, a.addr, Placeholder(a.id))
+	}
+	return s
+}
+
+// ResolveAddresses looks up the IP addresses of inventory hosts given by name,
+// so that Mask also hides them when a tool prints the address it connected
+// to. Names that do not resolve in time are skipped. It is a no-op unless
+// privacy mode is enabled.
+func (h *Hosts) ResolveAddresses(ctx context.Context) {
+	if !h.Privacy {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, resolveTimeout)
+	defer cancel()
+
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	resolved := map[string]string{}
+	for _, host := range h.Hosts {
+		if host.Host == "" || net.ParseIP(host.Host) != nil {
+			continue
+		}
+		wg.Add(1)
+		go func(host Host) {
+			defer wg.Done()
+			ips, err := net.DefaultResolver.LookupIPAddr(ctx, host.Host)
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			for _, ip := range ips {
+				resolved[ip.IP.String()] = host.ID
+			}
+		}(host)
+	}
+	wg.Wait()
+	h.resolved = resolved
+}
+
+// Unmask turns placeholders in s back into real host addresses.
+func (h *Hosts) Unmask(s string) string {
+	if h == nil || !strings.Contains(s, placeholderPrefix) {
+		return s
+	}
+	for _, host := range h.Hosts {
+		s = strings.ReplaceAll(s, Placeholder(host.ID), host.Host)
+	}
+	return s
+}
+
+func isAddressChar(c byte) bool {
+	return c == '-' || c == '_' ||
+		('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9')
+}
+
+// replaceWord replaces occurrences of old that are not part of a longer
+// hostname or address, e.g. "10.0.0.1" inside "10.0.0.12" is left alone.
+func replaceWord(s, old, new string) string {
+	var b strings.Builder
+	for {
+		i := strings.Index(s, old)
+		if i < 0 {
+			b.WriteString(s)
+			return b.String()
+		}
+		end := i + len(old)
+		before := i == 0 || !(isAddressChar(s[i-1]) || s[i-1] == '.')
+		after := end == len(s) || !isAddressChar(s[end]) && !(s[end] == '.' && end+1 < len(s) && isAddressChar(s[end+1]))
+		if before && after {
+			b.WriteString(s[:i])
+			b.WriteString(new)
+		} else {
+			b.WriteString(s[:end])
+		}
+		s = s[end:]
+	}
+}
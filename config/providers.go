@@ -0,0 +1,288 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SecretProvider fetches the credential of a secret from an external store.
+// For password secrets the value is the password, for keyfile secrets it is
+// the private key material.
+type SecretProvider interface {
+	Fetch(ctx context.Context, secret Secret) (string, error)
+}
+
+// VaultProvider reads secrets from a HashiCorp Vault KV v2 engine over HTTP.
+type VaultProvider struct {
+	Addr      string
+	Token     string
+	Mount     string
+	Namespace string
+	Client    *http.Client
+}
+
+func (v VaultProvider) Fetch(ctx context.Context, secret Secret) (string, error) {
+	if v.Addr == "" {
+		return "", fmt.Errorf("vault address is not configured")
+	}
+
+	field := secret.Field
+	if field == "" {
+		field = "password"
+		if secret.Type == "keyfile" {
+			field = "private_key"
+		}
+	}
+
+	endpoint := fmt.Sprintf("%s/v1/%s/data/%s",
+		strings.TrimRight(v.Addr, "/"),
+		escapePath(v.Mount),
+		escapePath(secret.Path),
+	)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", v.Token)
+	if v.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.Namespace)
+	}
+
+	client := v.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("vault request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("vault returned %s for '%s'", resp.Status, secret.Path)
+	}
+
+	var body struct {
+		Data struct {
+			Data map[string]any `json:"data"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("vault response: %w", err)
+	}
+
+	value, ok := body.Data.Data[field].(string)
+	if !ok {
+		return "", fmt.Errorf("vault secret '%s' has no string field '%s'", secret.Path, field)
+	}
+	return value, nil
+}
+
+// escapePath escapes each segment of a slash-separated path, so that a nested
+// mount such as kv/team keeps its slashes.
+func escapePath(p string) string {
+	segments := strings.Split(strings.Trim(p, "/"), "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// PassProvider reads secrets from the standard unix password manager.
+// Password secrets use the first line of the entry, as pass itself does.
+type PassProvider struct{}
+
+func (PassProvider) Fetch(ctx context.Context, secret Secret) (string, error) {
+	out, err := runProviderCommand(ctx, exec.CommandContext(ctx, "pass", "show", secret.Path))
+	if err != nil {
+		return "", err
+	}
+	if secret.Type == "password" {
+		out, _, _ = strings.Cut(out, "\n")
+	}
+	return out, nil
+}
+
+// CommandProvider runs an arbitrary shell command and uses its stdout.
+type CommandProvider struct{}
+
+func (CommandProvider) Fetch(ctx context.Context, secret Secret) (string, error) {
+	return runProviderCommand(ctx, exec.CommandContext(ctx, "sh", "-c", secret.Command))
+}
+
+func runProviderCommand(ctx context.Context, cmd *exec.Cmd) (string, error) {
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%s: %w: %s", cmd.Args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimRight(string(out), "\r\n"), nil
+}
+
+type cachedSecret struct {
+	value   string
+	expires time.Time
+}
+
+// pendingSecret is a fetch in progress; done is closed once value and err
+// are set.
+type pendingSecret struct {
+	done  chan struct{}
+	value string
+	err   error
+}
+
+// SecretStore resolves provider-backed secrets lazily and caches the fetched
+// values for a limited time so that repeated connections do not hit the store.
+// Concurrent lookups of the same secret share one fetch; lookups of different
+// secrets do not wait for each other.
+type SecretStore struct {
+	providers map[string]SecretProvider
+	ttl       time.Duration
+
+	mu      sync.Mutex
+	cache   map[string]cachedSecret
+	pending map[string]*pendingSecret
+	// fetched holds every value fetched so far, cached or not, for the
+	// redactor.
+	fetched map[string]struct{}
+}
+
+func NewSecretStore(cfg *Config) *SecretStore {
+	return &SecretStore{
+		providers: map[string]SecretProvider{
+			"vault": VaultProvider{
+				Addr:      cfg.VaultAddr,
+				Token:     cfg.VaultToken,
+				Mount:     cfg.VaultMount,
+				Namespace: cfg.VaultNamespace,
+			},
+			"pass":    PassProvider{},
+			"command": CommandProvider{},
+		},
+		ttl:     time.Duration(cfg.SecretsCacheTTL) * time.Second,
+		cache:   make(map[string]cachedSecret),
+		pending: make(map[string]*pendingSecret),
+		fetched: make(map[string]struct{}),
+	}
+}
+
+func (s *SecretStore) Resolve(ctx context.Context, secret Secret) (string, error) {
+	provider, ok := s.providers[secret.Provider]
+	if !ok {
+		return "", fmt.Errorf("secret '%s': unknown provider '%s'", secret.ID, secret.Provider)
+	}
+
+	s.mu.Lock()
+	if cached, ok := s.cache[secret.ID]; ok && time.Now().Before(cached.expires) {
+		s.mu.Unlock()
+		return cached.value, nil
+	}
+	if p, ok := s.pending[secret.ID]; ok {
+		s.mu.Unlock()
+		select {
+		case <-p.done:
+			return p.value, p.err
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+	p := &pendingSecret{done: make(chan struct{})}
+	s.pending[secret.ID] = p
+	s.mu.Unlock()
+
+	value, err := provider.Fetch(ctx, secret)
+	if err != nil {
+		err = fmt.Errorf("secret '%s': %w", secret.ID, err)
+	}
+
+	s.mu.Lock()
+	if err == nil {
+		s.fetched[value] = struct{}{}
+		if s.ttl > 0 {
+			s.cache[secret.ID] = cachedSecret{value: value, expires: time.Now().Add(s.ttl)}
+		}
+	}
+	delete(s.pending, secret.ID)
+	s.mu.Unlock()
+
+	p.value, p.err = value, err
+	close(p.done)
+	return value, err
+}
+
+// Password returns the password of a password secret from whichever source
+// it is configured with.
+func (h *Hosts) Password(ctx context.Context, secret Secret) (string, error) {
+	switch {
+	case secret.Provider != "":
+		return h.resolve(ctx, secret)
+	case secret.Password == "" && secret.PasswordEnvKey != "":
+		passwd := os.Getenv(secret.PasswordEnvKey)
+		if passwd == "" {
+			return "", fmt.Errorf("Password environment variable '%s' is not set", secret.PasswordEnvKey)
+		}
+		return passwd, nil
+	default:
+		return secret.Password, nil
+	}
+}
+
+// PrivateKey returns the private key material of a keyfile secret.
+func (h *Hosts) PrivateKey(ctx context.Context, secret Secret) ([]byte, error) {
+	if secret.Provider != "" {
+		key, err := h.resolve(ctx, secret)
+		return []byte(key), err
+	}
+	return os.ReadFile(secret.KeyfilePath)
+}
+
+func (h *Hosts) resolve(ctx context.Context, secret Secret) (string, error) {
+	if h.Store == nil {
+		return "", fmt.Errorf("secret '%s' uses provider '%s' but no secret store is configured", secret.ID, secret.Provider)
+	}
+	return h.Store.Resolve(ctx, secret)
+}
+
+// Values returns every secret value fetched so far, including values that
+// were never cached or have expired.
+func (s *SecretStore) Values() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	values := make([]string, 0, len(s.fetched))
+	for value := range s.fetched {
+		values = append(values, value)
+	}
+	return values
+}
+
+// SecretValues lists every credential value known locally: inline and
+// environment passwords plus whatever the secret store has fetched so far.
+func (h *Hosts) SecretValues() []string {
+	var values []string
+	for _, secret := range h.Secrets {
+		if secret.Password != "" {
+			values = append(values, secret.Password)
+		}
+		if secret.PasswordEnvKey != "" {
+			if passwd := os.Getenv(secret.PasswordEnvKey); passwd != "" {
+				values = append(values, passwd)
+			}
+		}
+	}
+	if h.Store != nil {
+		values = append(values, h.Store.Values()...)
+	}
+	return values
+}
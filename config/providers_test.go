@@ -0,0 +1,80 @@
+package config
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestVaultProviderFetch(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "token" || r.Header.Get("X-Vault-Namespace") != "team-a" {
+			http.Error(w, `{"errors":["permission denied"]}`, http.StatusForbidden)
+			return
+		}
+		switch r.URL.EscapedPath() {
+		case "/v1/kv/team/data/ssh/deploy":
+			w.Write([]byte(`{"data":{"data":{"password":"s3cret","private_key":"KEY"},"metadata":{"version":3}}}`))
+		default:
+			http.Error(w, `{"errors":[]}`, http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	vault := VaultProvider{Addr: srv.URL + "/", Token: "token", Mount: "/kv/team/", Namespace: "team-a"}
+	tests := []struct {
+		name    string
+		secret  Secret
+		want    string
+		wantErr string
+	}{
+		{"password", Secret{ID: "a", Type: "password", Path: "ssh/deploy"}, "s3cret", ""},
+		{"keyfile", Secret{ID: "b", Type: "keyfile", Path: "/ssh/deploy"}, "KEY", ""},
+		{"field", Secret{ID: "c", Type: "password", Path: "ssh/deploy", Field: "private_key"}, "KEY", ""},
+		{"missing field", Secret{ID: "d", Type: "password", Path: "ssh/deploy", Field: "user"}, "", "no string field 'user'"},
+		{"not found", Secret{ID: "e", Type: "password", Path: "ssh/other"}, "", "404"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := vault.Fetch(context.Background(), tt.secret)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Fetch() error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Fetch() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Fetch() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	vault.Namespace = ""
+	if _, err := vault.Fetch(context.Background(), Secret{ID: "f", Type: "password", Path: "ssh/deploy"}); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("Fetch() without namespace error = %v, want 403", err)
+	}
+}
+
+type fakeProvider struct{ value string }
+
+func (p fakeProvider) Fetch(context.Context, Secret) (string, error) { return p.value, nil }
+
+func TestSecretStoreValuesWithoutCache(t *testing.T) {
+	store := NewSecretStore(&Config{SecretsCacheTTL: 0})
+	store.providers["fake"] = fakeProvider{value: "s3cret"}
+
+	if _, err := store.Resolve(context.Background(), Secret{ID: "a", Provider: "fake"}); err != nil {
+		t.Fatalf("Resolve() error = %v", err)
+	}
+	if len(store.cache) != 0 {
+		t.Errorf("cache = %v, want nothing cached with a zero TTL", store.cache)
+	}
+	if values := store.Values(); len(values) != 1 || values[0] != "s3cret" {
+		t.Errorf("Values() = %v, want [s3cret]", values)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 
+	"filippo.io/age"
 	"github.com/go-playground/validator/v10"
 	"gopkg.in/yaml.v3"
 )
@@ -12,37 +13,72 @@ type Secret struct {
 	ID             string `validate:"required" yaml:"id"`
 	Type           string `validate:"required,oneof=keyfile password" yaml:"type"`
 	User           string `validate:"required" yaml:"user"`
-	KeyfilePath    string `validate:"required_if=Type keyfile" yaml:"filepath"`
-	Password       string `validate:"excluded_with=PasswordEnvKey" yaml:"password"`
-	PasswordEnvKey string `validate:"excluded_with=Password" yaml:"passwordEnvKey"`
+	KeyfilePath    string `validate:"excluded_with=Provider" yaml:"filepath"`
+	Password       string `validate:"excluded_with=PasswordEnvKey Provider" yaml:"password"`
+	PasswordEnvKey string `validate:"excluded_with=Password Provider" yaml:"passwordEnvKey"`
+	Provider       string `validate:"omitempty,oneof=vault pass command" yaml:"provider"`
+	Path           string `validate:"required_if=Provider vault,required_if=Provider pass" yaml:"path"`
+	Field          string `yaml:"field"`
+	Command        string `validate:"required_if=Provider command" yaml:"command"`
 }
 
 func secretPasswordValidation(sl validator.StructLevel) {
 	secret := sl.Current().Interface().(Secret)
 
-	if secret.Type == "password" {
+	if secret.Provider != "" {
+		return
+	}
+
+	switch secret.Type {
+	case "password":
 		if secret.Password == "" && secret.PasswordEnvKey == "" {
-			sl.ReportError(secret.Password, "Password", "Password", "required_oneof", "either Password or PasswordEnvKey must be set")
+			sl.ReportError(secret.Password, "Password", "Password", "required_oneof", "either Password, PasswordEnvKey or Provider must be set")
+		}
+	case "keyfile":
+		if secret.KeyfilePath == "" {
+			sl.ReportError(secret.KeyfilePath, "KeyfilePath", "KeyfilePath", "required_oneof", "either KeyfilePath or Provider must be set")
 		}
 	}
 }
 
-func LoadSecrets(path string) (map[string]Secret, error) {
+// LoadSecrets reads the secrets file, transparently decrypting it when it is
+// age- or sops-encrypted. Age files need at least one matching identity.
+func LoadSecrets(path string, identities ...age.Identity) (map[string]Secret, error) {
 	secrets := make(map[string]Secret, 0)
-	var data []Secret
-
-	v := validator.New()
-	v.RegisterStructValidation(secretPasswordValidation, Secret{})
 
 	fileContent, err := os.ReadFile(path)
 	if err != nil {
 		return secrets, err
 	}
 
-	if err := yaml.Unmarshal(fileContent, &data); err != nil {
+	plain, err := DecryptSecrets(path, fileContent, identities...)
+	if err != nil {
 		return secrets, err
 	}
 
+	return ParseSecrets(plain)
+}
+
+// ParseSecrets parses and validates a plaintext secrets document. The document
+// is either a bare list of secrets or a mapping with a "secrets" list, which is
+// the shape sops needs for its metadata key.
+func ParseSecrets(fileContent []byte) (map[string]Secret, error) {
+	secrets := make(map[string]Secret, 0)
+	var data []Secret
+
+	v := validator.New()
+	v.RegisterStructValidation(secretPasswordValidation, Secret{})
+
+	if err := yaml.Unmarshal(fileContent, &data); err != nil {
+		var wrapped struct {
+			Secrets []Secret `yaml:"secrets"`
+		}
+		if wrappedErr := yaml.Unmarshal(fileContent, &wrapped); wrappedErr != nil {
+			return secrets, err
+		}
+		data = wrapped.Secrets
+	}
+
 	for _, secret := range data {
 		if err := v.Struct(secret); err != nil {
 			if validationErrors, ok := err.(validator.ValidationErrors); ok {
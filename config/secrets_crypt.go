@@ -0,0 +1,161 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"gopkg.in/yaml.v3"
+)
+
+type SecretsEncryption string
+
+const (
+	EncryptionNone SecretsEncryption = ""
+	EncryptionAge  SecretsEncryption = "age"
+	EncryptionSops SecretsEncryption = "sops"
+)
+
+const ageBinaryHeader = "age-encryption.org/v1"
+
+// ErrIdentityRequired is returned when the secrets file is age-encrypted and
+// no identity was supplied to decrypt it.
+var ErrIdentityRequired = errors.New("secrets file is age-encrypted and no identity was provided")
+
+// DetectSecretsEncryption tells whether the secrets file content is plaintext,
+// an age file (armored or binary) or a sops-encrypted YAML document.
+func DetectSecretsEncryption(data []byte) SecretsEncryption {
+	trimmed := bytes.TrimSpace(data)
+	if bytes.HasPrefix(trimmed, []byte(armor.Header)) || bytes.HasPrefix(trimmed, []byte(ageBinaryHeader)) {
+		return EncryptionAge
+	}
+
+	var doc map[string]any
+	if err := yaml.Unmarshal(data, &doc); err == nil {
+		if meta, ok := doc["sops"].(map[string]any); ok {
+			if _, ok := meta["mac"]; ok {
+				return EncryptionSops
+			}
+		}
+	}
+
+	return EncryptionNone
+}
+
+// DecryptSecrets returns the plaintext of a secrets file. Sops documents are
+// decrypted by the sops binary, which resolves keys through its own settings.
+func DecryptSecrets(path string, data []byte, identities ...age.Identity) ([]byte, error) {
+	switch DetectSecretsEncryption(data) {
+	case EncryptionAge:
+		if len(identities) == 0 {
+			return nil, ErrIdentityRequired
+		}
+		var src io.Reader = bytes.NewReader(data)
+		if bytes.HasPrefix(bytes.TrimSpace(data), []byte(armor.Header)) {
+			src = armor.NewReader(bytes.NewReader(bytes.TrimSpace(data)))
+		}
+		r, err := age.Decrypt(src, identities...)
+		if err != nil {
+			return nil, fmt.Errorf("decrypting secrets '%s': %w", path, err)
+		}
+		return io.ReadAll(r)
+	case EncryptionSops:
+		var stderr bytes.Buffer
+		cmd := exec.Command("sops", "--decrypt", "--input-type", "yaml", "--output-type", "yaml", path)
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("decrypting secrets '%s' with sops: %w: %s", path, err, strings.TrimSpace(stderr.String()))
+		}
+		return out, nil
+	default:
+		return data, nil
+	}
+}
+
+// AgeRecipientCount returns the number of recipient stanzas in the header of
+// an age file. The recipients themselves cannot be recovered from the stanzas.
+func AgeRecipientCount(data []byte) (int, error) {
+	var src io.Reader = bytes.NewReader(data)
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte(armor.Header)) {
+		src = armor.NewReader(bytes.NewReader(bytes.TrimSpace(data)))
+	}
+	r := bufio.NewReader(src)
+	if line, err := r.ReadString('\n'); err != nil || strings.TrimSpace(line) != ageBinaryHeader {
+		return 0, errors.New("not an age file")
+	}
+	count := 0
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return 0, fmt.Errorf("reading age header: %w", err)
+		}
+		if strings.HasPrefix(line, "---") {
+			return count, nil
+		}
+		if fields := strings.Fields(line); len(fields) > 1 && fields[0] == "->" && !strings.HasSuffix(fields[1], "-grease") {
+			count++
+		}
+	}
+}
+
+// EncryptSecrets encrypts a plaintext secrets document into an armored age
+// file for the given recipients.
+func EncryptSecrets(plain []byte, recipients ...age.Recipient) ([]byte, error) {
+	if len(recipients) == 0 {
+		return nil, errors.New("at least one recipient is required")
+	}
+
+	var buf bytes.Buffer
+	aw := armor.NewWriter(&buf)
+	w, err := age.Encrypt(aw, recipients...)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(plain); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	if err := aw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// LoadIdentities reads age identities from a key file as produced by age-keygen.
+func LoadIdentities(path string) ([]age.Identity, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	identities, err := age.ParseIdentities(f)
+	if err != nil {
+		return nil, fmt.Errorf("identity file '%s': %w", path, err)
+	}
+	return identities, nil
+}
+
+// ParseIdentityInput turns interactive input into an identity: an
+// AGE-SECRET-KEY-... string is used as an X25519 key, anything else as a
+// passphrase for scrypt-encrypted files.
+func ParseIdentityInput(input string) (age.Identity, error) {
+	input = strings.TrimSpace(input)
+	if input == "" {
+		return nil, errors.New("empty identity")
+	}
+	if strings.HasPrefix(input, "AGE-SECRET-KEY-") {
+		return age.ParseX25519Identity(input)
+	}
+	return age.NewScryptIdentity(input)
+}
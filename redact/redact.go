@@ -0,0 +1,92 @@
+package redact
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const Mask = "[REDACTED]"
+
+// minSecretLength keeps very short values (e.g. "1234") from masking
+// unrelated output.
+const minSecretLength = 4
+
+// DefaultPatterns cover credentials that commonly show up in command output.
+// When a pattern has a capture group only the first group is masked, so the
+// surrounding key stays readable.
+var DefaultPatterns = []string{
+	`-----BEGIN [A-Z0-9 ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z0-9 ]*PRIVATE KEY-----`,
+	`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`,
+	`(?i)aws_secret_access_key\s*[=:]\s*["']?([A-Za-z0-9/+=]{40})`,
+	`\bgh[pousr]_[A-Za-z0-9]{36,}\b`,
+	`\bglpat-[A-Za-z0-9_-]{20,}\b`,
+	`\bxox[abprs]-[A-Za-z0-9-]{10,}\b`,
+	`\bsk-[A-Za-z0-9_-]{20,}\b`,
+	`\beyJ[A-Za-z0-9_-]{8,}\.eyJ[A-Za-z0-9_-]{8,}\.[A-Za-z0-9_-]{8,}\b`,
+	`(?i)\bbearer\s+([A-Za-z0-9._~+/-]{16,}=*)`,
+	`(?i)\b(?:password|passwd|[a-z0-9]+_pwd|secret|token|api[_-]?key)\s*[=:]\s*["']?([^\s"']{4,})`,
+}
+
+// Redactor masks secret values and credential-looking strings in text.
+type Redactor struct {
+	patterns []*regexp.Regexp
+	values   func() []string
+}
+
+// New compiles the given patterns. Known secret values are obtained from
+// values on every call so that lazily fetched secrets are covered as well.
+func New(patterns []string, values func() []string) (*Redactor, error) {
+	r := &Redactor{values: values}
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, err
+		}
+		r.patterns = append(r.patterns, re)
+	}
+	return r, nil
+}
+
+func (r *Redactor) Redact(s string) string {
+	if r == nil || s == "" {
+		return s
+	}
+
+	if r.values != nil {
+		values := r.values()
+		// Longer values first so that a secret containing another one is
+		// masked as a whole.
+		sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+		for _, v := range values {
+			if len(v) >= minSecretLength {
+				s = strings.ReplaceAll(s, v, Mask)
+			}
+		}
+	}
+
+	for _, re := range r.patterns {
+		s = replace(re, s)
+	}
+	return s
+}
+
+func replace(re *regexp.Regexp, s string) string {
+	if re.NumSubexp() == 0 {
+		return re.ReplaceAllLiteralString(s, Mask)
+	}
+
+	var b strings.Builder
+	last := 0
+	for _, m := range re.FindAllStringSubmatchIndex(s, -1) {
+		start, end := m[2], m[3]
+		if start < 0 {
+			start, end = m[0], m[1]
+		}
+		b.WriteString(s[last:start])
+		b.WriteString(Mask)
+		last = end
+	}
+	b.WriteString(s[last:])
+	return b.String()
+}
@@ -0,0 +1,190 @@
+package session
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/quniob/shellm/agent"
+)
+
+const titleLength = 60
+
+var ErrNotFound = errors.New("session not found")
+
+// Session is a saved conversation: the full agent memory, including tool
+// calls and their results, plus the model and token usage it was run with.
+type Session struct {
+	ID         string          `json:"id"`
+	ParentID   string          `json:"parent_id,omitempty"`
+	Title      string          `json:"title"`
+	Model      string          `json:"model"`
+	CreatedAt  time.Time       `json:"created_at"`
+	UpdatedAt  time.Time       `json:"updated_at"`
+	TokenUsage int             `json:"token_usage"`
+	Cost       float64         `json:"cost,omitempty"`
+	Messages   []agent.Message `json:"messages"`
+}
+
+// Summary is the listing view of a session without its messages.
+type Summary struct {
+	ID         string    `json:"id"`
+	ParentID   string    `json:"parent_id,omitempty"`
+	Title      string    `json:"title"`
+	Model      string    `json:"model"`
+	UpdatedAt  time.Time `json:"updated_at"`
+	TokenUsage int       `json:"token_usage"`
+	Cost       float64   `json:"cost,omitempty"`
+	Messages   int       `json:"messages"`
+}
+
+// NewID returns a sortable, reasonably unique session ID.
+func NewID() string {
+	b := make([]byte, 3)
+	rand.Read(b)
+	return time.Now().Format("20060102-150405") + "-" + hex.EncodeToString(b)
+}
+
+func New(model string) *Session {
+	now := time.Now()
+	return &Session{ID: NewID(), Model: model, CreatedAt: now, UpdatedAt: now}
+}
+
+// Fork copies the session under a new ID so that the conversation can branch
+// off without touching the original.
+func (s *Session) Fork() *Session {
+	fork := New(s.Model)
+	fork.ParentID = s.ID
+	fork.Title = s.Title
+	fork.TokenUsage = s.TokenUsage
+	fork.Cost = s.Cost
+	fork.Messages = append([]agent.Message{}, s.Messages...)
+	return fork
+}
+
+// Update records the latest state of the conversation and derives the title
+// from the first operator message when it is not set yet.
+func (s *Session) Update(messages []agent.Message, model string, stats agent.UsageStats) {
+	s.Messages = messages
+	s.Model = model
+	s.TokenUsage = stats.TotalTokens()
+	s.Cost = stats.Cost()
+	s.UpdatedAt = time.Now()
+
+	if s.Title != "" {
+		return
+	}
+	for _, m := range messages {
+		if m.Role == agent.RoleUser {
+			title := strings.Join(strings.Fields(m.Content), " ")
+			if runes := []rune(title); len(runes) > titleLength {
+				title = string(runes[:titleLength]) + "..."
+			}
+			s.Title = title
+			return
+		}
+	}
+}
+
+// Store keeps sessions as one JSON file each in a directory.
+type Store struct {
+	dir string
+}
+
+func NewStore(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &Store{dir: dir}, nil
+}
+
+func (st *Store) path(id string) string {
+	return filepath.Join(st.dir, id+".json")
+}
+
+func validID(id string) error {
+	if id == "" || id == "." || id == ".." || strings.ContainsAny(id, `/\*?[`) {
+		return fmt.Errorf("invalid session ID '%s'", id)
+	}
+	return nil
+}
+
+func (st *Store) Save(s *Session) error {
+	if err := validID(s.ID); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := st.path(s.ID) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, st.path(s.ID))
+}
+
+// Load reads a session by ID. A unique prefix of an ID is accepted as well.
+func (st *Store) Load(id string) (*Session, error) {
+	if err := validID(id); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(st.path(id))
+	if errors.Is(err, os.ErrNotExist) {
+		matches, _ := filepath.Glob(filepath.Join(st.dir, id+"*.json"))
+		switch len(matches) {
+		case 0:
+			return nil, fmt.Errorf("%w: %s", ErrNotFound, id)
+		case 1:
+			data, err = os.ReadFile(matches[0])
+		default:
+			return nil, fmt.Errorf("session ID '%s' is ambiguous", id)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var s Session
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("session '%s': %w", id, err)
+	}
+	return &s, nil
+}
+
+// List returns all saved sessions, most recently updated first.
+func (st *Store) List() ([]Summary, error) {
+	files, err := filepath.Glob(filepath.Join(st.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	summaries := make([]Summary, 0, len(files))
+	for _, f := range files {
+		s, err := st.Load(strings.TrimSuffix(filepath.Base(f), ".json"))
+		if err != nil {
+			continue
+		}
+		summaries = append(summaries, Summary{
+			ID:         s.ID,
+			ParentID:   s.ParentID,
+			Title:      s.Title,
+			Model:      s.Model,
+			UpdatedAt:  s.UpdatedAt,
+			TokenUsage: s.TokenUsage,
+			Cost:       s.Cost,
+			Messages:   len(s.Messages),
+		})
+	}
+
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].UpdatedAt.After(summaries[j].UpdatedAt) })
+	return summaries, nil
+}
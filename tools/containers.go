@@ -0,0 +1,386 @@
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/quniob/shellm/config"
+)
+
+const (
+	defaultContainerLogLines = 100
+	maxContainerLogLines     = 1000
+)
+
+// containerRuntime picks docker or podman, unless one was asked for, and
+// falls back to sudo -n when the login user cannot reach the daemon.
+const containerRuntime = `rt=%s
+[ -n "$rt" ] || rt=$(command -v docker >/dev/null 2>&1 && echo docker || { command -v podman >/dev/null 2>&1 && echo podman; })
+[ -n "$rt" ] || { echo 'neither docker nor podman is installed' >&2; exit 127; }
+$rt version >/dev/null 2>&1 || rt="` + asRoot + ` $rt"
+`
+
+const (
+	containerListFormat  = `{{.ID}}\t{{.Names}}\t{{.Image}}\t{{.State}}\t{{.Status}}\t{{.Ports}}`
+	containerStatsFormat = `{{.ID}}\t{{.Name}}\t{{.CPUPerc}}\t{{.MemUsage}}\t{{.MemPerc}}\t{{.NetIO}}\t{{.BlockIO}}\t{{.PIDs}}`
+)
+
+type ContainersArgs struct {
+	HostID    string `json:"host_id"`
+	Action    string `json:"action"`
+	Container string `json:"container"`
+	All       bool   `json:"all"`
+	Lines     int    `json:"lines"`
+	Since     string `json:"since"`
+	Runtime   string `json:"runtime"`
+}
+
+type Containers struct {
+	HostsData *config.Hosts
+}
+
+func (Containers) Name() string { return "containers" }
+func (Containers) Description() string {
+	return "Works with Docker or Podman containers on a host and returns JSON. Actions: list (running containers, or all with all=true), " +
+		"inspect (state, health, restart count, image, mounts, networks and ports of a container), logs (recent lines, optionally since a time such as 10m), " +
+		"stats (CPU, memory, network and block I/O of one or all running containers) and restart."
+}
+func (Containers) Schema() map[string]any {
+	return map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"host_id": map[string]any{"type": "string"},
+			"action": map[string]any{
+				"type": "string",
+				"enum": []string{"list", "inspect", "logs", "stats", "restart"},
+			},
+			"container": map[string]any{"type": "string", "description": "container name or ID; required except for list and stats"},
+			"all":       map[string]any{"type": "boolean", "description": "list stopped containers too"},
+			"lines":     map[string]any{"type": "integer", "description": fmt.Sprintf("log lines to return (default %d, max %d)", defaultContainerLogLines, maxContainerLogLines)},
+			"since":     map[string]any{"type": "string", "description": "only logs since this time, e.g. 10m or 2024-05-01T10:00:00"},
+			"runtime":   map[string]any{"type": "string", "enum": []string{"docker", "podman"}, "description": "defaults to whichever is installed"},
+		},
+		"required": []string{"host_id", "action"},
+	}
+}
+
+func (Containers) Mutating(raw json.RawMessage) bool {
+	var args ContainersArgs
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return true
+	}
+	return args.Action == "restart"
+}
+
+func (Containers) Preview(raw json.RawMessage) string {
+	var args ContainersArgs
+	json.Unmarshal(raw, &args)
+	return fmt.Sprintf("would %s container %s on %s", args.Action, args.Container, args.HostID)
+}
+
+type ContainerSummary struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Image  string `json:"image"`
+	State  string `json:"state"`
+	Status string `json:"status"`
+	Ports  string `json:"ports,omitempty"`
+}
+
+type ContainerMount struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	ReadOnly    bool   `json:"read_only,omitempty"`
+}
+
+type ContainerDetails struct {
+	ID            string            `json:"id"`
+	Name          string            `json:"name"`
+	Image         string            `json:"image"`
+	Created       string            `json:"created"`
+	Command       []string          `json:"command,omitempty"`
+	Status        string            `json:"status"`
+	Health        string            `json:"health,omitempty"`
+	ExitCode      int               `json:"exit_code"`
+	Error         string            `json:"error,omitempty"`
+	OOMKilled     bool              `json:"oom_killed,omitempty"`
+	StartedAt     string            `json:"started_at,omitempty"`
+	FinishedAt    string            `json:"finished_at,omitempty"`
+	RestartCount  int               `json:"restart_count"`
+	RestartPolicy string            `json:"restart_policy,omitempty"`
+	Mounts        []ContainerMount  `json:"mounts,omitempty"`
+	Networks      map[string]string `json:"networks,omitempty"`
+	Ports         []string          `json:"ports,omitempty"`
+}
+
+type ContainerStats struct {
+	ID         string  `json:"id"`
+	Name       string  `json:"name"`
+	CPUPercent float64 `json:"cpu_percent"`
+	MemUsage   string  `json:"mem_usage"`
+	MemPercent float64 `json:"mem_percent"`
+	NetIO      string  `json:"net_io"`
+	BlockIO    string  `json:"block_io"`
+	PIDs       int     `json:"pids"`
+}
+
+type containerLogs struct {
+	Container string   `json:"container"`
+	Lines     []string `json:"lines"`
+}
+
+type containerActionResult struct {
+	Action string `json:"action"`
+	OK     bool   `json:"ok"`
+	Output string `json:"output,omitempty"`
+	Status string `json:"status"`
+}
+
+// inspectData is the part of docker and podman inspect output that is kept.
+type inspectData struct {
+	ID      string `json:"Id"`
+	Name    string
+	Created string
+	Config  struct {
+		Image string
+		Cmd   []string
+	}
+	State struct {
+		Status     string
+		ExitCode   int
+		Error      string
+		OOMKilled  bool
+		StartedAt  string
+		FinishedAt string
+		Health     *struct{ Status string }
+	}
+	RestartCount int
+	HostConfig   struct {
+		RestartPolicy struct{ Name string }
+	}
+	Mounts []struct {
+		Source      string
+		Destination string
+		RW          bool
+	}
+	NetworkSettings struct {
+		Networks map[string]struct{ IPAddress string }
+		Ports    map[string][]struct {
+			HostIP   string `json:"HostIp"`
+			HostPort string
+		}
+	}
+}
+
+func (c Containers) Call(ctx context.Context, raw json.RawMessage) (string, error) {
+	var args ContainersArgs
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return "", err
+	}
+	host := c.HostsData.Hosts[args.HostID]
+	if host.ID == "" {
+		return "", fmt.Errorf("Host with ID '%s' does not exist", args.HostID)
+	}
+	if args.Runtime != "" && args.Runtime != "docker" && args.Runtime != "podman" {
+		return "", fmt.Errorf("unknown runtime '%s'", args.Runtime)
+	}
+	if args.Container == "" && args.Action != "list" && args.Action != "stats" {
+		return "", fmt.Errorf("action '%s' needs a container", args.Action)
+	}
+
+	var result any
+	var err error
+	switch args.Action {
+	case "list":
+		result, err = c.list(ctx, host, args)
+	case "inspect":
+		result, err = c.inspect(ctx, host, args)
+	case "logs":
+		result, err = c.logs(ctx, host, args)
+	case "stats":
+		result, err = c.stats(ctx, host, args)
+	case "restart":
+		result, err = c.restart(ctx, host, args)
+	default:
+		return "", fmt.Errorf("unknown action '%s'", args.Action)
+	}
+	if err != nil {
+		return "", errors.New(c.HostsData.Mask(err.Error()))
+	}
+
+	out, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return c.HostsData.Mask(string(out)), nil
+}
+
+// run runs a container CLI command; $rt in command is the runtime.
+func (c Containers) run(ctx context.Context, host config.Host, runtime, command string) (string, error) {
+	script := fmt.Sprintf(containerRuntime, runtime) + command
+	return ExecuteCommand{HostsData: c.HostsData}.Run(ctx, host, script)
+}
+
+func (c Containers) list(ctx context.Context, host config.Host, args ContainersArgs) ([]ContainerSummary, error) {
+	command := "$rt ps --no-trunc --format " + shellQuote(containerListFormat)
+	if args.All {
+		command += " -a"
+	}
+	out, err := c.run(ctx, host, args.Runtime, command)
+	if err != nil {
+		return nil, err
+	}
+
+	containers := []ContainerSummary{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) < 6 {
+			continue
+		}
+		containers = append(containers, ContainerSummary{
+			ID:     shortID(fields[0]),
+			Name:   fields[1],
+			Image:  fields[2],
+			State:  fields[3],
+			Status: fields[4],
+			Ports:  fields[5],
+		})
+	}
+	return containers, nil
+}
+
+func (c Containers) inspect(ctx context.Context, host config.Host, args ContainersArgs) (ContainerDetails, error) {
+	out, err := c.run(ctx, host, args.Runtime, "$rt inspect --type container "+shellQuote(args.Container))
+	if err != nil {
+		return ContainerDetails{}, err
+	}
+	var data []inspectData
+	if err := json.Unmarshal([]byte(out), &data); err != nil {
+		return ContainerDetails{}, fmt.Errorf("parsing inspect output: %w", err)
+	}
+	if len(data) == 0 {
+		return ContainerDetails{}, fmt.Errorf("container '%s' not found", args.Container)
+	}
+	d := data[0]
+
+	details := ContainerDetails{
+		ID:            shortID(d.ID),
+		Name:          strings.TrimPrefix(d.Name, "/"),
+		Image:         d.Config.Image,
+		Created:       d.Created,
+		Command:       d.Config.Cmd,
+		Status:        d.State.Status,
+		ExitCode:      d.State.ExitCode,
+		Error:         d.State.Error,
+		OOMKilled:     d.State.OOMKilled,
+		StartedAt:     d.State.StartedAt,
+		FinishedAt:    d.State.FinishedAt,
+		RestartCount:  d.RestartCount,
+		RestartPolicy: d.HostConfig.RestartPolicy.Name,
+	}
+	if d.State.Health != nil {
+		details.Health = d.State.Health.Status
+	}
+	for _, m := range d.Mounts {
+		details.Mounts = append(details.Mounts, ContainerMount{Source: m.Source, Destination: m.Destination, ReadOnly: !m.RW})
+	}
+	if len(d.NetworkSettings.Networks) > 0 {
+		details.Networks = map[string]string{}
+		for name, n := range d.NetworkSettings.Networks {
+			details.Networks[name] = n.IPAddress
+		}
+	}
+	for port, bindings := range d.NetworkSettings.Ports {
+		if len(bindings) == 0 {
+			details.Ports = append(details.Ports, port)
+		}
+		for _, b := range bindings {
+			details.Ports = append(details.Ports, fmt.Sprintf("%s:%s->%s", b.HostIP, b.HostPort, port))
+		}
+	}
+	sort.Strings(details.Ports)
+	return details, nil
+}
+
+func (c Containers) logs(ctx context.Context, host config.Host, args ContainersArgs) (containerLogs, error) {
+	lines := args.Lines
+	if lines <= 0 {
+		lines = defaultContainerLogLines
+	}
+	lines = min(lines, maxContainerLogLines)
+	command := fmt.Sprintf("$rt logs --timestamps --tail %d", lines)
+	if args.Since != "" {
+		command += " --since " + shellQuote(args.Since)
+	}
+	out, err := c.run(ctx, host, args.Runtime, command+" "+shellQuote(args.Container)+" 2>&1")
+	if err != nil {
+		return containerLogs{}, err
+	}
+	result := containerLogs{Container: args.Container, Lines: []string{}}
+	if out = strings.TrimRight(out, "\n"); out != "" {
+		result.Lines = strings.Split(out, "\n")
+	}
+	return result, nil
+}
+
+func (c Containers) stats(ctx context.Context, host config.Host, args ContainersArgs) ([]ContainerStats, error) {
+	command := "$rt stats --no-stream --format " + shellQuote(containerStatsFormat)
+	if args.Container != "" {
+		command += " " + shellQuote(args.Container)
+	}
+	out, err := c.run(ctx, host, args.Runtime, command)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := []ContainerStats{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) < 8 {
+			continue
+		}
+		s := ContainerStats{
+			ID:       shortID(fields[0]),
+			Name:     fields[1],
+			MemUsage: fields[3],
+			NetIO:    fields[5],
+			BlockIO:  fields[6],
+		}
+		s.CPUPercent, _ = strconv.ParseFloat(strings.TrimSuffix(fields[2], "%"), 64)
+		s.MemPercent, _ = strconv.ParseFloat(strings.TrimSuffix(fields[4], "%"), 64)
+		s.PIDs, _ = strconv.Atoi(fields[7])
+		stats = append(stats, s)
+	}
+	return stats, nil
+}
+
+// restart restarts a container and reads its status afterwards.
+func (c Containers) restart(ctx context.Context, host config.Host, args ContainersArgs) (containerActionResult, error) {
+	name := shellQuote(args.Container)
+	command := "$rt restart " + name + ` 2>&1; echo "### rc=$?"; $rt inspect --type container --format '{{.State.Status}}' ` + name + " 2>&1"
+	out, err := c.run(ctx, host, args.Runtime, command)
+	if err != nil {
+		return containerActionResult{}, err
+	}
+
+	output, status, _ := strings.Cut(out, "### rc=")
+	rc, status, _ := strings.Cut(status, "\n")
+	return containerActionResult{
+		Action: "restart",
+		OK:     strings.TrimSpace(rc) == "0",
+		Output: strings.TrimSpace(output),
+		Status: strings.TrimSpace(status),
+	}, nil
+}
+
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
@@ -0,0 +1,174 @@
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/quniob/shellm/config"
+)
+
+var dnsTypes = []string{"A", "AAAA", "CNAME", "MX", "NS", "TXT", "SRV", "PTR"}
+
+// firstNameserver prints the resolver a host uses.
+const firstNameserver = `awk '/^nameserver/ {print $2; exit}' /etc/resolv.conf`
+
+type DNSLookupArgs struct {
+	HostID  string `json:"host_id"`
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Server  string `json:"server"`
+	Timeout int    `json:"timeout"`
+}
+
+type DNSLookup struct {
+	HostsData *config.Hosts
+}
+
+func (DNSLookup) Name() string                  { return "dns_lookup" }
+func (DNSLookup) Mutating(json.RawMessage) bool { return false }
+func (DNSLookup) Description() string {
+	return "Resolves a name and returns the records as JSON. Types: A, AAAA, CNAME, MX, NS, TXT, SRV and PTR (give an IP address as the name). " +
+		"Set server to ask a specific DNS server, and host_id to resolve from an inventory host; the host's first nameserver is then asked over TCP."
+}
+func (DNSLookup) Schema() map[string]any {
+	return map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"host_id": map[string]any{"type": "string", "description": "inventory host to resolve from; omit to resolve locally"},
+			"name":    map[string]any{"type": "string"},
+			"type":    map[string]any{"type": "string", "enum": dnsTypes, "description": "record type (default A)"},
+			"server":  map[string]any{"type": "string", "description": "DNS server as ip or ip:port"},
+			"timeout": map[string]any{"type": "integer", "description": fmt.Sprintf("seconds (default %d, max %d)", defaultCheckTimeout, maxCheckTimeout)},
+		},
+		"required": []string{"name"},
+	}
+}
+
+type dnsResult struct {
+	From       string   `json:"from"`
+	Name       string   `json:"name"`
+	Type       string   `json:"type"`
+	Server     string   `json:"server,omitempty"`
+	Records    []string `json:"records"`
+	NotFound   bool     `json:"not_found,omitempty"`
+	Error      string   `json:"error,omitempty"`
+	DurationMS float64  `json:"duration_ms"`
+}
+
+func (d DNSLookup) Call(ctx context.Context, raw json.RawMessage) (string, error) {
+	var args DNSLookupArgs
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return "", err
+	}
+	name := d.HostsData.Unmask(args.Name)
+	server := d.HostsData.Unmask(args.Server)
+	typ := strings.ToUpper(args.Type)
+	if typ == "" {
+		typ = "A"
+	}
+	if !slices.Contains(dnsTypes, typ) {
+		return "", fmt.Errorf("unknown record type '%s'", args.Type)
+	}
+
+	o, err := newOrigin(d.HostsData, args.HostID)
+	if err != nil {
+		return "", err
+	}
+	defer o.Close()
+	ctx, cancel := checkContext(ctx, args.Timeout)
+	defer cancel()
+
+	if server == "" && o.Remote() {
+		out, err := o.run(ctx, firstNameserver)
+		if err != nil {
+			return "", errors.New(d.HostsData.Mask(err.Error()))
+		}
+		if server = strings.TrimSpace(out); server == "" {
+			return "", fmt.Errorf("no nameserver configured on %s", o.Name())
+		}
+	}
+	if _, _, err := net.SplitHostPort(server); server != "" && err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+
+	resolver := net.DefaultResolver
+	if server != "" {
+		resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return o.DialContext(ctx, network, server)
+			},
+		}
+	}
+
+	result := dnsResult{From: o.Name(), Name: name, Type: typ, Server: server}
+	start := time.Now()
+	result.Records, err = lookup(ctx, resolver, typ, name)
+	result.DurationMS = millis(time.Since(start))
+	var dnsErr *net.DNSError
+	switch {
+	case errors.As(err, &dnsErr) && dnsErr.IsNotFound:
+		result.NotFound = true
+	case err != nil:
+		result.Error = err.Error()
+	}
+	if result.Records == nil {
+		result.Records = []string{}
+	}
+
+	out, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return d.HostsData.Mask(string(out)), nil
+}
+
+func lookup(ctx context.Context, r *net.Resolver, typ, name string) ([]string, error) {
+	var records []string
+	switch typ {
+	case "A", "AAAA":
+		network := "ip4"
+		if typ == "AAAA" {
+			network = "ip6"
+		}
+		ips, err := r.LookupIP(ctx, network, name)
+		for _, ip := range ips {
+			records = append(records, ip.String())
+		}
+		return records, err
+	case "CNAME":
+		cname, err := r.LookupCNAME(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		return []string{cname}, nil
+	case "MX":
+		mxs, err := r.LookupMX(ctx, name)
+		for _, mx := range mxs {
+			records = append(records, fmt.Sprintf("%d %s", mx.Pref, mx.Host))
+		}
+		return records, err
+	case "NS":
+		nss, err := r.LookupNS(ctx, name)
+		for _, ns := range nss {
+			records = append(records, ns.Host)
+		}
+		return records, err
+	case "TXT":
+		return r.LookupTXT(ctx, name)
+	case "SRV":
+		_, srvs, err := r.LookupSRV(ctx, "", "", name)
+		for _, srv := range srvs {
+			records = append(records, fmt.Sprintf("%d %d %d %s", srv.Priority, srv.Weight, srv.Port, srv.Target))
+		}
+		return records, err
+	default:
+		return r.LookupAddr(ctx, name)
+	}
+}
@@ -3,8 +3,11 @@ package tools
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"os"
+	"net"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/quniob/shellm/config"
@@ -22,6 +25,25 @@ type ExecuteCommand struct {
 }
 
 func (ExecuteCommand) Name() string { return "execute_command" }
+
+// Mutating treats a command as read-only only when the command policy knows
+// every program in it; see ReadOnlyCommand.
+func (ExecuteCommand) Mutating(raw json.RawMessage) bool {
+	var args ExecuteCommandArgs
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return true
+	}
+	return !ReadOnlyCommand(args.Command)
+}
+
+func (ExecuteCommand) Preview(raw json.RawMessage) string {
+	var args ExecuteCommandArgs
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return fmt.Sprintf("would run execute_command(%s)", raw)
+	}
+	return fmt.Sprintf("would run `%s` on %s", args.Command, args.HostID)
+}
+
 func (ExecuteCommand) Description() string {
 	return "Executes given command on the specified host. Host ID can be obtained from the get_hosts tool."
 }
@@ -44,24 +66,24 @@ func (e ExecuteCommand) Call(ctx context.Context, raw json.RawMessage) (string,
 	if host.ID == "" {
 		return "", fmt.Errorf("Host with ID '%s' does not exist", args.HostID)
 	}
-	return e.Run(ctx, host, args.Command)
+	out, err := e.Run(ctx, host, e.HostsData.Unmask(args.Command))
+	if err != nil {
+		return "", errors.New(e.HostsData.Mask(err.Error()))
+	}
+	return e.HostsData.Mask(out), nil
 }
 
-func (e ExecuteCommand) getSSHConfig(secret config.Secret) (*ssh.ClientConfig, error) {
+func (e ExecuteCommand) getSSHConfig(ctx context.Context, secret config.Secret) (*ssh.ClientConfig, error) {
 	var authMethod ssh.AuthMethod
 	switch secret.Type {
 	case "password":
-		if secret.Password == "" && secret.PasswordEnvKey != "" {
-			passwd := os.Getenv(secret.PasswordEnvKey)
-			if passwd == "" {
-				return nil, fmt.Errorf("Password environment variable '%s' is not set", secret.PasswordEnvKey)
-			}
-			authMethod = ssh.Password(passwd)
-		} else {
-			authMethod = ssh.Password(secret.Password)
+		passwd, err := e.HostsData.Password(ctx, secret)
+		if err != nil {
+			return nil, err
 		}
+		authMethod = ssh.Password(passwd)
 	case "keyfile":
-		key, err := os.ReadFile(secret.KeyfilePath)
+		key, err := e.HostsData.PrivateKey(ctx, secret)
 		if err != nil {
 			return nil, fmt.Errorf("Unable to read private key: %w", err)
 		}
@@ -79,22 +101,46 @@ func (e ExecuteCommand) getSSHConfig(secret config.Secret) (*ssh.ClientConfig, e
 		Auth: []ssh.AuthMethod{
 			authMethod,
 		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		HostKeyCallback: e.HostsData.HostKeys.Callback(),
 		Timeout:         5 * time.Second,
 	}, nil
 }
 
-func (e ExecuteCommand) Run(ctx context.Context, host config.Host, command string) (string, error) {
-	secret := e.HostsData.Secrets[host.SecretRef]
-	config, err := e.getSSHConfig(secret)
+// Dial opens an authenticated SSH connection to the host. The TCP connect and
+// the SSH handshake are both bounded by the client config timeout.
+func (e ExecuteCommand) Dial(ctx context.Context, host config.Host) (*ssh.Client, error) {
+	secret, ok := e.HostsData.Secrets[host.SecretRef]
+	if !ok {
+		return nil, fmt.Errorf("Secret '%s' for host '%s' does not exist", host.SecretRef, host.ID)
+	}
+	config, err := e.getSSHConfig(ctx, secret)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+
+	addr := net.JoinHostPort(host.Host, strconv.Itoa(host.Port))
+	dialer := net.Dialer{Timeout: config.Timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to dial: %w", err)
 	}
 
-	addr := fmt.Sprintf("%s:%d", host.Host, host.Port)
-	client, err := ssh.Dial("tcp", addr, config)
+	config.HostKeyAlgorithms = e.HostsData.HostKeys.Algorithms(addr, conn.RemoteAddr())
+	conn.SetDeadline(time.Now().Add(config.Timeout))
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Failed to dial: %w", err)
+	}
+	conn.SetDeadline(time.Time{})
+
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+func (e ExecuteCommand) Run(ctx context.Context, host config.Host, command string) (string, error) {
+	client, err := e.Dial(ctx, host)
 	if err != nil {
-		return "", fmt.Errorf("Failed to dial: %w", err)
+		return "", err
 	}
 	defer client.Close()
 
@@ -127,3 +173,16 @@ func (e ExecuteCommand) Run(ctx context.Context, host config.Host, command strin
 		return res.output, res.err
 	}
 }
+
+// shellQuote quotes s as a single word for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// asRoot expands to sudo -n unless the login user is root, so that a
+// command fails instead of waiting for a password.
+const asRoot = `$([ "$(id -u)" -eq 0 ] || echo sudo -n)`
+
+func privileged(command string) string {
+	return asRoot + " " + command
+}
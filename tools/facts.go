@@ -0,0 +1,211 @@
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/quniob/shellm/config"
+)
+
+// detectPackageManager prints the first package manager found on the host.
+const detectPackageManager = `for p in apt-get dnf yum zypper apk pacman; do command -v $p >/dev/null 2>&1 && { echo $p; break; }; done; true`
+
+// factsScript prints every fact in its own section so that one SSH session
+// is enough. Each command falls back to something busybox provides.
+const factsScript = `echo '### os-release'; cat /etc/os-release 2>/dev/null
+echo '### kernel'; uname -r; uname -m
+echo '### package-manager'; ` + detectPackageManager + `
+echo '### init'; cat /proc/1/comm 2>/dev/null
+echo '### cpu'; nproc 2>/dev/null || grep -c ^processor /proc/cpuinfo; grep -m1 -i '^model name' /proc/cpuinfo
+echo '### memory'; grep -E '^(MemTotal|SwapTotal):' /proc/meminfo
+echo '### disks'; df -PkT -x tmpfs -x devtmpfs -x squashfs -x overlay 2>/dev/null || df -Pk
+echo '### ips'; ip -o addr show scope global 2>/dev/null || hostname -i 2>/dev/null`
+
+type GetHostFactsArgs struct {
+	HostID  string `json:"host_id"`
+	Refresh bool   `json:"refresh"`
+}
+
+type GetHostFacts struct {
+	HostsData *config.Hosts
+}
+
+func (GetHostFacts) Name() string                  { return "get_host_facts" }
+func (GetHostFacts) Mutating(json.RawMessage) bool { return false }
+func (GetHostFacts) Description() string {
+	return "Returns facts about a host as JSON: OS and distribution, kernel, architecture, package manager, init system, CPUs, memory, disks and IP addresses. " +
+		"Facts are cached, so prefer this over running uname, nproc or cat /etc/os-release; set refresh to gather them again."
+}
+func (GetHostFacts) Schema() map[string]any {
+	return map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"host_id": map[string]any{"type": "string"},
+			"refresh": map[string]any{"type": "boolean", "description": "gather the facts again instead of using the cache"},
+		},
+		"required": []string{"host_id"},
+	}
+}
+
+type hostFactsResult struct {
+	HostID string `json:"host_id"`
+	Cached bool   `json:"cached"`
+	config.HostFacts
+}
+
+func (g GetHostFacts) Call(ctx context.Context, raw json.RawMessage) (string, error) {
+	var args GetHostFactsArgs
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return "", err
+	}
+	host := g.HostsData.Hosts[args.HostID]
+	if host.ID == "" {
+		return "", fmt.Errorf("Host with ID '%s' does not exist", args.HostID)
+	}
+
+	result := hostFactsResult{HostID: host.ID}
+	if facts, ok := g.HostsData.Facts.Get(host.ID); ok && !args.Refresh {
+		result.Cached, result.HostFacts = true, facts
+	} else {
+		facts, err := GatherFacts(ctx, g.HostsData, host)
+		if err != nil {
+			return "", err
+		}
+		if err := g.HostsData.Facts.Put(host.ID, facts); err != nil {
+			log.Printf("facts cache: %v", err)
+		}
+		result.HostFacts = facts
+	}
+	if g.HostsData.Privacy {
+		result.IPs = nil
+	}
+
+	out, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return g.HostsData.Mask(string(out)), nil
+}
+
+// GatherFacts collects the facts of a host over SSH.
+func GatherFacts(ctx context.Context, hosts *config.Hosts, host config.Host) (config.HostFacts, error) {
+	out, err := ExecuteCommand{HostsData: hosts}.Run(ctx, host, factsScript)
+	if err != nil {
+		return config.HostFacts{}, fmt.Errorf("gathering facts: %w", err)
+	}
+	facts := parseFacts(out)
+	facts.CollectedAt = time.Now()
+	return facts, nil
+}
+
+func parseFacts(out string) config.HostFacts {
+	var facts config.HostFacts
+	sections := scriptSections(out)
+
+	osRelease := map[string]string{}
+	for _, line := range sections["os-release"] {
+		if k, v, ok := strings.Cut(line, "="); ok {
+			osRelease[k] = strings.Trim(v, `"'`)
+		}
+	}
+	facts.OS = osRelease["PRETTY_NAME"]
+	facts.Distro = osRelease["ID"]
+	facts.DistroVersion = osRelease["VERSION_ID"]
+
+	if k := sections["kernel"]; len(k) > 0 {
+		facts.Kernel = k[0]
+		if len(k) > 1 {
+			facts.Arch = k[1]
+		}
+	}
+	if pm := sections["package-manager"]; len(pm) > 0 {
+		facts.PackageManager = strings.TrimSuffix(pm[0], "-get")
+	}
+	if init := sections["init"]; len(init) > 0 {
+		facts.InitSystem = init[0]
+	}
+
+	for _, line := range sections["cpu"] {
+		if n, err := strconv.Atoi(line); err == nil && facts.CPUs == 0 {
+			facts.CPUs = n
+		} else if _, model, ok := strings.Cut(line, ":"); ok {
+			facts.CPUModel = strings.TrimSpace(model)
+		}
+	}
+
+	for _, line := range sections["memory"] {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		kb, _ := strconv.ParseInt(fields[1], 10, 64)
+		switch fields[0] {
+		case "MemTotal:":
+			facts.MemoryMB = kb / 1024
+		case "SwapTotal:":
+			facts.SwapMB = kb / 1024
+		}
+	}
+
+	facts.Disks = parseDisks(sections["disks"])
+	facts.IPs = parseIPs(sections["ips"])
+	return facts
+}
+
+// parseDisks reads POSIX df output, with or without the type column.
+func parseDisks(lines []string) []config.Disk {
+	if len(lines) < 2 {
+		return nil
+	}
+	withType := strings.Contains(lines[0], "Type")
+
+	var disks []config.Disk
+	for _, line := range lines[1:] {
+		fields := strings.Fields(line)
+		if withType {
+			if len(fields) < 7 {
+				continue
+			}
+		} else {
+			if len(fields) < 6 {
+				continue
+			}
+			fields = append(fields[:1], append([]string{""}, fields[1:]...)...)
+		}
+		if !strings.HasPrefix(fields[0], "/") {
+			continue
+		}
+		size, _ := strconv.ParseInt(fields[2], 10, 64)
+		used, _ := strconv.ParseInt(fields[3], 10, 64)
+		pct, _ := strconv.Atoi(strings.TrimSuffix(fields[5], "%"))
+		disks = append(disks, config.Disk{
+			Device:     fields[0],
+			FSType:     fields[1],
+			SizeMB:     size / 1024,
+			UsedMB:     used / 1024,
+			UsePercent: pct,
+			Mount:      strings.Join(fields[6:], " "),
+		})
+	}
+	return disks
+}
+
+// parseIPs reads "ip -o addr" output as "iface address/prefix", or the
+// space-separated addresses printed by hostname -i.
+func parseIPs(lines []string) []string {
+	var ips []string
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) >= 4 && (fields[2] == "inet" || fields[2] == "inet6") {
+			ips = append(ips, fields[1]+" "+fields[3])
+			continue
+		}
+		ips = append(ips, fields...)
+	}
+	return ips
+}
@@ -13,9 +13,14 @@ type GetHosts struct {
 	HostsData *config.Hosts
 }
 
-func (GetHosts) Name() string { return "get_hosts" }
-func (GetHosts) Description() string {
-	return "Gets a list of available hosts from the inventory. Returns a JSON array of host information - ID, Host, Port, Description and tags"
+func (GetHosts) Name() string                  { return "get_hosts" }
+func (GetHosts) Mutating(json.RawMessage) bool { return false }
+func (h GetHosts) Description() string {
+	if h.HostsData != nil && h.HostsData.Privacy {
+		return "Gets a list of available hosts from the inventory. Returns a JSON array of host information - ID, Description, tags, OS and a summary of the cached facts when known. " +
+			"Host addresses are hidden: refer to hosts by ID, and write <host:ID> wherever an address is needed in a command or ping target."
+	}
+	return "Gets a list of available hosts from the inventory. Returns a JSON array of host information - ID, Host, Port, Description, tags, OS and a summary of the cached facts when known"
 }
 func (GetHosts) Schema() map[string]any {
 	return map[string]any{
@@ -26,22 +31,31 @@ func (GetHosts) Schema() map[string]any {
 
 type HostInfo struct {
 	ID          string   `json:"id"`
-	Host        string   `json:"host"`
-	Port        int      `json:"port"`
+	Host        string   `json:"host,omitempty"`
+	Port        int      `json:"port,omitempty"`
 	Description string   `json:"description"`
 	Tags        []string `json:"tags"`
+	OS          string   `json:"os,omitempty"`
+	Facts       string   `json:"facts,omitempty"`
 }
 
 func (h GetHosts) Call(ctx context.Context, raw json.RawMessage) (string, error) {
-	sanitizedHosts := make([]HostInfo, len(h.HostsData.Hosts))
-	for _, h := range h.HostsData.Hosts {
-		sanitizedHosts = append(sanitizedHosts, HostInfo{
-			ID:          h.ID,
-			Host:        h.Host,
-			Port:        h.Port,
-			Description: h.Description,
-			Tags:        h.Tags,
-		})
+	sanitizedHosts := make([]HostInfo, 0, len(h.HostsData.Hosts))
+	for _, host := range h.HostsData.Hosts {
+		info := HostInfo{
+			ID:          host.ID,
+			Description: host.Description,
+			Tags:        host.Tags,
+			OS:          host.OS,
+		}
+		if facts, ok := h.HostsData.Facts.Get(host.ID); ok {
+			info.Facts = facts.Summary()
+		}
+		if !h.HostsData.Privacy {
+			info.Host = host.Host
+			info.Port = host.Port
+		}
+		sanitizedHosts = append(sanitizedHosts, info)
 	}
 
 	out, err := json.MarshalIndent(sanitizedHosts, "", "  ")
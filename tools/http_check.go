@@ -0,0 +1,203 @@
+package tools
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/quniob/shellm/config"
+)
+
+const (
+	defaultBodySnippet = 512
+	maxBodySnippet     = 4096
+	maxRedirects       = 10
+)
+
+type HTTPCheckArgs struct {
+	HostID      string            `json:"host_id"`
+	URL         string            `json:"url"`
+	Method      string            `json:"method"`
+	Headers     map[string]string `json:"headers"`
+	NoRedirects bool              `json:"no_redirects"`
+	Insecure    bool              `json:"insecure"`
+	BodyBytes   int               `json:"body_bytes"`
+	Timeout     int               `json:"timeout"`
+}
+
+type HTTPCheck struct {
+	HostsData *config.Hosts
+}
+
+func (HTTPCheck) Name() string                  { return "http_check" }
+func (HTTPCheck) Mutating(json.RawMessage) bool { return false }
+func (HTTPCheck) Description() string {
+	return "Requests a URL with GET or HEAD and returns JSON with the status, total latency and time to first byte, redirects followed, " +
+		"response headers, the start of the body, and TLS details including certificate expiry. Set host_id to make the request from an inventory host instead of locally."
+}
+func (HTTPCheck) Schema() map[string]any {
+	return map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"host_id":      map[string]any{"type": "string", "description": "inventory host to request from; omit to request locally"},
+			"url":          map[string]any{"type": "string"},
+			"method":       map[string]any{"type": "string", "enum": []string{"GET", "HEAD"}, "description": "default GET"},
+			"headers":      map[string]any{"type": "object", "additionalProperties": map[string]any{"type": "string"}, "description": "request headers, e.g. Host"},
+			"no_redirects": map[string]any{"type": "boolean", "description": "return the first response instead of following redirects"},
+			"insecure":     map[string]any{"type": "boolean", "description": "do not verify the TLS certificate"},
+			"body_bytes":   map[string]any{"type": "integer", "description": fmt.Sprintf("body bytes to return (default %d, max %d)", defaultBodySnippet, maxBodySnippet)},
+			"timeout":      map[string]any{"type": "integer", "description": fmt.Sprintf("seconds (default %d, max %d)", defaultCheckTimeout, maxCheckTimeout)},
+		},
+		"required": []string{"url"},
+	}
+}
+
+type httpCheckResult struct {
+	From          string            `json:"from"`
+	Method        string            `json:"method"`
+	URL           string            `json:"url"`
+	FinalURL      string            `json:"final_url,omitempty"`
+	Redirects     []string          `json:"redirects,omitempty"`
+	StatusCode    int               `json:"status_code,omitempty"`
+	Status        string            `json:"status,omitempty"`
+	Proto         string            `json:"proto,omitempty"`
+	LatencyMS     float64           `json:"latency_ms"`
+	TTFBMS        float64           `json:"ttfb_ms,omitempty"`
+	Headers       map[string]string `json:"headers,omitempty"`
+	Body          string            `json:"body,omitempty"`
+	BodyTruncated bool              `json:"body_truncated,omitempty"`
+	TLS           *TLSInfo          `json:"tls,omitempty"`
+	Error         string            `json:"error,omitempty"`
+}
+
+func (h HTTPCheck) Call(ctx context.Context, raw json.RawMessage) (string, error) {
+	var args HTTPCheckArgs
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return "", err
+	}
+	method := strings.ToUpper(args.Method)
+	if method == "" {
+		method = http.MethodGet
+	}
+	if method != http.MethodGet && method != http.MethodHead {
+		return "", fmt.Errorf("method must be GET or HEAD, not '%s'", args.Method)
+	}
+	url := h.HostsData.Unmask(args.URL)
+	if !strings.Contains(url, "://") {
+		url = "http://" + url
+	}
+
+	o, err := newOrigin(h.HostsData, args.HostID)
+	if err != nil {
+		return "", err
+	}
+	defer o.Close()
+	ctx, cancel := checkContext(ctx, args.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("User-Agent", "shellm")
+	for k, v := range args.Headers {
+		if strings.EqualFold(k, "Host") {
+			req.Host = h.HostsData.Unmask(v)
+		} else {
+			req.Header.Set(k, h.HostsData.Unmask(v))
+		}
+	}
+
+	result := h.check(o, req, args)
+	out, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return h.HostsData.Mask(string(out)), nil
+}
+
+func (h HTTPCheck) check(o *origin, req *http.Request, args HTTPCheckArgs) httpCheckResult {
+	result := httpCheckResult{From: o.Name(), Method: req.Method, URL: req.URL.String()}
+
+	transport := &http.Transport{
+		DialContext:       o.DialContext,
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: args.Insecure},
+		DisableKeepAlives: true,
+		ForceAttemptHTTP2: true,
+	}
+	// A proxy configured here means nothing on a remote host.
+	if !o.Remote() {
+		transport.Proxy = http.ProxyFromEnvironment
+	}
+	client := &http.Client{
+		Transport: transport,
+		CheckRedirect: func(next *http.Request, via []*http.Request) error {
+			if args.NoRedirects {
+				return http.ErrUseLastResponse
+			}
+			if len(via) >= maxRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxRedirects)
+			}
+			result.Redirects = append(result.Redirects, next.URL.String())
+			return nil
+		},
+	}
+
+	start := time.Now()
+	trace := &httptrace.ClientTrace{
+		GotFirstResponseByte: func() { result.TTFBMS = millis(time.Since(start)) },
+	}
+	resp, err := client.Do(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+	if err != nil {
+		result.LatencyMS = millis(time.Since(start))
+		result.Error = err.Error()
+		return result
+	}
+	defer resp.Body.Close()
+
+	limit := args.BodyBytes
+	if limit <= 0 {
+		limit = defaultBodySnippet
+	}
+	limit = min(limit, maxBodySnippet)
+	body, err := io.ReadAll(io.LimitReader(resp.Body, int64(limit)+1))
+	result.LatencyMS = millis(time.Since(start))
+	if err != nil && !errors.Is(err, io.EOF) {
+		result.Error = "reading body: " + err.Error()
+	}
+
+	result.StatusCode = resp.StatusCode
+	result.Status = resp.Status
+	result.Proto = resp.Proto
+	if final := resp.Request.URL.String(); final != result.URL {
+		result.FinalURL = final
+	}
+	result.Headers = map[string]string{}
+	for k, v := range resp.Header {
+		result.Headers[k] = strings.Join(v, ", ")
+	}
+	if len(body) > limit {
+		body, result.BodyTruncated = body[:limit], true
+		// Do not count a character cut in half as binary data.
+		for i := 0; i < utf8.UTFMax-1 && len(body) > 0 && !utf8.Valid(body); i++ {
+			body = body[:len(body)-1]
+		}
+	}
+	if utf8.Valid(body) {
+		result.Body = string(body)
+	} else {
+		result.Body = fmt.Sprintf("(%d bytes of binary data)", len(body))
+	}
+	if resp.TLS != nil {
+		result.TLS = tlsInfo(*resp.TLS)
+	}
+	return result
+}
@@ -0,0 +1,663 @@
+package tools
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/quniob/shellm/config"
+)
+
+const (
+	defaultKubeItems = 100
+	maxKubeItems     = 500
+	defaultKubeTail  = 200
+	maxKubeTail      = 2000
+	// maxKubeOutput limits the text returned by describe, logs and the
+	// mutating verbs.
+	maxKubeOutput = 20000
+)
+
+// kubeReadVerbs never change the cluster. Every other verb needs approval.
+var kubeReadVerbs = map[string]bool{
+	"get": true, "describe": true, "logs": true, "top": true, "events": true,
+}
+
+var kubeWriteVerbs = map[string]bool{
+	"delete": true, "scale": true, "rollout": true, "cordon": true, "uncordon": true,
+	"drain": true, "label": true, "annotate": true, "patch": true,
+}
+
+type KubectlArgs struct {
+	HostID        string   `json:"host_id"`
+	Context       string   `json:"context"`
+	Verb          string   `json:"verb"`
+	Resource      string   `json:"resource"`
+	Name          string   `json:"name"`
+	Namespace     string   `json:"namespace"`
+	AllNamespaces bool     `json:"all_namespaces"`
+	Selector      string   `json:"selector"`
+	FieldSelector string   `json:"field_selector"`
+	Container     string   `json:"container"`
+	Tail          int      `json:"tail"`
+	Since         string   `json:"since"`
+	Previous      bool     `json:"previous"`
+	Limit         int      `json:"limit"`
+	Args          []string `json:"args"`
+}
+
+type Kubectl struct {
+	HostsData *config.Hosts
+}
+
+func (Kubectl) Name() string { return "kubectl" }
+func (Kubectl) Description() string {
+	return "Runs kubectl against a kube context, locally or on an inventory host such as a control-plane node (omit host_id to run locally), and returns JSON. " +
+		"Read verbs: get (objects summarised with status, readiness, restarts and age), describe, logs, top (pods or nodes) and events (newest last). " +
+		"Verbs that change the cluster (delete, scale, rollout, cordon, uncordon, drain, label, annotate, patch) take extra arguments in args " +
+		"and are only run once the operator approves them."
+}
+func (Kubectl) Schema() map[string]any {
+	verbs := []string{}
+	for v := range kubeReadVerbs {
+		verbs = append(verbs, v)
+	}
+	for v := range kubeWriteVerbs {
+		verbs = append(verbs, v)
+	}
+	sort.Strings(verbs)
+	return map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"host_id":        map[string]any{"type": "string", "description": "inventory host to run kubectl on; omit to run locally"},
+			"context":        map[string]any{"type": "string", "description": "kube context; defaults to the current one"},
+			"verb":           map[string]any{"type": "string", "enum": verbs},
+			"resource":       map[string]any{"type": "string", "description": "resource type such as pods, deployments or nodes, or type/name such as deploy/web"},
+			"name":           map[string]any{"type": "string", "description": "object name; for logs the pod, and for events the involved object"},
+			"namespace":      map[string]any{"type": "string"},
+			"all_namespaces": map[string]any{"type": "boolean"},
+			"selector":       map[string]any{"type": "string", "description": "label selector, e.g. app=web"},
+			"field_selector": map[string]any{"type": "string", "description": "field selector, e.g. status.phase!=Running"},
+			"container":      map[string]any{"type": "string", "description": "container for logs"},
+			"tail":           map[string]any{"type": "integer", "description": fmt.Sprintf("log lines to return (default %d, max %d)", defaultKubeTail, maxKubeTail)},
+			"since":          map[string]any{"type": "string", "description": "only logs newer than this duration, e.g. 10m"},
+			"previous":       map[string]any{"type": "boolean", "description": "logs of the previous container instance, e.g. after a crash"},
+			"limit":          map[string]any{"type": "integer", "description": fmt.Sprintf("objects or events to return (default %d, max %d)", defaultKubeItems, maxKubeItems)},
+			"args":           map[string]any{"type": "array", "items": map[string]any{"type": "string"}, "description": "extra arguments for the verbs that change the cluster, e.g. [\"--replicas=3\"] for scale or [\"restart\"] for rollout"},
+		},
+		"required": []string{"verb"},
+	}
+}
+
+// Mutating reports whether a call may change the cluster. rollout status and
+// rollout history only read it.
+func (Kubectl) Mutating(raw json.RawMessage) bool {
+	var args KubectlArgs
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return true
+	}
+	if args.Verb == "rollout" && len(args.Args) > 0 && (args.Args[0] == "status" || args.Args[0] == "history") {
+		return false
+	}
+	return !kubeReadVerbs[args.Verb]
+}
+
+func (k Kubectl) NeedsApproval(raw json.RawMessage) bool { return k.Mutating(raw) }
+
+func (k Kubectl) Preview(raw json.RawMessage) string {
+	var args KubectlArgs
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return fmt.Sprintf("would call kubectl(%s)", raw)
+	}
+	where := "locally"
+	if args.HostID != "" {
+		where = "on " + args.HostID
+	}
+	argv, err := kubectlArgv(args)
+	if err != nil {
+		return fmt.Sprintf("would run kubectl %s %s", args.Verb, where)
+	}
+	return fmt.Sprintf("would run `kubectl %s` %s", strings.Join(argv, " "), where)
+}
+
+// KubeObject is the summary of an object returned by get.
+type KubeObject struct {
+	Kind      string            `json:"kind"`
+	Namespace string            `json:"namespace,omitempty"`
+	Name      string            `json:"name"`
+	Status    string            `json:"status,omitempty"`
+	Age       string            `json:"age,omitempty"`
+	Details   map[string]string `json:"details,omitempty"`
+}
+
+type KubeEvent struct {
+	Last      string `json:"last"`
+	Type      string `json:"type"`
+	Reason    string `json:"reason"`
+	Namespace string `json:"namespace,omitempty"`
+	Object    string `json:"object"`
+	Count     int    `json:"count,omitempty"`
+	Message   string `json:"message"`
+}
+
+type kubectlResult struct {
+	Command   string              `json:"command"`
+	Objects   []KubeObject        `json:"objects,omitempty"`
+	Events    []KubeEvent         `json:"events,omitempty"`
+	Rows      []map[string]string `json:"rows,omitempty"`
+	Lines     []string            `json:"lines,omitempty"`
+	Output    string              `json:"output,omitempty"`
+	Total     int                 `json:"total,omitempty"`
+	Truncated bool                `json:"truncated,omitempty"`
+}
+
+func (k Kubectl) Call(ctx context.Context, raw json.RawMessage) (string, error) {
+	var args KubectlArgs
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return "", err
+	}
+	argv, err := kubectlArgv(args)
+	if err != nil {
+		return "", err
+	}
+
+	out, err := k.run(ctx, args.HostID, argv)
+	if err != nil {
+		return "", errors.New(k.HostsData.Mask(err.Error()))
+	}
+
+	result := kubectlResult{Command: "kubectl " + strings.Join(argv, " ")}
+	limit := args.Limit
+	if limit <= 0 {
+		limit = defaultKubeItems
+	}
+	limit = min(limit, maxKubeItems)
+
+	switch args.Verb {
+	case "get":
+		objects, err := parseKubeObjects(out)
+		if err != nil {
+			return "", err
+		}
+		result.Objects, result.Total = objects, len(objects)
+		if len(objects) == 0 {
+			result.Output = "No resources found."
+		}
+		if len(objects) > limit {
+			result.Objects, result.Truncated = objects[:limit], true
+		}
+	case "events":
+		events, err := parseKubeEvents(out)
+		if err != nil {
+			return "", err
+		}
+		result.Events, result.Total = events, len(events)
+		if len(events) == 0 {
+			result.Output = "No events found."
+		}
+		if len(events) > limit {
+			result.Events, result.Truncated = events[len(events)-limit:], true
+		}
+	case "top":
+		result.Rows = parseTable(out)
+	case "logs":
+		out, result.Truncated = truncateHead(out, maxKubeOutput)
+		result.Lines = strings.Split(strings.TrimRight(out, "\n"), "\n")
+	default:
+		result.Output, result.Truncated = truncateTail(strings.TrimSpace(out), maxKubeOutput)
+	}
+
+	resp, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return k.HostsData.Mask(string(resp)), nil
+}
+
+// kubectlArgv builds the kubectl arguments of a call.
+func kubectlArgv(args KubectlArgs) ([]string, error) {
+	if !kubeReadVerbs[args.Verb] && !kubeWriteVerbs[args.Verb] {
+		return nil, fmt.Errorf("unknown verb '%s'", args.Verb)
+	}
+	if len(args.Args) > 0 && kubeReadVerbs[args.Verb] {
+		return nil, fmt.Errorf("args are only accepted by the verbs that change the cluster, not by '%s'", args.Verb)
+	}
+
+	// Only global flags go before the verb; --all-namespaces belongs to the
+	// verbs and follows them.
+	var argv []string
+	if args.Context != "" {
+		argv = append(argv, "--context", args.Context)
+	}
+	if args.Namespace != "" && !args.AllNamespaces {
+		argv = append(argv, "--namespace", args.Namespace)
+	}
+	selectors := func() {
+		if args.AllNamespaces {
+			argv = append(argv, "--all-namespaces")
+		}
+		if args.Selector != "" {
+			argv = append(argv, "--selector", args.Selector)
+		}
+		if args.FieldSelector != "" {
+			argv = append(argv, "--field-selector", args.FieldSelector)
+		}
+	}
+
+	switch args.Verb {
+	case "get", "describe":
+		if args.Resource == "" {
+			return nil, fmt.Errorf("verb '%s' needs a resource", args.Verb)
+		}
+		argv = append(argv, args.Verb, args.Resource)
+		if args.Name != "" {
+			argv = append(argv, args.Name)
+		}
+		selectors()
+		if args.Verb == "get" {
+			argv = append(argv, "--output", "json")
+		}
+	case "events":
+		argv = append(argv, "get", "events", "--output", "json")
+		if args.Name != "" {
+			args.FieldSelector = strings.Trim("involvedObject.name="+args.Name+","+args.FieldSelector, ",")
+		}
+		selectors()
+	case "top":
+		if args.Resource != "pods" && args.Resource != "nodes" && args.Resource != "pod" && args.Resource != "node" {
+			return nil, errors.New("verb 'top' needs resource pods or nodes")
+		}
+		argv = append(argv, "top", args.Resource)
+		if args.Name != "" {
+			argv = append(argv, args.Name)
+		}
+		if args.AllNamespaces && strings.HasPrefix(args.Resource, "pod") {
+			argv = append(argv, "--all-namespaces")
+		}
+		if args.Selector != "" {
+			argv = append(argv, "--selector", args.Selector)
+		}
+	case "logs":
+		target := args.Name
+		if args.Resource != "" && args.Name != "" {
+			target = args.Resource + "/" + args.Name
+		} else if args.Resource != "" {
+			target = args.Resource
+		}
+		if target == "" && args.Selector == "" {
+			return nil, errors.New("verb 'logs' needs a pod name or a selector")
+		}
+		if args.AllNamespaces {
+			return nil, errors.New("verb 'logs' reads from one namespace, set namespace instead of all_namespaces")
+		}
+		tail := args.Tail
+		if tail <= 0 {
+			tail = defaultKubeTail
+		}
+		argv = append(argv, "logs", "--timestamps", "--tail", strconv.Itoa(min(tail, maxKubeTail)))
+		if target != "" {
+			argv = append(argv, target)
+		} else {
+			argv = append(argv, "--selector", args.Selector)
+		}
+		if args.Container != "" {
+			argv = append(argv, "--container", args.Container)
+		}
+		if args.Since != "" {
+			argv = append(argv, "--since", args.Since)
+		}
+		if args.Previous {
+			argv = append(argv, "--previous")
+		}
+	default:
+		argv = append(argv, args.Verb)
+		if args.Verb == "rollout" && len(args.Args) > 0 {
+			// The rollout subcommand comes before the resource.
+			argv = append(argv, args.Args[0])
+			args.Args = args.Args[1:]
+		}
+		if args.Resource != "" {
+			argv = append(argv, args.Resource)
+		}
+		if args.Name != "" {
+			argv = append(argv, args.Name)
+		}
+		selectors()
+		argv = append(argv, args.Args...)
+	}
+	return argv, nil
+}
+
+// run runs kubectl on an inventory host, or locally when hostID is empty.
+func (k Kubectl) run(ctx context.Context, hostID string, argv []string) (string, error) {
+	if hostID == "" {
+		cmd := exec.CommandContext(ctx, "kubectl", argv...)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("kubectl: %w: %s", err, strings.TrimSpace(stderr.String()))
+		}
+		return string(out), nil
+	}
+
+	host := k.HostsData.Hosts[hostID]
+	if host.ID == "" {
+		return "", fmt.Errorf("Host with ID '%s' does not exist", hostID)
+	}
+	// Warnings on stderr would be mixed into the JSON, so they are dropped
+	// unless kubectl fails.
+	command := fmt.Sprintf("err=$(mktemp); kubectl %s 2>\"$err\"; rc=$?; [ $rc -eq 0 ] || cat \"$err\" >&2; rm -f \"$err\"; exit $rc", quoteAll(argv))
+	return ExecuteCommand{HostsData: k.HostsData}.Run(ctx, host, command)
+}
+
+// kubeItem holds the fields of the common kinds used in their summaries.
+type kubeItem struct {
+	Kind     string `json:"kind"`
+	Metadata struct {
+		Name              string            `json:"name"`
+		Namespace         string            `json:"namespace"`
+		CreationTimestamp time.Time         `json:"creationTimestamp"`
+		Labels            map[string]string `json:"labels"`
+	} `json:"metadata"`
+	Spec struct {
+		Replicas      *int   `json:"replicas"`
+		NodeName      string `json:"nodeName"`
+		Type          string `json:"type"`
+		ClusterIP     string `json:"clusterIP"`
+		Unschedulable bool   `json:"unschedulable"`
+		Completions   *int   `json:"completions"`
+		Ports         []struct {
+			Port     int    `json:"port"`
+			NodePort int    `json:"nodePort"`
+			Protocol string `json:"protocol"`
+		} `json:"ports"`
+	} `json:"spec"`
+	Status struct {
+		Phase                  string `json:"phase"`
+		Reason                 string `json:"reason"`
+		PodIP                  string `json:"podIP"`
+		Replicas               int    `json:"replicas"`
+		ReadyReplicas          int    `json:"readyReplicas"`
+		UpdatedReplicas        int    `json:"updatedReplicas"`
+		AvailableReplicas      int    `json:"availableReplicas"`
+		DesiredNumberScheduled int    `json:"desiredNumberScheduled"`
+		NumberReady            int    `json:"numberReady"`
+		Succeeded              int    `json:"succeeded"`
+		Failed                 int    `json:"failed"`
+		ContainerStatuses      []struct {
+			Ready        bool                               `json:"ready"`
+			RestartCount int                                `json:"restartCount"`
+			State        map[string]struct{ Reason string } `json:"state"`
+		} `json:"containerStatuses"`
+		Conditions []struct {
+			Type   string `json:"type"`
+			Status string `json:"status"`
+		} `json:"conditions"`
+		NodeInfo struct {
+			KubeletVersion string `json:"kubeletVersion"`
+		} `json:"nodeInfo"`
+		Addresses []struct {
+			Type    string `json:"type"`
+			Address string `json:"address"`
+		} `json:"addresses"`
+		Capacity map[string]string `json:"capacity"`
+	} `json:"status"`
+}
+
+// jsonStart skips anything printed before the JSON document.
+func jsonStart(out string) []byte {
+	if i := strings.IndexByte(out, '{'); i > 0 {
+		out = out[i:]
+	}
+	return []byte(out)
+}
+
+func parseKubeObjects(out string) ([]KubeObject, error) {
+	var list struct {
+		Kind  string     `json:"kind"`
+		Items []kubeItem `json:"items"`
+	}
+	data := jsonStart(out)
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("parsing kubectl output: %w", err)
+	}
+	if !strings.HasSuffix(list.Kind, "List") {
+		var item kubeItem
+		if err := json.Unmarshal(data, &item); err != nil {
+			return nil, fmt.Errorf("parsing kubectl output: %w", err)
+		}
+		list.Items = []kubeItem{item}
+	}
+
+	objects := []KubeObject{}
+	for _, item := range list.Items {
+		objects = append(objects, summarizeKubeItem(item))
+	}
+	return objects, nil
+}
+
+func summarizeKubeItem(item kubeItem) KubeObject {
+	obj := KubeObject{
+		Kind:      item.Kind,
+		Namespace: item.Metadata.Namespace,
+		Name:      item.Metadata.Name,
+		Status:    item.Status.Phase,
+		Age:       kubeAge(item.Metadata.CreationTimestamp),
+		Details:   map[string]string{},
+	}
+	s := item.Status
+
+	switch item.Kind {
+	case "Pod":
+		ready, restarts := 0, 0
+		for _, c := range s.ContainerStatuses {
+			if c.Ready {
+				ready++
+			}
+			restarts += c.RestartCount
+			// A waiting or terminated reason such as CrashLoopBackOff says
+			// more than the phase.
+			for _, state := range []string{"waiting", "terminated"} {
+				if st, ok := c.State[state]; ok && st.Reason != "" {
+					obj.Status = st.Reason
+				}
+			}
+		}
+		if s.Reason != "" {
+			obj.Status = s.Reason
+		}
+		obj.Details["ready"] = fmt.Sprintf("%d/%d", ready, len(s.ContainerStatuses))
+		obj.Details["restarts"] = strconv.Itoa(restarts)
+		obj.Details["node"] = item.Spec.NodeName
+		obj.Details["ip"] = s.PodIP
+	case "Deployment", "StatefulSet", "ReplicaSet":
+		desired := s.Replicas
+		if item.Spec.Replicas != nil {
+			desired = *item.Spec.Replicas
+		}
+		obj.Details["ready"] = fmt.Sprintf("%d/%d", s.ReadyReplicas, desired)
+		obj.Details["updated"] = strconv.Itoa(s.UpdatedReplicas)
+		obj.Details["available"] = strconv.Itoa(s.AvailableReplicas)
+	case "DaemonSet":
+		obj.Details["ready"] = fmt.Sprintf("%d/%d", s.NumberReady, s.DesiredNumberScheduled)
+	case "Job":
+		completions := 1
+		if item.Spec.Completions != nil {
+			completions = *item.Spec.Completions
+		}
+		obj.Details["succeeded"] = fmt.Sprintf("%d/%d", s.Succeeded, completions)
+		obj.Details["failed"] = strconv.Itoa(s.Failed)
+	case "Node":
+		obj.Status = "NotReady"
+		for _, c := range s.Conditions {
+			if c.Type == "Ready" && c.Status == "True" {
+				obj.Status = "Ready"
+			}
+		}
+		if item.Spec.Unschedulable {
+			obj.Status += ",SchedulingDisabled"
+		}
+		var roles []string
+		for label := range item.Metadata.Labels {
+			if role, ok := strings.CutPrefix(label, "node-role.kubernetes.io/"); ok {
+				roles = append(roles, role)
+			}
+		}
+		sort.Strings(roles)
+		obj.Details["roles"] = strings.Join(roles, ",")
+		obj.Details["version"] = s.NodeInfo.KubeletVersion
+		for _, a := range s.Addresses {
+			if a.Type == "InternalIP" {
+				obj.Details["internal_ip"] = a.Address
+			}
+		}
+	case "Service":
+		obj.Details["type"] = item.Spec.Type
+		obj.Details["cluster_ip"] = item.Spec.ClusterIP
+		var ports []string
+		for _, p := range item.Spec.Ports {
+			port := fmt.Sprintf("%d/%s", p.Port, p.Protocol)
+			if p.NodePort != 0 {
+				port = fmt.Sprintf("%d:%d/%s", p.Port, p.NodePort, p.Protocol)
+			}
+			ports = append(ports, port)
+		}
+		obj.Details["ports"] = strings.Join(ports, ",")
+	case "PersistentVolumeClaim", "PersistentVolume":
+		obj.Details["capacity"] = s.Capacity["storage"]
+	}
+
+	for k, v := range obj.Details {
+		if v == "" {
+			delete(obj.Details, k)
+		}
+	}
+	return obj
+}
+
+// kubeAge formats the age of an object the way kubectl get does.
+func kubeAge(created time.Time) string {
+	if created.IsZero() {
+		return ""
+	}
+	d := time.Since(created)
+	switch {
+	case d < time.Minute:
+		return fmt.Sprintf("%ds", int(d.Seconds()))
+	case d < time.Hour:
+		return fmt.Sprintf("%dm", int(d.Minutes()))
+	case d < 48*time.Hour:
+		return fmt.Sprintf("%dh", int(d.Hours()))
+	default:
+		return fmt.Sprintf("%dd", int(d.Hours()/24))
+	}
+}
+
+// parseKubeEvents returns the events oldest first.
+func parseKubeEvents(out string) ([]KubeEvent, error) {
+	var list struct {
+		Items []struct {
+			Type           string    `json:"type"`
+			Reason         string    `json:"reason"`
+			Message        string    `json:"message"`
+			Count          int       `json:"count"`
+			LastTimestamp  time.Time `json:"lastTimestamp"`
+			EventTime      time.Time `json:"eventTime"`
+			InvolvedObject struct {
+				Kind      string `json:"kind"`
+				Name      string `json:"name"`
+				Namespace string `json:"namespace"`
+			} `json:"involvedObject"`
+		} `json:"items"`
+	}
+	if err := json.Unmarshal(jsonStart(out), &list); err != nil {
+		return nil, fmt.Errorf("parsing kubectl output: %w", err)
+	}
+
+	type timedEvent struct {
+		at time.Time
+		KubeEvent
+	}
+	var timed []timedEvent
+	for _, e := range list.Items {
+		at := e.LastTimestamp
+		if at.IsZero() {
+			at = e.EventTime
+		}
+		timed = append(timed, timedEvent{at: at, KubeEvent: KubeEvent{
+			Last:      at.Format(time.RFC3339),
+			Type:      e.Type,
+			Reason:    e.Reason,
+			Namespace: e.InvolvedObject.Namespace,
+			Object:    strings.ToLower(e.InvolvedObject.Kind) + "/" + e.InvolvedObject.Name,
+			Count:     e.Count,
+			Message:   strings.TrimSpace(e.Message),
+		}})
+	}
+	sort.SliceStable(timed, func(i, j int) bool { return timed[i].at.Before(timed[j].at) })
+
+	events := []KubeEvent{}
+	for _, e := range timed {
+		events = append(events, e.KubeEvent)
+	}
+	return events, nil
+}
+
+// parseTable reads kubectl's column output into rows keyed by the lowercased
+// headers.
+func parseTable(out string) []map[string]string {
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) < 2 {
+		return nil
+	}
+	headers := strings.Fields(strings.ToLower(lines[0]))
+	var rows []map[string]string
+	for _, line := range lines[1:] {
+		fields := strings.Fields(line)
+		if len(fields) != len(headers) {
+			continue
+		}
+		row := map[string]string{}
+		for i, h := range headers {
+			row[h] = fields[i]
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// truncateTail keeps the start of s, truncateHead its end.
+func truncateTail(s string, max int) (string, bool) {
+	if len(s) <= max {
+		return s, false
+	}
+	// Back off to a rune boundary so that no character is cut in half.
+	for max > 0 && !utf8.RuneStart(s[max]) {
+		max--
+	}
+	return s[:max] + "\n...", true
+}
+
+func truncateHead(s string, max int) (string, bool) {
+	if len(s) <= max {
+		return s, false
+	}
+	start := len(s) - max
+	for start < len(s) && !utf8.RuneStart(s[start]) {
+		start++
+	}
+	s = s[start:]
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		s = s[i+1:]
+	}
+	return s, true
+}
@@ -0,0 +1,477 @@
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/quniob/shellm/config"
+)
+
+const (
+	defaultLogMatches = 100
+	maxLogMatches     = 500
+	defaultLogContext = 2
+	maxLogContext     = 10
+	maxLogLineLength  = 500
+	maxLogErrors      = 10
+	// logFetchLines bounds what is read back from each source before the
+	// time window and the match limit are applied.
+	logFetchLines = 5000
+)
+
+var (
+	logPathPattern     = regexp.MustCompile(`^/[A-Za-z0-9_.*?/\[\]@+-]+$`)
+	logPriorityPattern = regexp.MustCompile(`^[a-z0-9]+(\.\.[a-z0-9]+)?$`)
+	// grepLine matches "12:text" for a matching line and "12-text" for context.
+	grepLine = regexp.MustCompile(`^(\d+)([:-])(.*)$`)
+)
+
+type SearchLogsArgs struct {
+	HostID   string `json:"host_id"`
+	Source   string `json:"source"`
+	Unit     string `json:"unit"`
+	Priority string `json:"priority"`
+	Path     string `json:"path"`
+	Pattern  string `json:"pattern"`
+	Since    string `json:"since"`
+	Until    string `json:"until"`
+	Context  *int   `json:"context"`
+	Limit    int    `json:"limit"`
+}
+
+type SearchLogs struct {
+	HostsData *config.Hosts
+}
+
+func (SearchLogs) Name() string                  { return "search_logs" }
+func (SearchLogs) Mutating(json.RawMessage) bool { return false }
+func (SearchLogs) Description() string {
+	return "Searches logs on a host and returns JSON with the matched lines, surrounding context and match counts, most recent matches last. " +
+		"source journal queries journald (optionally by unit and priority); source files searches log files given by a path glob such as /var/log/nginx/*.log, including .gz files. " +
+		"pattern is an extended regular expression. since and until take a duration back from now such as 1h or 30m, or a time such as '2024-05-01 10:00'."
+}
+func (SearchLogs) Schema() map[string]any {
+	return map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"host_id":  map[string]any{"type": "string"},
+			"source":   map[string]any{"type": "string", "enum": []string{"journal", "files"}},
+			"unit":     map[string]any{"type": "string", "description": "journal: systemd unit"},
+			"priority": map[string]any{"type": "string", "description": "journal: highest priority to include or a range, e.g. err or warning..err"},
+			"path":     map[string]any{"type": "string", "description": "files: absolute path or glob"},
+			"pattern":  map[string]any{"type": "string", "description": "extended regular expression, e.g. 'error|fail'"},
+			"since":    map[string]any{"type": "string"},
+			"until":    map[string]any{"type": "string"},
+			"context":  map[string]any{"type": "integer", "description": fmt.Sprintf("lines of context around each match (default %d, max %d)", defaultLogContext, maxLogContext)},
+			"limit":    map[string]any{"type": "integer", "description": fmt.Sprintf("most recent matches to return (default %d, max %d)", defaultLogMatches, maxLogMatches)},
+		},
+		"required": []string{"host_id", "source"},
+	}
+}
+
+// LogBlock is a run of lines from one source. For files each line starts with
+// its line number, followed by ':' for a match and '-' for context; journal
+// lines start with "* " for a match.
+type LogBlock struct {
+	File  string   `json:"file,omitempty"`
+	Lines []string `json:"lines"`
+
+	matches int
+	isMatch []bool
+}
+
+type LogSearchResult struct {
+	Source string `json:"source"`
+	// Counts holds the number of matching lines per source before the limit
+	// and, for files, before the time window is applied.
+	Counts    map[string]int `json:"counts"`
+	Returned  int            `json:"returned"`
+	Truncated bool           `json:"truncated,omitempty"`
+	Blocks    []LogBlock     `json:"blocks"`
+	Errors    []string       `json:"errors,omitempty"`
+}
+
+func (s SearchLogs) Call(ctx context.Context, raw json.RawMessage) (string, error) {
+	var args SearchLogsArgs
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return "", err
+	}
+	host := s.HostsData.Hosts[args.HostID]
+	if host.ID == "" {
+		return "", fmt.Errorf("Host with ID '%s' does not exist", args.HostID)
+	}
+	if args.Pattern == "" {
+		args.Pattern = "."
+	}
+	if _, err := regexp.Compile(args.Pattern); err != nil {
+		return "", fmt.Errorf("invalid pattern: %w", err)
+	}
+	contextLines := defaultLogContext
+	if args.Context != nil {
+		contextLines = max(0, min(*args.Context, maxLogContext))
+	}
+	limit := args.Limit
+	if limit <= 0 {
+		limit = defaultLogMatches
+	}
+	limit = min(limit, maxLogMatches)
+
+	var result LogSearchResult
+	var err error
+	switch args.Source {
+	case "journal":
+		result, err = s.journal(ctx, host, args, contextLines)
+	case "files":
+		result, err = s.files(ctx, host, args, contextLines)
+	default:
+		return "", fmt.Errorf("unknown source '%s', use journal or files", args.Source)
+	}
+	if err != nil {
+		return "", errors.New(s.HostsData.Mask(err.Error()))
+	}
+	limitMatches(&result, limit)
+
+	out, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return s.HostsData.Mask(string(out)), nil
+}
+
+func (s SearchLogs) run(ctx context.Context, host config.Host, command string) (string, error) {
+	return ExecuteCommand{HostsData: s.HostsData}.Run(ctx, host, command)
+}
+
+// journalTime turns a duration such as 1h into a relative journalctl time;
+// anything else is passed on as is.
+func journalTime(t string) string {
+	if d, err := time.ParseDuration(t); err == nil {
+		return fmt.Sprintf("-%ds", int(d.Seconds()))
+	}
+	return t
+}
+
+func (s SearchLogs) journal(ctx context.Context, host config.Host, args SearchLogsArgs, contextLines int) (LogSearchResult, error) {
+	journal := "journalctl --no-pager --quiet -o short-iso"
+	if args.Unit != "" {
+		journal += " -u " + shellQuote(args.Unit)
+	}
+	if args.Priority != "" {
+		if !logPriorityPattern.MatchString(args.Priority) {
+			return LogSearchResult{}, fmt.Errorf("invalid priority '%s'", args.Priority)
+		}
+		journal += " -p " + args.Priority
+	}
+	if args.Since != "" {
+		journal += " --since " + shellQuote(journalTime(args.Since))
+	}
+	if args.Until != "" {
+		journal += " --until " + shellQuote(journalTime(args.Until))
+	}
+	pattern := shellQuote(args.Pattern)
+
+	command := fmt.Sprintf(`S=%s
+echo "### count $($S %s 2>/dev/null | grep -E -c -e %s)"
+$S %s | grep -E -n -C %d -e %s | tail -n %d`,
+		asRoot, journal, pattern, journal, contextLines, pattern, logFetchLines)
+	out, err := s.run(ctx, host, command)
+	if err != nil {
+		return LogSearchResult{}, err
+	}
+
+	result := LogSearchResult{Source: "journal", Counts: map[string]int{}}
+	name := "journal"
+	if args.Unit != "" {
+		name = args.Unit
+	}
+	var lines []string
+	for _, line := range strings.Split(out, "\n") {
+		if n, ok := strings.CutPrefix(line, "### count "); ok {
+			result.Counts[name], _ = strconv.Atoi(strings.TrimSpace(n))
+			continue
+		}
+		lines = append(lines, line)
+	}
+	result.Blocks = result.grepBlocks("", lines, func(string) bool { return true })
+	return result, nil
+}
+
+func (s SearchLogs) files(ctx context.Context, host config.Host, args SearchLogsArgs, contextLines int) (LogSearchResult, error) {
+	if !logPathPattern.MatchString(args.Path) {
+		return LogSearchResult{}, fmt.Errorf("invalid path '%s': use an absolute path or glob without spaces or quotes", args.Path)
+	}
+	since, err := windowTime(args.Since)
+	if err != nil {
+		return LogSearchResult{}, err
+	}
+	until, err := windowTime(args.Until)
+	if err != nil {
+		return LogSearchResult{}, err
+	}
+
+	pattern := shellQuote(args.Pattern)
+	// Times without a zone are resolved by date on the host, which also
+	// reports its zone for reading log lines. Files last modified before the
+	// window cannot contain lines in it. The path is checked above and left
+	// unquoted so that the shell expands the glob.
+	command := fmt.Sprintf(`S=%s
+from=%s
+to=%s
+echo "### window $(date +%%z) ${from:--} ${to:--}"
+for f in %s; do
+  [ -f "$f" ] || continue
+  [ -z "$from" ] || [ "$(stat -c %%Y "$f" 2>/dev/null || echo 0)" -ge "$from" ] || continue
+  case "$f" in *.gz) g=zgrep ;; *) g=grep ;; esac
+  echo "### file $($S $g -E -c -e %s -- "$f" 2>/dev/null) $f"
+  $S $g -E -n -C %d -e %s -- "$f" | tail -n %d
+done`, asRoot, since, until, args.Path, pattern, contextLines, pattern, logFetchLines)
+	out, err := s.run(ctx, host, command)
+	if err != nil {
+		return LogSearchResult{}, err
+	}
+
+	var window logWindow
+	inWindow := func(line string) bool {
+		t, ok := lineTime(line, window.zone)
+		return !ok || ((window.since.IsZero() || !t.Before(window.since)) && (window.until.IsZero() || !t.After(window.until)))
+	}
+
+	result := LogSearchResult{Source: "files", Counts: map[string]int{}}
+	var file string
+	var lines []string
+	flush := func() {
+		if file != "" {
+			result.Blocks = append(result.Blocks, result.grepBlocks(file, lines, inWindow)...)
+		}
+		lines = nil
+	}
+	for _, line := range strings.Split(out, "\n") {
+		if header, ok := strings.CutPrefix(line, "### window "); ok {
+			if window, err = parseWindow(header); err != nil {
+				return LogSearchResult{}, err
+			}
+			if (args.Since != "" && window.since.IsZero()) || (args.Until != "" && window.until.IsZero()) {
+				return LogSearchResult{}, fmt.Errorf("date on the host could not read the time window")
+			}
+			continue
+		}
+		if header, ok := strings.CutPrefix(line, "### file "); ok {
+			flush()
+			count, name, _ := strings.Cut(header, " ")
+			file = name
+			result.Counts[file], _ = strconv.Atoi(count)
+			continue
+		}
+		lines = append(lines, line)
+	}
+	flush()
+	if len(result.Counts) == 0 && len(result.Errors) == 0 {
+		return result, fmt.Errorf("no log files match '%s'", args.Path)
+	}
+	return result, nil
+}
+
+// grepBlocks splits grep -n output into blocks at the "--" separators,
+// leaving out lines rejected by keep and blocks without a match left. Other output, such as
+// errors of journalctl or sudo, is added to the errors of the result.
+func (r *LogSearchResult) grepBlocks(file string, lines []string, keep func(line string) bool) []LogBlock {
+	var blocks []LogBlock
+	var block LogBlock
+	flush := func() {
+		if block.matches > 0 {
+			blocks = append(blocks, block)
+		}
+		block = LogBlock{File: file}
+	}
+	flush()
+
+	for _, line := range lines {
+		if line == "--" {
+			flush()
+			continue
+		}
+		m := grepLine.FindStringSubmatch(line)
+		if m == nil {
+			r.addError(line)
+			continue
+		}
+		text := m[3]
+		if len(text) > maxLogLineLength {
+			cut := maxLogLineLength
+			for cut > 0 && !utf8.RuneStart(text[cut]) {
+				cut--
+			}
+			text = text[:cut] + "…"
+		}
+		if !keep(text) {
+			continue
+		}
+		isMatch := m[2] == ":"
+		if isMatch {
+			block.matches++
+		}
+		block.isMatch = append(block.isMatch, isMatch)
+		if file == "" {
+			// Line numbers of the journal stream mean nothing to the reader.
+			marker := "  "
+			if isMatch {
+				marker = "* "
+			}
+			block.Lines = append(block.Lines, marker+text)
+		} else {
+			block.Lines = append(block.Lines, m[1]+m[2]+" "+text)
+		}
+	}
+	flush()
+	return blocks
+}
+
+func (r *LogSearchResult) addError(line string) {
+	line = strings.TrimSpace(line)
+	if line == "" || len(r.Errors) >= maxLogErrors {
+		return
+	}
+	for _, e := range r.Errors {
+		if e == line {
+			return
+		}
+	}
+	r.Errors = append(r.Errors, line)
+}
+
+// limitMatches keeps the most recent limit matches. A block is cut at the
+// first match that is kept.
+func limitMatches(result *LogSearchResult, limit int) {
+	kept := 0
+	for i := len(result.Blocks) - 1; i >= 0; i-- {
+		block := &result.Blocks[i]
+		if kept+block.matches <= limit {
+			kept += block.matches
+			continue
+		}
+		result.Truncated = true
+		start := len(block.Lines)
+		for ; start > 0 && kept < limit; start-- {
+			if block.isMatch[start-1] {
+				kept++
+			}
+		}
+		if start == len(block.Lines) {
+			i++
+		} else {
+			block.Lines = block.Lines[start:]
+		}
+		result.Blocks = result.Blocks[i:]
+		break
+	}
+	result.Returned = kept
+	if result.Blocks == nil {
+		result.Blocks = []LogBlock{}
+	}
+}
+
+// windowTime turns since/until for log files into a shell word that expands
+// to Unix seconds on the host: a duration back from now or a time with a zone
+// is converted here, a time without one is left to date on the host so that
+// it is read in the host's zone.
+func windowTime(s string) (string, error) {
+	if s == "" {
+		return "", nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return strconv.FormatInt(time.Now().Add(-d).Unix(), 10), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return strconv.FormatInt(t.Unix(), 10), nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"} {
+		if _, err := time.Parse(layout, s); err == nil {
+			return fmt.Sprintf(`"$(date -d %s +%%s)"`, shellQuote(s)), nil
+		}
+	}
+	return "", fmt.Errorf("invalid time '%s': use a duration such as 1h or a time such as 2024-05-01 10:00", s)
+}
+
+// logWindow is the time window of a file search as resolved on the host,
+// together with the host's zone.
+type logWindow struct {
+	zone         *time.Location
+	since, until time.Time
+}
+
+// parseWindow reads the "### window" header: the zone offset of the host
+// followed by since and until in Unix seconds, or "-" for no bound.
+func parseWindow(header string) (logWindow, error) {
+	fields := strings.Fields(header)
+	if len(fields) == 0 {
+		return logWindow{}, fmt.Errorf("host did not report its time zone")
+	}
+	zone, err := time.Parse("-0700", fields[0])
+	if err != nil {
+		return logWindow{}, fmt.Errorf("host reported an invalid time zone '%s'", fields[0])
+	}
+	window := logWindow{zone: zone.Location()}
+	bounds := []*time.Time{&window.since, &window.until}
+	for i, field := range fields[1:] {
+		if i >= len(bounds) || field == "-" {
+			continue
+		}
+		secs, err := strconv.ParseInt(field, 10, 64)
+		if err != nil {
+			return logWindow{}, fmt.Errorf("host could not resolve the time window: '%s'", field)
+		}
+		*bounds[i] = time.Unix(secs, 0)
+	}
+	return window, nil
+}
+
+var (
+	isoTimestamp    = regexp.MustCompile(`^\[?(\d{4}-\d{2}-\d{2})[T ](\d{2}:\d{2}:\d{2})(?:[.,]\d+)?(Z|[+-]\d{2}:?\d{2})?`)
+	syslogTimestamp = regexp.MustCompile(`^([A-Z][a-z]{2} [ \d]\d \d{2}:\d{2}:\d{2})`)
+	clfTimestamp    = regexp.MustCompile(`\[(\d{2}/[A-Z][a-z]{2}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4})\]`)
+)
+
+// lineTime reads the timestamp of a log line in ISO 8601, syslog or common
+// log format. Times without a zone are taken in zone, the zone of the host.
+func lineTime(line string, zone *time.Location) (time.Time, bool) {
+	if zone == nil {
+		zone = time.Local
+	}
+	if m := isoTimestamp.FindStringSubmatch(line); m != nil {
+		switch offset := strings.Replace(m[3], ":", "", 1); offset {
+		case "":
+			t, err := time.ParseInLocation("2006-01-02 15:04:05", m[1]+" "+m[2], zone)
+			return t, err == nil
+		case "Z":
+			t, err := time.Parse("2006-01-02 15:04:05", m[1]+" "+m[2])
+			return t, err == nil
+		default:
+			t, err := time.Parse("2006-01-02 15:04:05 -0700", m[1]+" "+m[2]+" "+offset)
+			return t, err == nil
+		}
+	}
+	if m := syslogTimestamp.FindStringSubmatch(line); m != nil {
+		now := time.Now().In(zone)
+		t, err := time.ParseInLocation("2006 Jan _2 15:04:05", strconv.Itoa(now.Year())+" "+m[1], zone)
+		if err != nil {
+			return t, false
+		}
+		// Syslog omits the year; a time in the future is from last year.
+		if t.After(now.Add(24 * time.Hour)) {
+			t = t.AddDate(-1, 0, 0)
+		}
+		return t, true
+	}
+	if m := clfTimestamp.FindStringSubmatch(line); m != nil {
+		t, err := time.Parse("02/Jan/2006:15:04:05 -0700", m[1])
+		return t, err == nil
+	}
+	return time.Time{}, false
+}
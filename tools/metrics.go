@@ -0,0 +1,318 @@
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/quniob/shellm/config"
+)
+
+const (
+	defaultTopProcesses = 5
+	maxTopProcesses     = 20
+)
+
+// metricsScript reads /proc twice, one second apart, so that CPU usage can be
+// computed from the difference. %d is the number of top processes.
+const metricsScript = `echo '### stat1'; grep '^cpu' /proc/stat; sleep 1; echo '### stat2'; grep '^cpu ' /proc/stat
+echo '### loadavg'; cat /proc/loadavg
+echo '### uptime'; cat /proc/uptime
+echo '### meminfo'; cat /proc/meminfo
+echo '### disks'; df -PkT -x tmpfs -x devtmpfs -x squashfs -x overlay 2>/dev/null || df -Pk
+echo '### inodes'; df -PiT -x tmpfs -x devtmpfs -x squashfs -x overlay 2>/dev/null || df -Pi
+echo '### net'; tail -n +3 /proc/net/dev
+echo '### top-cpu'; ps -eo pid,user,pcpu,pmem,rss,comm --sort=-pcpu 2>/dev/null | head -n %[1]d
+echo '### top-mem'; ps -eo pid,user,pcpu,pmem,rss,comm --sort=-rss 2>/dev/null | head -n %[1]d
+true`
+
+type HostMetricsArgs struct {
+	HostID string `json:"host_id"`
+	Top    int    `json:"top"`
+}
+
+type HostMetrics struct {
+	HostsData *config.Hosts
+}
+
+func (HostMetrics) Name() string                  { return "host_metrics" }
+func (HostMetrics) Mutating(json.RawMessage) bool { return false }
+func (HostMetrics) Description() string {
+	return "Returns a JSON snapshot of a host's health: load average, CPU usage over one second, memory and swap, disk and inode usage per mount, " +
+		"top processes by CPU and by memory, and network interface counters. Use it to answer health questions instead of running top, free or df."
+}
+func (HostMetrics) Schema() map[string]any {
+	return map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"host_id": map[string]any{"type": "string"},
+			"top":     map[string]any{"type": "integer", "description": fmt.Sprintf("processes to list by CPU and by memory (default %d, max %d)", defaultTopProcesses, maxTopProcesses)},
+		},
+		"required": []string{"host_id"},
+	}
+}
+
+type LoadMetrics struct {
+	One       float64 `json:"1m"`
+	Five      float64 `json:"5m"`
+	Fifteen   float64 `json:"15m"`
+	CPUs      int     `json:"cpus"`
+	Running   int     `json:"running"`
+	Processes int     `json:"processes"`
+}
+
+type CPUMetrics struct {
+	UsagePercent  float64 `json:"usage_percent"`
+	UserPercent   float64 `json:"user_percent"`
+	SystemPercent float64 `json:"system_percent"`
+	IOWaitPercent float64 `json:"iowait_percent"`
+	StealPercent  float64 `json:"steal_percent"`
+}
+
+type MemoryMetrics struct {
+	TotalMB         int64   `json:"total_mb"`
+	AvailableMB     int64   `json:"available_mb"`
+	UsedPercent     float64 `json:"used_percent"`
+	SwapTotalMB     int64   `json:"swap_total_mb"`
+	SwapUsedMB      int64   `json:"swap_used_mb"`
+	SwapUsedPercent float64 `json:"swap_used_percent"`
+}
+
+type DiskMetrics struct {
+	config.Disk
+	InodesUsePercent int `json:"inodes_use_percent"`
+}
+
+type ProcessMetrics struct {
+	PID        int     `json:"pid"`
+	User       string  `json:"user"`
+	CPUPercent float64 `json:"cpu_percent"`
+	MemPercent float64 `json:"mem_percent"`
+	RSSMB      int64   `json:"rss_mb"`
+	Command    string  `json:"command"`
+}
+
+type InterfaceMetrics struct {
+	Name      string `json:"name"`
+	RxBytes   int64  `json:"rx_bytes"`
+	TxBytes   int64  `json:"tx_bytes"`
+	RxPackets int64  `json:"rx_packets"`
+	TxPackets int64  `json:"tx_packets"`
+	RxErrors  int64  `json:"rx_errors"`
+	TxErrors  int64  `json:"tx_errors"`
+	RxDropped int64  `json:"rx_dropped"`
+	TxDropped int64  `json:"tx_dropped"`
+}
+
+type MetricsSnapshot struct {
+	HostID        string             `json:"host_id"`
+	UptimeSeconds int64              `json:"uptime_seconds"`
+	Load          LoadMetrics        `json:"load"`
+	CPU           CPUMetrics         `json:"cpu"`
+	Memory        MemoryMetrics      `json:"memory"`
+	Disks         []DiskMetrics      `json:"disks"`
+	TopCPU        []ProcessMetrics   `json:"top_cpu"`
+	TopMemory     []ProcessMetrics   `json:"top_memory"`
+	Network       []InterfaceMetrics `json:"network"`
+}
+
+func (h HostMetrics) Call(ctx context.Context, raw json.RawMessage) (string, error) {
+	var args HostMetricsArgs
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return "", err
+	}
+	host := h.HostsData.Hosts[args.HostID]
+	if host.ID == "" {
+		return "", fmt.Errorf("Host with ID '%s' does not exist", args.HostID)
+	}
+	top := args.Top
+	if top <= 0 {
+		top = defaultTopProcesses
+	}
+	top = min(top, maxTopProcesses)
+
+	// One more line for the ps header.
+	out, err := ExecuteCommand{HostsData: h.HostsData}.Run(ctx, host, fmt.Sprintf(metricsScript, top+1))
+	if err != nil {
+		return "", errors.New(h.HostsData.Mask(err.Error()))
+	}
+	snapshot := parseMetrics(out)
+	snapshot.HostID = host.ID
+
+	result, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return h.HostsData.Mask(string(result)), nil
+}
+
+// scriptSections splits the output of a script into the sections started by
+// "### name" lines.
+func scriptSections(out string) map[string][]string {
+	sections := map[string][]string{}
+	var current string
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		if name, ok := strings.CutPrefix(line, "### "); ok {
+			current = name
+			continue
+		}
+		if line != "" && current != "" {
+			sections[current] = append(sections[current], line)
+		}
+	}
+	return sections
+}
+
+func parseMetrics(out string) MetricsSnapshot {
+	sections := scriptSections(out)
+	var m MetricsSnapshot
+
+	var before, after []int64
+	for _, line := range sections["stat1"] {
+		if strings.HasPrefix(line, "cpu ") {
+			before = int64Fields(line)
+		} else {
+			m.Load.CPUs++
+		}
+	}
+	if len(sections["stat2"]) > 0 {
+		after = int64Fields(sections["stat2"][0])
+	}
+	m.CPU = cpuUsage(before, after)
+
+	if l := sections["loadavg"]; len(l) > 0 {
+		fields := strings.Fields(l[0])
+		if len(fields) >= 4 {
+			m.Load.One, _ = strconv.ParseFloat(fields[0], 64)
+			m.Load.Five, _ = strconv.ParseFloat(fields[1], 64)
+			m.Load.Fifteen, _ = strconv.ParseFloat(fields[2], 64)
+			running, total, _ := strings.Cut(fields[3], "/")
+			m.Load.Running, _ = strconv.Atoi(running)
+			m.Load.Processes, _ = strconv.Atoi(total)
+		}
+	}
+	if u := sections["uptime"]; len(u) > 0 {
+		secs, _ := strconv.ParseFloat(strings.Fields(u[0])[0], 64)
+		m.UptimeSeconds = int64(secs)
+	}
+
+	meminfo := map[string]int64{}
+	for _, line := range sections["meminfo"] {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 {
+			meminfo[strings.TrimSuffix(fields[0], ":")], _ = strconv.ParseInt(fields[1], 10, 64)
+		}
+	}
+	available, ok := meminfo["MemAvailable"]
+	if !ok {
+		// Kernels before 3.14 do not report MemAvailable.
+		available = meminfo["MemFree"] + meminfo["Buffers"] + meminfo["Cached"]
+	}
+	m.Memory = MemoryMetrics{
+		TotalMB:     meminfo["MemTotal"] / 1024,
+		AvailableMB: available / 1024,
+		SwapTotalMB: meminfo["SwapTotal"] / 1024,
+		SwapUsedMB:  (meminfo["SwapTotal"] - meminfo["SwapFree"]) / 1024,
+	}
+	m.Memory.UsedPercent = percent(meminfo["MemTotal"]-available, meminfo["MemTotal"])
+	m.Memory.SwapUsedPercent = percent(meminfo["SwapTotal"]-meminfo["SwapFree"], meminfo["SwapTotal"])
+
+	inodes := map[string]int{}
+	for _, d := range parseDisks(sections["inodes"]) {
+		inodes[d.Mount] = d.UsePercent
+	}
+	m.Disks = []DiskMetrics{}
+	for _, d := range parseDisks(sections["disks"]) {
+		m.Disks = append(m.Disks, DiskMetrics{Disk: d, InodesUsePercent: inodes[d.Mount]})
+	}
+
+	m.TopCPU = parseProcesses(sections["top-cpu"])
+	m.TopMemory = parseProcesses(sections["top-mem"])
+	m.Network = parseNetDev(sections["net"])
+	return m
+}
+
+// cpuUsage computes CPU usage from two samples of the cpu line of /proc/stat:
+// user nice system idle iowait irq softirq steal.
+func cpuUsage(before, after []int64) CPUMetrics {
+	if len(before) < 8 || len(after) < 8 {
+		return CPUMetrics{}
+	}
+	delta := make([]int64, 8)
+	var total int64
+	for i := range delta {
+		delta[i] = after[i] - before[i]
+		total += delta[i]
+	}
+	return CPUMetrics{
+		UsagePercent:  percent(total-delta[3]-delta[4], total),
+		UserPercent:   percent(delta[0]+delta[1], total),
+		SystemPercent: percent(delta[2]+delta[5]+delta[6], total),
+		IOWaitPercent: percent(delta[4], total),
+		StealPercent:  percent(delta[7], total),
+	}
+}
+
+// int64Fields parses the numbers after the label of a /proc line.
+func int64Fields(line string) []int64 {
+	fields := strings.Fields(line)
+	nums := make([]int64, 0, len(fields))
+	for _, f := range fields[1:] {
+		n, _ := strconv.ParseInt(f, 10, 64)
+		nums = append(nums, n)
+	}
+	return nums
+}
+
+func percent(part, total int64) float64 {
+	if total <= 0 {
+		return 0
+	}
+	return float64(part*1000/total) / 10
+}
+
+// parseProcesses reads "PID USER %CPU %MEM RSS COMMAND" lines after the header.
+func parseProcesses(lines []string) []ProcessMetrics {
+	procs := []ProcessMetrics{}
+	for i, line := range lines {
+		fields := strings.Fields(line)
+		if i == 0 || len(fields) < 6 {
+			continue
+		}
+		p := ProcessMetrics{User: fields[1], Command: strings.Join(fields[5:], " ")}
+		p.PID, _ = strconv.Atoi(fields[0])
+		p.CPUPercent, _ = strconv.ParseFloat(fields[2], 64)
+		p.MemPercent, _ = strconv.ParseFloat(fields[3], 64)
+		rss, _ := strconv.ParseInt(fields[4], 10, 64)
+		p.RSSMB = rss / 1024
+		procs = append(procs, p)
+	}
+	return procs
+}
+
+// parseNetDev reads the interface lines of /proc/net/dev, leaving out the
+// loopback interface.
+func parseNetDev(lines []string) []InterfaceMetrics {
+	ifaces := []InterfaceMetrics{}
+	for _, line := range lines {
+		name, counters, ok := strings.Cut(line, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "lo" {
+			continue
+		}
+		n := int64Fields("x " + counters)
+		if len(n) < 12 {
+			continue
+		}
+		ifaces = append(ifaces, InterfaceMetrics{
+			Name:    name,
+			RxBytes: n[0], RxPackets: n[1], RxErrors: n[2], RxDropped: n[3],
+			TxBytes: n[8], TxPackets: n[9], TxErrors: n[10], TxDropped: n[11],
+		})
+	}
+	return ifaces
+}
@@ -0,0 +1,165 @@
+package tools
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/quniob/shellm/config"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	defaultCheckTimeout = 10
+	maxCheckTimeout     = 60
+)
+
+// origin is where a network check runs from: this machine, or an inventory
+// host whose SSH connection carries the TCP connections of the check, so
+// nothing has to be installed there.
+type origin struct {
+	hosts  *config.Hosts
+	host   *config.Host
+	mu     sync.Mutex
+	client *ssh.Client
+}
+
+func newOrigin(hosts *config.Hosts, hostID string) (*origin, error) {
+	o := &origin{hosts: hosts}
+	if hostID == "" {
+		return o, nil
+	}
+	host := hosts.Hosts[hostID]
+	if host.ID == "" {
+		return nil, fmt.Errorf("Host with ID '%s' does not exist", hostID)
+	}
+	o.host = &host
+	return o, nil
+}
+
+func (o *origin) Name() string {
+	if o.host == nil {
+		return "local"
+	}
+	return o.host.ID
+}
+
+func (o *origin) Remote() bool { return o.host != nil }
+
+// DialContext connects to addr from the origin. Connections from a host are
+// always TCP, since SSH cannot forward UDP.
+func (o *origin) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if o.host == nil {
+		var d net.Dialer
+		return d.DialContext(ctx, network, addr)
+	}
+
+	o.mu.Lock()
+	if o.client == nil {
+		client, err := ExecuteCommand{HostsData: o.hosts}.Dial(ctx, *o.host)
+		if err != nil {
+			o.mu.Unlock()
+			return nil, err
+		}
+		o.client = client
+	}
+	client := o.client
+	o.mu.Unlock()
+	return client.DialContext(ctx, "tcp", addr)
+}
+
+// run runs a shell command at the origin and returns its combined output.
+func (o *origin) run(ctx context.Context, command string) (string, error) {
+	if o.host == nil {
+		cmd := exec.CommandContext(ctx, "sh", "-c", command)
+		// Do not wait for children that still hold the output open after
+		// the shell was killed.
+		cmd.WaitDelay = time.Second
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			return "", fmt.Errorf("Failed to run command: %w. Output: %s", err, out)
+		}
+		return string(out), nil
+	}
+	return ExecuteCommand{HostsData: o.hosts}.Run(ctx, *o.host, command)
+}
+
+func (o *origin) Close() {
+	if o.client != nil {
+		o.client.Close()
+	}
+}
+
+// millis returns a duration in milliseconds, to the microsecond.
+func millis(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// checkContext bounds a check by its timeout in seconds.
+func checkContext(ctx context.Context, seconds int) (context.Context, context.CancelFunc) {
+	if seconds <= 0 {
+		seconds = defaultCheckTimeout
+	}
+	return context.WithTimeout(ctx, time.Duration(min(seconds, maxCheckTimeout))*time.Second)
+}
+
+type CertInfo struct {
+	Subject   string   `json:"subject"`
+	Issuer    string   `json:"issuer"`
+	DNSNames  []string `json:"dns_names,omitempty"`
+	NotBefore string   `json:"not_before"`
+	NotAfter  string   `json:"not_after"`
+	DaysLeft  int      `json:"days_left"`
+	Expired   bool     `json:"expired,omitempty"`
+}
+
+type TLSInfo struct {
+	Version     string     `json:"version"`
+	CipherSuite string     `json:"cipher_suite"`
+	HandshakeMS float64    `json:"handshake_ms,omitempty"`
+	Verified    bool       `json:"verified"`
+	VerifyError string     `json:"verify_error,omitempty"`
+	Chain       []CertInfo `json:"chain"`
+}
+
+// tlsInfo describes a TLS connection, with the peer chain leaf first.
+func tlsInfo(state tls.ConnectionState) *TLSInfo {
+	info := &TLSInfo{
+		Version:     tls.VersionName(state.Version),
+		CipherSuite: tls.CipherSuiteName(state.CipherSuite),
+		Verified:    len(state.VerifiedChains) > 0,
+		Chain:       []CertInfo{},
+	}
+	now := time.Now()
+	for _, cert := range state.PeerCertificates {
+		info.Chain = append(info.Chain, CertInfo{
+			Subject:   cert.Subject.String(),
+			Issuer:    cert.Issuer.String(),
+			DNSNames:  cert.DNSNames,
+			NotBefore: cert.NotBefore.Format(time.RFC3339),
+			NotAfter:  cert.NotAfter.Format(time.RFC3339),
+			DaysLeft:  int(cert.NotAfter.Sub(now).Hours() / 24),
+			Expired:   now.After(cert.NotAfter),
+		})
+	}
+	return info
+}
+
+// verifyChain checks the peer chain of a handshake made without verification,
+// so that an invalid certificate is still described.
+func verifyChain(state tls.ConnectionState, serverName string) error {
+	if len(state.PeerCertificates) == 0 {
+		return fmt.Errorf("no certificate presented")
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{DNSName: serverName, Intermediates: intermediates})
+	return err
+}
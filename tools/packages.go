@@ -0,0 +1,388 @@
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/quniob/shellm/config"
+)
+
+// maxPackageOutput bounds the installer output returned to the model.
+const maxPackageOutput = 2000
+
+// packageActions change what is installed and are classified as mutating.
+var packageActions = map[string]bool{"install": true, "remove": true, "hold": true, "unhold": true}
+
+type Package struct {
+	Name      string `json:"name"`
+	Installed bool   `json:"installed"`
+	Version   string `json:"version,omitempty"`
+}
+
+type PackageUpgrade struct {
+	Name      string `json:"name"`
+	Current   string `json:"current,omitempty"`
+	Available string `json:"available"`
+}
+
+// packageManager knows the commands of one package manager. Commands take the
+// quoted package names; an empty command means the action is not supported.
+type packageManager struct {
+	query           func(pkgs string) string
+	parseQuery      func(out string) map[string]string
+	upgradable      string
+	parseUpgradable func(out string) []PackageUpgrade
+	install, remove string
+	hold, unhold    string
+}
+
+var packageManagers = map[string]packageManager{
+	"apt": {
+		query: func(pkgs string) string {
+			return `dpkg-query -W -f='${db:Status-Abbrev} ${Package} ${Version}\n' ` + pkgs
+		},
+		parseQuery:      parseDpkgQuery,
+		upgradable:      "apt list --upgradable",
+		parseUpgradable: parseAptUpgradable,
+		install:         "env DEBIAN_FRONTEND=noninteractive apt-get install -y",
+		remove:          "env DEBIAN_FRONTEND=noninteractive apt-get remove -y",
+		hold:            "apt-mark hold",
+		unhold:          "apt-mark unhold",
+	},
+	"dnf": {
+		query:           rpmQuery,
+		parseQuery:      parseNameVersion,
+		upgradable:      "dnf -q check-update",
+		parseUpgradable: parseDnfUpgradable,
+		install:         "dnf install -y",
+		remove:          "dnf remove -y",
+		hold:            "dnf versionlock add",
+		unhold:          "dnf versionlock delete",
+	},
+	"yum": {
+		query:           rpmQuery,
+		parseQuery:      parseNameVersion,
+		upgradable:      "yum -q check-update",
+		parseUpgradable: parseDnfUpgradable,
+		install:         "yum install -y",
+		remove:          "yum remove -y",
+		hold:            "yum versionlock add",
+		unhold:          "yum versionlock delete",
+	},
+	"apk": {
+		query:           func(string) string { return "apk list --installed" },
+		parseQuery:      parseApkInstalled,
+		upgradable:      "apk list --upgradable",
+		parseUpgradable: parseApkUpgradable,
+		install:         "apk add",
+		remove:          "apk del",
+	},
+	"pacman": {
+		query:           func(pkgs string) string { return "pacman -Q " + pkgs },
+		parseQuery:      parseNameVersion,
+		upgradable:      "pacman -Qu",
+		parseUpgradable: parsePacmanUpgradable,
+		install:         "pacman -S --noconfirm",
+		remove:          "pacman -R --noconfirm",
+	},
+}
+
+type PackagesArgs struct {
+	HostID   string   `json:"host_id"`
+	Action   string   `json:"action"`
+	Packages []string `json:"packages"`
+}
+
+type Packages struct {
+	HostsData *config.Hosts
+}
+
+func (Packages) Name() string { return "packages" }
+func (Packages) Description() string {
+	return "Manages packages on a host with its own package manager (apt, dnf, yum, apk or pacman, detected automatically) and returns JSON. " +
+		"Actions: query (whether packages are installed and their versions), list_upgradable, install, remove, hold and unhold (pin the installed version)."
+}
+func (Packages) Schema() map[string]any {
+	return map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"host_id": map[string]any{"type": "string"},
+			"action": map[string]any{
+				"type": "string",
+				"enum": []string{"query", "list_upgradable", "install", "remove", "hold", "unhold"},
+			},
+			"packages": map[string]any{"type": "array", "items": map[string]any{"type": "string"}},
+		},
+		"required": []string{"host_id", "action"},
+	}
+}
+
+func (Packages) Mutating(raw json.RawMessage) bool {
+	var args PackagesArgs
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return true
+	}
+	return packageActions[args.Action]
+}
+
+func (Packages) Preview(raw json.RawMessage) string {
+	var args PackagesArgs
+	json.Unmarshal(raw, &args)
+	return fmt.Sprintf("would %s %s on %s", args.Action, strings.Join(args.Packages, ", "), args.HostID)
+}
+
+type packageActionResult struct {
+	Action   string    `json:"action"`
+	OK       bool      `json:"ok"`
+	Output   string    `json:"output,omitempty"`
+	Packages []Package `json:"packages"`
+}
+
+func (p Packages) Call(ctx context.Context, raw json.RawMessage) (string, error) {
+	var args PackagesArgs
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return "", err
+	}
+	host := p.HostsData.Hosts[args.HostID]
+	if host.ID == "" {
+		return "", fmt.Errorf("Host with ID '%s' does not exist", args.HostID)
+	}
+	for _, pkg := range args.Packages {
+		if pkg == "" || strings.HasPrefix(pkg, "-") {
+			return "", fmt.Errorf("invalid package name '%s'", pkg)
+		}
+	}
+	if len(args.Packages) == 0 && args.Action != "list_upgradable" {
+		return "", fmt.Errorf("action '%s' needs packages", args.Action)
+	}
+
+	name, err := p.manager(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	pm := packageManagers[name]
+
+	var result any
+	switch {
+	case args.Action == "query":
+		result, err = p.query(ctx, host, pm, args.Packages)
+	case args.Action == "list_upgradable":
+		var out string
+		// check-update exits with 100 when there are updates.
+		out, err = p.run(ctx, host, pm.upgradable+" 2>/dev/null; true")
+		result = map[string]any{"manager": name, "upgrades": pm.parseUpgradable(out)}
+	case packageActions[args.Action]:
+		result, err = p.act(ctx, host, name, pm, args.Action, args.Packages)
+	default:
+		return "", fmt.Errorf("unknown action '%s'", args.Action)
+	}
+	if err != nil {
+		return "", errors.New(p.HostsData.Mask(err.Error()))
+	}
+
+	out, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return p.HostsData.Mask(string(out)), nil
+}
+
+func (p Packages) run(ctx context.Context, host config.Host, command string) (string, error) {
+	return ExecuteCommand{HostsData: p.HostsData}.Run(ctx, host, command)
+}
+
+// manager returns the package manager of the host, from the cached facts
+// when they are fresh.
+func (p Packages) manager(ctx context.Context, host config.Host) (string, error) {
+	name := ""
+	if facts, ok := p.HostsData.Facts.Get(host.ID); ok {
+		name = facts.PackageManager
+	} else {
+		out, err := p.run(ctx, host, detectPackageManager)
+		if err != nil {
+			return "", err
+		}
+		name = strings.TrimSuffix(strings.TrimSpace(out), "-get")
+	}
+	if _, ok := packageManagers[name]; !ok {
+		if name == "" {
+			return "", errors.New("no supported package manager found on the host")
+		}
+		return "", fmt.Errorf("package manager '%s' is not supported", name)
+	}
+	return name, nil
+}
+
+func (p Packages) query(ctx context.Context, host config.Host, pm packageManager, pkgs []string) ([]Package, error) {
+	// Querying a package that is not installed fails; what matters is the
+	// output for the others.
+	out, err := p.run(ctx, host, pm.query(quoteAll(pkgs))+" 2>/dev/null; true")
+	if err != nil {
+		return nil, err
+	}
+	versions := pm.parseQuery(out)
+
+	result := make([]Package, 0, len(pkgs))
+	for _, name := range pkgs {
+		version, ok := versions[name]
+		result = append(result, Package{Name: name, Installed: ok, Version: version})
+	}
+	return result, nil
+}
+
+// act changes packages and queries them afterwards.
+func (p Packages) act(ctx context.Context, host config.Host, name string, pm packageManager, action string, pkgs []string) (packageActionResult, error) {
+	command := map[string]string{"install": pm.install, "remove": pm.remove, "hold": pm.hold, "unhold": pm.unhold}[action]
+	if command == "" {
+		return packageActionResult{}, fmt.Errorf("%s does not support %s", name, action)
+	}
+
+	out, err := p.run(ctx, host, privileged(command+" "+quoteAll(pkgs))+" 2>&1; echo \"### rc=$?\"")
+	if err != nil {
+		return packageActionResult{}, err
+	}
+	output, rc, _ := strings.Cut(out, "### rc=")
+	output = strings.TrimSpace(output)
+	if len(output) > maxPackageOutput {
+		start := len(output) - maxPackageOutput
+		for start < len(output) && !utf8.RuneStart(output[start]) {
+			start++
+		}
+		output = "…" + output[start:]
+	}
+
+	after, err := p.query(ctx, host, pm, pkgs)
+	if err != nil {
+		return packageActionResult{}, err
+	}
+	return packageActionResult{Action: action, OK: strings.TrimSpace(rc) == "0", Output: output, Packages: after}, nil
+}
+
+func quoteAll(words []string) string {
+	quoted := make([]string, len(words))
+	for i, w := range words {
+		quoted[i] = shellQuote(w)
+	}
+	return strings.Join(quoted, " ")
+}
+
+func rpmQuery(pkgs string) string {
+	return `rpm -q --qf '%{NAME} %{VERSION}-%{RELEASE}\n' ` + pkgs
+}
+
+// parseDpkgQuery keeps installed packages only: "ii" is installed and "hi"
+// installed and held, while "rc" means only the configuration is left.
+func parseDpkgQuery(out string) map[string]string {
+	versions := map[string]string{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 3 && len(fields[0]) >= 2 && fields[0][1] == 'i' {
+			versions[fields[1]] = fields[2]
+		}
+	}
+	return versions
+}
+
+func parseNameVersion(out string) map[string]string {
+	versions := map[string]string{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 {
+			versions[fields[0]] = fields[1]
+		}
+	}
+	return versions
+}
+
+// "nginx/jammy-updates 1.18.0-6ubuntu14.4 amd64 [upgradable from: 1.18.0-6ubuntu14.3]"
+func parseAptUpgradable(out string) []PackageUpgrade {
+	upgrades := []PackageUpgrade{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || !strings.Contains(fields[0], "/") {
+			continue
+		}
+		u := PackageUpgrade{Name: strings.SplitN(fields[0], "/", 2)[0], Available: fields[1]}
+		if _, from, ok := strings.Cut(line, "from: "); ok {
+			u.Current = strings.TrimSuffix(from, "]")
+		}
+		upgrades = append(upgrades, u)
+	}
+	return upgrades
+}
+
+// "nginx.x86_64  1:1.20.1-14.el9  appstream"; the listing ends where the
+// obsoleted packages start.
+func parseDnfUpgradable(out string) []PackageUpgrade {
+	upgrades := []PackageUpgrade{}
+	for _, line := range strings.Split(out, "\n") {
+		if strings.HasPrefix(line, "Obsoleting") {
+			break
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 || !strings.Contains(fields[0], ".") {
+			continue
+		}
+		name := fields[0][:strings.LastIndex(fields[0], ".")]
+		upgrades = append(upgrades, PackageUpgrade{Name: name, Available: fields[1]})
+	}
+	return upgrades
+}
+
+// apkVersion splits "nginx-1.24.0-r6" into name and version.
+var apkVersion = regexp.MustCompile(`^(.+?)-(\d[^-]*-r\d+)$`)
+
+// "nginx-1.24.0-r6 x86_64 {nginx} (BSD-2-Clause) [installed]"
+func parseApkInstalled(out string) map[string]string {
+	versions := map[string]string{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if m := apkVersion.FindStringSubmatch(fields[0]); m != nil {
+			versions[m[1]] = m[2]
+		}
+	}
+	return versions
+}
+
+// "curl-8.5.0-r0 x86_64 {curl} (curl) [upgradable from: curl-8.4.0-r0]"
+func parseApkUpgradable(out string) []PackageUpgrade {
+	upgrades := []PackageUpgrade{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		m := apkVersion.FindStringSubmatch(fields[0])
+		if m == nil {
+			continue
+		}
+		u := PackageUpgrade{Name: m[1], Available: m[2]}
+		if _, from, ok := strings.Cut(line, "from: "); ok {
+			if c := apkVersion.FindStringSubmatch(strings.TrimSuffix(from, "]")); c != nil {
+				u.Current = c[2]
+			}
+		}
+		upgrades = append(upgrades, u)
+	}
+	return upgrades
+}
+
+// "linux 6.6.1.arch1-1 -> 6.6.2.arch1-1"
+func parsePacmanUpgradable(out string) []PackageUpgrade {
+	upgrades := []PackageUpgrade{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 4 && fields[2] == "->" {
+			upgrades = append(upgrades, PackageUpgrade{Name: fields[0], Current: fields[1], Available: fields[3]})
+		}
+	}
+	return upgrades
+}
@@ -3,16 +3,24 @@ package tools
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"net"
 	"os/exec"
+	"strings"
+
+	"github.com/quniob/shellm/config"
 )
 
 type PingArgs struct {
 	Target string `json:"target"`
 }
-type Ping struct{}
+type Ping struct {
+	HostsData *config.Hosts
+}
 
-func (Ping) Name() string        { return "ping" }
-func (Ping) Description() string { return "Pings given ipv4 target" }
+func (Ping) Name() string                  { return "ping" }
+func (Ping) Mutating(json.RawMessage) bool { return false }
+func (Ping) Description() string           { return "Pings given ipv4 target" }
 func (Ping) Schema() map[string]any {
 	return map[string]any{
 		"type": "object",
@@ -22,12 +30,26 @@ func (Ping) Schema() map[string]any {
 		"required": []string{"target"},
 	}
 }
-func (Ping) Call(ctx context.Context, raw json.RawMessage) (string, error) {
+func (p Ping) Call(ctx context.Context, raw json.RawMessage) (string, error) {
 	var a PingArgs
 	if err := json.Unmarshal(raw, &a); err != nil {
 		return "", err
 	}
-	cmd := exec.Command("ping", a.Target, "-c 5")
-	out, err := cmd.CombinedOutput()
-	return string(out), err
+	target := p.HostsData.Unmask(a.Target)
+	masked := p.HostsData.Mask(target)
+	if masked == target {
+		out, err := exec.CommandContext(ctx, "ping", target, "-c 5").CombinedOutput()
+		return p.HostsData.Mask(string(out)), err
+	}
+
+	// ping prints the address it resolved and the reverse name of the replies;
+	// ping the address without reverse lookups instead, so that only the
+	// placeholder reaches the model.
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, target)
+	if err != nil {
+		return "", errors.New(p.HostsData.Mask(err.Error()))
+	}
+	ip := ips[0].IP.String()
+	out, err := exec.CommandContext(ctx, "ping", "-n", ip, "-c 5").CombinedOutput()
+	return p.HostsData.Mask(strings.ReplaceAll(string(out), ip, masked)), err
 }
@@ -0,0 +1,507 @@
+package tools
+
+import (
+	"path"
+	"regexp"
+	"strings"
+)
+
+// readOnlyCommands lists programs that only inspect a host. A nil check means
+// any arguments are fine; otherwise the check decides from the arguments.
+var readOnlyCommands = map[string]func(args []string) bool{
+	"basename": nil, "blkid": nil, "cat": nil, "column": nil,
+	"cut": nil, "df": nil, "diff": nil, "dig": nil,
+	"dirname": nil, "du": nil, "echo": nil, "egrep": nil,
+	"false": nil, "fgrep": nil, "file": nil, "findmnt": nil, "free": nil,
+	"getenforce": nil, "getent": nil, "grep": nil, "head": nil, "host": nil,
+	"id": nil, "iostat": nil, "jq": nil, "last": nil,
+	"lastlog": nil, "ls": nil, "lsblk": nil, "lscpu": nil, "lsmem": nil,
+	"lsmod": nil, "lsof": nil, "lspci": nil, "lsusb": nil, "md5sum": nil,
+	"mpstat": nil, "netstat": nil, "nl": nil, "nproc": nil, "nslookup": nil,
+	"pgrep": nil, "ping": nil, "printenv": nil, "printf": nil, "ps": nil,
+	"pstree": nil, "pwd": nil, "readlink": nil, "realpath": nil, "rev": nil,
+	"sestatus": nil, "seq": nil, "sha1sum": nil, "sha256sum": nil, "sleep": nil,
+	"ss": nil, "stat": nil, "strings": nil, "tac": nil, "tail": nil,
+	"test": nil, "top": nil, "tr": nil, "tracepath": nil, "traceroute": nil,
+	"tree": nil, "true": nil, "type": nil, "uname": nil, "uniq": nil,
+	"uptime": nil, "vmstat": nil, "w": nil, "wc": nil, "whereis": nil,
+	"which": nil, "who": nil, "whoami": nil, "zcat": nil, "zgrep": nil,
+
+	"awk":   awkReadOnly,
+	"sed":   sedReadOnly,
+	"sort":  sortReadOnly,
+	"date":  dateReadOnly,
+	"find":  without("-delete", "-exec", "-execdir", "-ok", "-okdir", "-fprint", "-fprint0", "-fprintf", "-fls"),
+	"dmesg": without("-c", "-C", "--clear", "--read-clear", "-n", "--console-level", "-D", "-E"),
+	"journalctl": without("--vacuum-size", "--vacuum-time", "--vacuum-files",
+		"--rotate", "--flush", "--sync", "--relinquish-var", "--setup-keys", "--update-catalog"),
+	"sysctl": func(args []string) bool {
+		return none(args, "-w", "--write", "-p", "--load", "--system") && !anyContains(args, "=")
+	},
+	"mount":    noArgs,
+	"env":      noArgs,
+	"hostname": hostnameReadOnly,
+	"crontab":  func(args []string) bool { return len(args) == 1 && args[0] == "-l" },
+	"iptables": func(args []string) bool {
+		return hasAny(args, "-L", "--list", "-S", "--list-rules") && none(args, "-F", "--flush", "-Z", "--zero")
+	},
+
+	"systemctl":   subcommand("status", "show", "cat", "list-units", "list-unit-files", "list-timers", "list-sockets", "list-dependencies", "is-active", "is-enabled", "is-failed", "--failed"),
+	"hostnamectl": subcommand("", "status"),
+	"timedatectl": subcommand("", "status", "show", "list-timezones"),
+	"ip":          ipReadOnly,
+	"nft":         subcommand("list"),
+	"docker":      subcommand("ps", "images", "inspect", "logs", "stats", "top", "version", "info", "port", "diff"),
+	"podman":      subcommand("ps", "images", "inspect", "logs", "stats", "top", "version", "info", "port", "diff"),
+	"kubectl":     subcommand("get", "describe", "logs", "top", "version", "explain", "api-resources", "api-versions", "cluster-info", "events"),
+	"git":         gitReadOnly,
+	"apt":         subcommand("list", "show", "search", "policy", "depends", "rdepends"),
+	"apt-cache":   nil,
+	"dpkg":        subcommand("-l", "--list", "-L", "--listfiles", "-s", "--status", "-S", "--search", "--get-selections", "--print-architecture"),
+	"dpkg-query":  nil,
+	"rpm":         func(args []string) bool { return len(args) > 0 && strings.HasPrefix(args[0], "-q") },
+	"dnf":         subcommand("list", "info", "search", "repolist", "check-update", "provides", "repoquery", "history"),
+	"yum":         subcommand("list", "info", "search", "repolist", "check-update", "provides", "history"),
+	"apk":         subcommand("info", "search", "list", "policy", "version"),
+	"pacman":      func(args []string) bool { return len(args) > 0 && strings.HasPrefix(args[0], "-Q") },
+}
+
+// wrappers run the command given in their arguments; the wrapped command is
+// classified instead.
+var wrappers = map[string]int{"sudo": 0, "nice": 0, "nohup": 0, "time": 0, "timeout": 1, "stdbuf": 0, "ionice": 0}
+
+// harmlessRedirect matches redirections that do not write to a file.
+var harmlessRedirect = regexp.MustCompile(`\d?>&\d|&?\d?>\s*/dev/null`)
+
+// ReadOnlyCommand reports whether a shell command only inspects the host. It
+// errs on the side of caution: every command of a pipeline or list must be
+// known to be read-only, and file redirections, command substitution and
+// unknown programs make the whole command mutating.
+func ReadOnlyCommand(command string) bool {
+	command = harmlessRedirect.ReplaceAllString(command, "")
+	if strings.TrimSpace(command) == "" || strings.ContainsAny(command, "`>") ||
+		strings.Contains(command, "$(") || strings.Contains(command, "<(") {
+		return false
+	}
+	commands, ok := splitCommands(command)
+	if !ok {
+		return false
+	}
+	for _, words := range commands {
+		if len(words) > 0 && !readOnlySimpleCommand(words) {
+			return false
+		}
+	}
+	return true
+}
+
+// splitCommands splits a shell command list into the words of its simple
+// commands, honouring quotes and backslashes so that a separator inside a
+// quoted argument does not start a new command. It fails on an unterminated
+// quote.
+func splitCommands(command string) ([][]string, bool) {
+	var (
+		commands [][]string
+		words    []string
+		word     strings.Builder
+		inWord   bool
+	)
+	endWord := func() {
+		if inWord {
+			words = append(words, word.String())
+			word.Reset()
+			inWord = false
+		}
+	}
+	for i := 0; i < len(command); i++ {
+		c := command[i]
+		switch {
+		case c == '\\':
+			if i++; i < len(command) && command[i] != '\n' {
+				word.WriteByte(command[i])
+			}
+			inWord = true
+		case c == '\'':
+			end := strings.IndexByte(command[i+1:], '\'')
+			if end < 0 {
+				return nil, false
+			}
+			word.WriteString(command[i+1 : i+1+end])
+			i += end + 1
+			inWord = true
+		case c == '"':
+			for i++; i < len(command) && command[i] != '"'; i++ {
+				if command[i] == '\\' && i+1 < len(command) && strings.IndexByte("\\\"$`", command[i+1]) >= 0 {
+					i++
+				}
+				word.WriteByte(command[i])
+			}
+			if i >= len(command) {
+				return nil, false
+			}
+			inWord = true
+		case c == ' ' || c == '\t':
+			endWord()
+		case c == ';' || c == '&' || c == '|' || c == '\n':
+			endWord()
+			commands = append(commands, words)
+			words = nil
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+	endWord()
+	return append(commands, words), true
+}
+
+func readOnlySimpleCommand(words []string) bool {
+	// Leading variable assignments are allowed only for locale and display
+	// settings; others, like LD_PRELOAD or GIT_EXTERNAL_DIFF, can run code.
+	for len(words) > 0 && strings.Contains(words[0], "=") && !strings.HasPrefix(words[0], "-") {
+		if name, _, _ := strings.Cut(words[0], "="); !safeVariable(name) {
+			return false
+		}
+		words = words[1:]
+	}
+	for len(words) > 0 {
+		skip, ok := wrappers[path.Base(words[0])]
+		if !ok {
+			break
+		}
+		words = words[1:]
+		for len(words) > 0 && strings.HasPrefix(words[0], "-") {
+			words = words[1:]
+		}
+		if skip > 0 && len(words) >= skip {
+			words = words[skip:]
+		}
+	}
+	if len(words) == 0 {
+		return false
+	}
+
+	check, ok := readOnlyCommands[path.Base(words[0])]
+	if !ok {
+		return false
+	}
+	return check == nil || check(words[1:])
+}
+
+func safeVariable(name string) bool {
+	return name == "LANG" || name == "TZ" || name == "COLUMNS" || strings.HasPrefix(name, "LC_")
+}
+
+func noArgs(args []string) bool { return len(args) == 0 }
+
+func without(flags ...string) func([]string) bool {
+	return func(args []string) bool { return none(args, flags...) }
+}
+
+// subcommand allows the listed subcommands only; "" allows no subcommand.
+// Options before the subcommand are skipped.
+func subcommand(allowed ...string) func([]string) bool {
+	return func(args []string) bool {
+		sub := ""
+		for _, a := range args {
+			if !strings.HasPrefix(a, "-") || hasAny([]string{a}, allowed...) {
+				sub = a
+				break
+			}
+		}
+		return hasAny([]string{sub}, allowed...)
+	}
+}
+
+var gitSubcommands = subcommand("status", "log", "diff", "show", "rev-parse", "describe", "blame", "ls-files")
+
+// gitReadOnly also rejects --output, which log, diff and show write to.
+func gitReadOnly(args []string) bool { return gitSubcommands(args) && none(args, "--output") }
+
+func hostnameReadOnly(args []string) bool {
+	for _, a := range args {
+		if !strings.HasPrefix(a, "-") {
+			return false
+		}
+	}
+	return none(args, "-F", "--file", "-b", "--boot")
+}
+
+// dateReadOnly rejects setting the clock, with -s or with a MMDDhhmm operand.
+// Only a +FORMAT operand is allowed besides the values of -d and -r.
+func dateReadOnly(args []string) bool {
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		switch {
+		case a == "-d" || a == "--date" || a == "-r" || a == "--reference":
+			i++
+		case strings.HasPrefix(a, "--"):
+			if strings.HasPrefix(a, "--set") {
+				return false
+			}
+		case strings.HasPrefix(a, "-"):
+			if strings.ContainsAny(a, "s") {
+				return false
+			}
+		case !strings.HasPrefix(a, "+"):
+			return false
+		}
+	}
+	return true
+}
+
+// sortReadOnly rejects writing the output to a file, including forms like
+// -o/tmp/x and -uo x, and running a compression program.
+func sortReadOnly(args []string) bool {
+	for _, a := range args {
+		if strings.HasPrefix(a, "--") {
+			if strings.HasPrefix(a, "--output") || strings.HasPrefix(a, "--compress-program") {
+				return false
+			}
+		} else if strings.HasPrefix(a, "-") && strings.Contains(a, "o") {
+			return false
+		}
+	}
+	return true
+}
+
+// sedReadOnly rejects in-place editing, including forms like -i.bak and -ni,
+// script files, and scripts that write files or run commands.
+func sedReadOnly(args []string) bool {
+	var scripts, operands []string
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		switch {
+		case a == "--":
+			operands = append(operands, args[i+1:]...)
+			i = len(args)
+		case strings.HasPrefix(a, "--in-place") || strings.HasPrefix(a, "--file"):
+			return false
+		case a == "--expression":
+			if i++; i < len(args) {
+				scripts = append(scripts, args[i])
+			}
+		case strings.HasPrefix(a, "--expression="):
+			scripts = append(scripts, strings.TrimPrefix(a, "--expression="))
+		case strings.HasPrefix(a, "--") || a == "-":
+			operands = append(operands, a)
+		case strings.HasPrefix(a, "-"):
+			for j := 1; j < len(a); j++ {
+				switch a[j] {
+				case 'i', 'f':
+					return false
+				case 'e', 'l':
+					value := a[j+1:]
+					if value == "" && i+1 < len(args) {
+						i++
+						value = args[i]
+					}
+					if a[j] == 'e' {
+						scripts = append(scripts, value)
+					}
+					j = len(a)
+				}
+			}
+		default:
+			operands = append(operands, a)
+		}
+	}
+	if len(scripts) == 0 {
+		if len(operands) == 0 {
+			return false
+		}
+		scripts = operands[:1]
+	}
+	for _, script := range scripts {
+		if !sedScriptReadOnly(script) {
+			return false
+		}
+	}
+	return true
+}
+
+// sedScriptReadOnly parses a sed script far enough to find the commands and
+// s/// flags that read or write files or run commands: r, R, w, W and e.
+// Anything it does not understand makes the script mutating.
+func sedScriptReadOnly(script string) bool {
+	p := sedParser{s: script}
+	for {
+		p.skip(" \t\n;")
+		if p.done() {
+			return true
+		}
+		if !p.address() {
+			return false
+		}
+		p.skip(" \t")
+		for p.peek() == '!' {
+			p.i++
+			p.skip(" \t")
+		}
+		if p.done() {
+			return false
+		}
+		c := p.s[p.i]
+		p.i++
+		switch c {
+		case '{', '}', '=', 'd', 'D', 'g', 'G', 'h', 'H', 'n', 'N', 'p', 'P', 'x', 'z', 'F':
+		case 'q', 'Q', 'l', 'L':
+			p.skip(" \t0123456789")
+		case '#', 'a', 'i', 'c':
+			p.toEndOfLine()
+		case ':', 'b', 't', 'T', 'v':
+			for !p.done() && p.peek() != ';' && p.peek() != '\n' {
+				p.i++
+			}
+		case 'y':
+			if !p.delimited(2) {
+				return false
+			}
+		case 's':
+			if !p.delimited(2) {
+				return false
+			}
+			for !p.done() && strings.IndexByte(" \t\n;}", p.peek()) < 0 {
+				if strings.IndexByte("gpiImM0123456789", p.peek()) < 0 {
+					return false
+				}
+				p.i++
+			}
+		default:
+			return false
+		}
+	}
+}
+
+type sedParser struct {
+	s string
+	i int
+}
+
+func (p *sedParser) done() bool { return p.i >= len(p.s) }
+
+func (p *sedParser) peek() byte {
+	if p.done() {
+		return 0
+	}
+	return p.s[p.i]
+}
+
+func (p *sedParser) skip(chars string) {
+	for !p.done() && strings.IndexByte(chars, p.s[p.i]) >= 0 {
+		p.i++
+	}
+}
+
+func (p *sedParser) toEndOfLine() {
+	for ; !p.done() && p.s[p.i] != '\n'; p.i++ {
+		if p.s[p.i] == '\\' {
+			p.i++
+		}
+	}
+}
+
+// delimited consumes n parts closed by the delimiter at the current position,
+// as in the /regex/ and /replacement/ of an s command.
+func (p *sedParser) delimited(n int) bool {
+	if p.done() || p.peek() == '\n' || p.peek() == '\\' {
+		return false
+	}
+	delim := p.s[p.i]
+	p.i++
+	for ; n > 0; n-- {
+		for !p.done() && p.s[p.i] != delim {
+			if p.s[p.i] == '\\' {
+				p.i++
+			}
+			p.i++
+		}
+		if p.done() {
+			return false
+		}
+		p.i++
+	}
+	return true
+}
+
+// address consumes an optional address or address range.
+func (p *sedParser) address() bool {
+	for first := true; ; first = false {
+		switch c := p.peek(); {
+		case c >= '0' && c <= '9', c == '+' || c == '~':
+			p.skip("+~0123456789")
+		case c == '$':
+			p.i++
+		case c == '/':
+			if !p.delimited(1) {
+				return false
+			}
+			p.skip("IM")
+		case c == '\\':
+			p.i++
+			if !p.delimited(1) {
+				return false
+			}
+			p.skip("IM")
+		}
+		p.skip(" \t")
+		if !first || p.peek() != ',' {
+			return true
+		}
+		p.i++
+		p.skip(" \t")
+	}
+}
+
+// awkReadOnly rejects programs that run commands or pipe to them, program
+// files and extensions it cannot see into. Writing to a file needs ">", which
+// ReadOnlyCommand already rejects.
+func awkReadOnly(args []string) bool {
+	if anyContains(args, "system") || anyContains(args, "getline") || anyContains(args, "|") {
+		return false
+	}
+	for _, a := range args {
+		if hasAny([]string{a}, "--file", "--exec", "--include", "--load") ||
+			strings.HasPrefix(a, "-f") || strings.HasPrefix(a, "-E") || strings.HasPrefix(a, "-i") || strings.HasPrefix(a, "-l") {
+			return false
+		}
+	}
+	return true
+}
+
+func ipReadOnly(args []string) bool {
+	for _, a := range args {
+		switch a {
+		case "add", "del", "delete", "deleteall", "set", "flush", "change", "replace", "append", "prepend", "exec", "save", "restore":
+			return false
+		}
+		// ip takes any abbreviation of -batch, with one or two dashes, for a
+		// file of commands to run.
+		if opt := strings.TrimLeft(a, "-"); opt != a && opt != "" && strings.HasPrefix("batch", opt) {
+			return false
+		}
+	}
+	return true
+}
+
+func hasAny(args []string, values ...string) bool {
+	for _, a := range args {
+		for _, v := range values {
+			if a == v || strings.HasPrefix(a, v+"=") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func none(args []string, flags ...string) bool { return !hasAny(args, flags...) }
+
+func anyContains(args []string, s string) bool {
+	for _, a := range args {
+		if strings.Contains(a, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,93 @@
+package tools
+
+import "testing"
+
+func TestReadOnlyCommand(t *testing.T) {
+	tests := []struct {
+		command  string
+		readOnly bool
+	}{
+		{"uptime", true},
+		{"df -h && free -m", true},
+		{"ps aux | grep nginx | head -5", true},
+		{"journalctl -u nginx --since today 2>&1", true},
+		{"cat /etc/hosts > /dev/null", true},
+		{"systemctl status nginx", true},
+		{"sudo -n systemctl status nginx", true},
+		{"grep 'a;b' /etc/hosts", true},
+		{"date", true},
+		{"date +%s", true},
+		{"date -u -d '1 day ago' +%F", true},
+		{"sed -n 1,5p /etc/hosts", true},
+		{"sed 's/a/b/g' f", true},
+		{"sed -n '/^root/,/^$/ p' /etc/passwd", true},
+		{"sed -e 's|a|b|2' -e '$d' f", true},
+		{"sed '/x/I!d;y/abc/xyz/' f", true},
+		{"sort -rn -k2 f", true},
+		{"find /var/log -name '*.gz' -print0", true},
+		{"git diff --stat", true},
+		{"awk -F: '{print $1}' /etc/passwd", true},
+		{"LANG=C LC_ALL=C TZ=UTC df -h", true},
+		{"ip -br addr show", true},
+		{"ip route show table main", true},
+
+		{"", false},
+		{"rm -rf /tmp/x", false},
+		{"cat /etc/hosts > /tmp/x", false},
+		{"echo $(touch /tmp/x)", false},
+		{"echo `touch /tmp/x`", false},
+		{"cat <(touch /tmp/pwn)", false},
+		{"diff >(touch /tmp/pwn) f", false},
+		{"uptime; reboot", false},
+		{"grep 'a;b' f; touch x", false},
+		{"grep 'unterminated f", false},
+		{"systemctl restart nginx", false},
+		{"date -s 2020-01-01", false},
+		{"date --set=2020-01-01", false},
+		{"date -us 2020-01-01", false},
+		{"date 010100002020", false},
+		{"sed -i 's/a/b/' f", false},
+		{"sed -ni.bak p f", false},
+		{"sed --in-place 's/a/b/' f", false},
+		{"sed -f script.sed f", false},
+		{"sed -n 'w /etc/x' f", false},
+		{"sed 's/a/b/;w /etc/x' f", false},
+		{"sed '1W /etc/x' f", false},
+		{"sed 's/a/b/e' f", false},
+		{"sed 's/a/b/gw /etc/x' f", false},
+		{"sed 'e touch /tmp/x' f", false},
+		{"sed -e p -e 'r /etc/shadow' f", false},
+		{"sed '/x/{R /etc/shadow\n}' f", false},
+		{"sed --expression='$!w /etc/x' f", false},
+		{"find / -fprint0 /tmp/x", false},
+		{"find / -name x -delete", false},
+		{"find / -exec rm {} ;", false},
+		{"git diff --output=/etc/x", false},
+		{"git diff --output /etc/x", false},
+		{"git -c core.pager=sh log", false},
+		{"git push", false},
+		{"sort -o/tmp/x f", false},
+		{"sort -o /tmp/x f", false},
+		{"sort -uo /tmp/x f", false},
+		{"sort --output=/tmp/x f", false},
+		{"sort --compress-program=sh f", false},
+		{`awk '{print "rm -rf /x" | "sh"}' f`, false},
+		{`awk 'BEGIN {"date" | getline d}'`, false},
+		{`awk 'BEGIN {system("reboot")}'`, false},
+		{"awk -f prog.awk f", false},
+		{"awk -l ext f", false},
+		{"LD_PRELOAD=/tmp/x.so cat f", false},
+		{"GIT_EXTERNAL_DIFF=/tmp/x git diff", false},
+		{"LANG=C PATH=/tmp cat f", false},
+		{"ip -batch f", false},
+		{"ip -b f", false},
+		{"ip --batch f", false},
+		{"ip route prepend default via 10.0.0.1", false},
+		{"ip neigh deleteall", false},
+	}
+	for _, tt := range tests {
+		if got := ReadOnlyCommand(tt.command); got != tt.readOnly {
+			t.Errorf("ReadOnlyCommand(%q) = %v, want %v", tt.command, got, tt.readOnly)
+		}
+	}
+}
@@ -10,8 +10,9 @@ type ReportArgs struct {
 }
 type Report struct{}
 
-func (a Report) Name() string        { return "report" }
-func (a Report) Description() string { return "Provides final answer to user" }
+func (a Report) Name() string                  { return "report" }
+func (a Report) Mutating(json.RawMessage) bool { return false }
+func (a Report) Description() string           { return "Provides final answer to user" }
 func (a Report) Schema() map[string]any {
 	return map[string]any{
 		"type": "object",
@@ -0,0 +1,254 @@
+package tools
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/quniob/shellm/config"
+)
+
+const (
+	defaultJournalLines = 50
+	maxJournalLines     = 500
+)
+
+// serviceProperties are read with systemctl show for the status of a unit.
+var serviceProperties = []string{
+	"Id", "Description", "LoadState", "ActiveState", "SubState", "UnitFileState",
+	"MainPID", "MemoryCurrent", "ActiveEnterTimestamp", "NRestarts", "ExecMainStatus", "Result", "FragmentPath",
+}
+
+// serviceActions change the state of a unit and are classified as mutating.
+var serviceActions = map[string]bool{
+	"start": true, "stop": true, "restart": true, "reload": true, "enable": true, "disable": true,
+}
+
+type ServiceArgs struct {
+	HostID string `json:"host_id"`
+	Action string `json:"action"`
+	Unit   string `json:"unit"`
+	Lines  int    `json:"lines"`
+}
+
+type Service struct {
+	HostsData *config.Hosts
+}
+
+func (Service) Name() string { return "service" }
+func (Service) Description() string {
+	return "Manages systemd services on a host and returns JSON. Actions: list (units, optionally filtered by a unit pattern such as 'nginx*'), " +
+		"status (active and sub state, PID, memory, since, enabled state), journal (recent log lines of the unit), " +
+		"and start, stop, restart, reload, enable, disable, which return the status afterwards."
+}
+func (Service) Schema() map[string]any {
+	return map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"host_id": map[string]any{"type": "string"},
+			"action": map[string]any{
+				"type": "string",
+				"enum": []string{"list", "status", "journal", "start", "stop", "restart", "reload", "enable", "disable"},
+			},
+			"unit":  map[string]any{"type": "string", "description": "unit name, e.g. nginx or nginx.service; a pattern for list"},
+			"lines": map[string]any{"type": "integer", "description": fmt.Sprintf("journal lines to return (default %d, max %d)", defaultJournalLines, maxJournalLines)},
+		},
+		"required": []string{"host_id", "action"},
+	}
+}
+
+func (Service) Mutating(raw json.RawMessage) bool {
+	var args ServiceArgs
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return true
+	}
+	return serviceActions[args.Action]
+}
+
+func (Service) Preview(raw json.RawMessage) string {
+	var args ServiceArgs
+	json.Unmarshal(raw, &args)
+	return fmt.Sprintf("would %s %s on %s", args.Action, args.Unit, args.HostID)
+}
+
+type ServiceUnit struct {
+	Unit        string `json:"unit"`
+	Load        string `json:"load"`
+	Active      string `json:"active"`
+	Sub         string `json:"sub"`
+	Description string `json:"description"`
+}
+
+type ServiceStatus struct {
+	Unit        string `json:"unit"`
+	Description string `json:"description,omitempty"`
+	LoadState   string `json:"load_state"`
+	ActiveState string `json:"active_state"`
+	SubState    string `json:"sub_state"`
+	Enabled     string `json:"enabled,omitempty"`
+	PID         int    `json:"pid,omitempty"`
+	MemoryMB    int64  `json:"memory_mb,omitempty"`
+	Since       string `json:"since,omitempty"`
+	Restarts    int    `json:"restarts,omitempty"`
+	ExitStatus  int    `json:"exit_status,omitempty"`
+	Result      string `json:"result,omitempty"`
+	Path        string `json:"path,omitempty"`
+}
+
+type serviceActionResult struct {
+	Action string        `json:"action"`
+	OK     bool          `json:"ok"`
+	Output string        `json:"output,omitempty"`
+	Status ServiceStatus `json:"status"`
+}
+
+type serviceJournal struct {
+	Unit  string   `json:"unit"`
+	Lines []string `json:"lines"`
+}
+
+func (s Service) Call(ctx context.Context, raw json.RawMessage) (string, error) {
+	var args ServiceArgs
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return "", err
+	}
+	host := s.HostsData.Hosts[args.HostID]
+	if host.ID == "" {
+		return "", fmt.Errorf("Host with ID '%s' does not exist", args.HostID)
+	}
+	if args.Unit == "" && args.Action != "list" {
+		return "", fmt.Errorf("action '%s' needs a unit", args.Action)
+	}
+
+	var result any
+	var err error
+	switch {
+	case args.Action == "list":
+		result, err = s.list(ctx, host, args.Unit)
+	case args.Action == "status":
+		result, err = s.status(ctx, host, args.Unit)
+	case args.Action == "journal":
+		result, err = s.journal(ctx, host, args.Unit, args.Lines)
+	case serviceActions[args.Action]:
+		result, err = s.act(ctx, host, args.Action, args.Unit)
+	default:
+		return "", fmt.Errorf("unknown action '%s'", args.Action)
+	}
+	if err != nil {
+		return "", errors.New(s.HostsData.Mask(err.Error()))
+	}
+
+	out, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return s.HostsData.Mask(string(out)), nil
+}
+
+func (s Service) run(ctx context.Context, host config.Host, command string) (string, error) {
+	return ExecuteCommand{HostsData: s.HostsData}.Run(ctx, host, command)
+}
+
+func (s Service) list(ctx context.Context, host config.Host, pattern string) ([]ServiceUnit, error) {
+	command := "systemctl list-units --type=service --all --no-legend --no-pager --plain"
+	if pattern != "" {
+		command += " " + shellQuote(pattern)
+	}
+	out, err := s.run(ctx, host, command)
+	if err != nil {
+		return nil, err
+	}
+
+	units := []ServiceUnit{}
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(strings.TrimLeft(scanner.Text(), "●* "))
+		if len(fields) < 4 {
+			continue
+		}
+		units = append(units, ServiceUnit{
+			Unit:        fields[0],
+			Load:        fields[1],
+			Active:      fields[2],
+			Sub:         fields[3],
+			Description: strings.Join(fields[4:], " "),
+		})
+	}
+	return units, nil
+}
+
+func statusCommand(unit string) string {
+	return "systemctl show --no-pager -p " + strings.Join(serviceProperties, ",") + " " + shellQuote(unit)
+}
+
+func (s Service) status(ctx context.Context, host config.Host, unit string) (ServiceStatus, error) {
+	out, err := s.run(ctx, host, statusCommand(unit))
+	if err != nil {
+		return ServiceStatus{}, err
+	}
+	return parseServiceStatus(out), nil
+}
+
+func (s Service) journal(ctx context.Context, host config.Host, unit string, lines int) (serviceJournal, error) {
+	if lines <= 0 {
+		lines = defaultJournalLines
+	}
+	lines = min(lines, maxJournalLines)
+	out, err := s.run(ctx, host, privileged(fmt.Sprintf("journalctl --no-pager -o short-iso -n %d -u %s", lines, shellQuote(unit))))
+	if err != nil {
+		return serviceJournal{}, err
+	}
+	return serviceJournal{Unit: unit, Lines: strings.Split(strings.TrimRight(out, "\n"), "\n")}, nil
+}
+
+// act runs a state-changing action and reads the status afterwards, so that
+// a failed start still reports why the unit is down.
+func (s Service) act(ctx context.Context, host config.Host, action, unit string) (serviceActionResult, error) {
+	command := privileged("systemctl "+action+" "+shellQuote(unit)) + " 2>&1; echo \"### rc=$?\"; " + statusCommand(unit)
+	out, err := s.run(ctx, host, command)
+	if err != nil {
+		return serviceActionResult{}, err
+	}
+
+	output, status, _ := strings.Cut(out, "### rc=")
+	rc, status, _ := strings.Cut(status, "\n")
+	return serviceActionResult{
+		Action: action,
+		OK:     strings.TrimSpace(rc) == "0",
+		Output: strings.TrimSpace(output),
+		Status: parseServiceStatus(status),
+	}, nil
+}
+
+func parseServiceStatus(out string) ServiceStatus {
+	props := map[string]string{}
+	for _, line := range strings.Split(out, "\n") {
+		if k, v, ok := strings.Cut(strings.TrimSpace(line), "="); ok {
+			props[k] = v
+		}
+	}
+
+	status := ServiceStatus{
+		Unit:        props["Id"],
+		Description: props["Description"],
+		LoadState:   props["LoadState"],
+		ActiveState: props["ActiveState"],
+		SubState:    props["SubState"],
+		Enabled:     props["UnitFileState"],
+		Since:       props["ActiveEnterTimestamp"],
+		Result:      props["Result"],
+		Path:        props["FragmentPath"],
+	}
+	status.PID, _ = strconv.Atoi(props["MainPID"])
+	status.Restarts, _ = strconv.Atoi(props["NRestarts"])
+	status.ExitStatus, _ = strconv.Atoi(props["ExecMainStatus"])
+	// MemoryCurrent is "[not set]" or the maximum uint64 when accounting is off.
+	if mem, err := strconv.ParseUint(props["MemoryCurrent"], 10, 64); err == nil && mem < 1<<62 {
+		status.MemoryMB = int64(mem / (1 << 20))
+	}
+	return status
+}
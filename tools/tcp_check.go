@@ -0,0 +1,127 @@
+package tools
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/quniob/shellm/config"
+)
+
+type TCPCheckArgs struct {
+	HostID     string `json:"host_id"`
+	Host       string `json:"host"`
+	Port       int    `json:"port"`
+	TLS        bool   `json:"tls"`
+	ServerName string `json:"server_name"`
+	Timeout    int    `json:"timeout"`
+}
+
+type TCPCheck struct {
+	HostsData *config.Hosts
+}
+
+func (TCPCheck) Name() string                  { return "tcp_check" }
+func (TCPCheck) Mutating(json.RawMessage) bool { return false }
+func (TCPCheck) Description() string {
+	return "Connects to host:port and returns JSON with whether it connected and how long it took. With tls it also makes a TLS handshake and reports " +
+		"the version, whether the certificate verifies for the name, and the subject, issuer and expiry (days left) of each certificate in the chain. " +
+		"Set host_id to connect from an inventory host instead of locally."
+}
+func (TCPCheck) Schema() map[string]any {
+	return map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"host_id":     map[string]any{"type": "string", "description": "inventory host to connect from; omit to connect locally"},
+			"host":        map[string]any{"type": "string", "description": "name or IP address to connect to"},
+			"port":        map[string]any{"type": "integer"},
+			"tls":         map[string]any{"type": "boolean", "description": "make a TLS handshake after connecting"},
+			"server_name": map[string]any{"type": "string", "description": "name sent with SNI and verified (default host)"},
+			"timeout":     map[string]any{"type": "integer", "description": fmt.Sprintf("seconds (default %d, max %d)", defaultCheckTimeout, maxCheckTimeout)},
+		},
+		"required": []string{"host", "port"},
+	}
+}
+
+type tcpCheckResult struct {
+	From       string   `json:"from"`
+	Address    string   `json:"address"`
+	Connected  bool     `json:"connected"`
+	ConnectMS  float64  `json:"connect_ms,omitempty"`
+	RemoteAddr string   `json:"remote_addr,omitempty"`
+	TLS        *TLSInfo `json:"tls,omitempty"`
+	Error      string   `json:"error,omitempty"`
+}
+
+func (t TCPCheck) Call(ctx context.Context, raw json.RawMessage) (string, error) {
+	var args TCPCheckArgs
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return "", err
+	}
+	if args.Host == "" || args.Port <= 0 || args.Port > 65535 {
+		return "", fmt.Errorf("a host and a port between 1 and 65535 are required")
+	}
+	host := t.HostsData.Unmask(args.Host)
+
+	o, err := newOrigin(t.HostsData, args.HostID)
+	if err != nil {
+		return "", err
+	}
+	defer o.Close()
+	ctx, cancel := checkContext(ctx, args.Timeout)
+	defer cancel()
+
+	result := t.check(ctx, o, host, args)
+	out, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return t.HostsData.Mask(string(out)), nil
+}
+
+func (t TCPCheck) check(ctx context.Context, o *origin, host string, args TCPCheckArgs) tcpCheckResult {
+	result := tcpCheckResult{From: o.Name(), Address: net.JoinHostPort(host, strconv.Itoa(args.Port))}
+
+	start := time.Now()
+	conn, err := o.DialContext(ctx, "tcp", result.Address)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer conn.Close()
+	result.Connected = true
+	result.ConnectMS = millis(time.Since(start))
+	// Over SSH the address is resolved by the host and not known here.
+	if !o.Remote() {
+		result.RemoteAddr = conn.RemoteAddr().String()
+	}
+	if !args.TLS {
+		return result
+	}
+
+	serverName := t.HostsData.Unmask(args.ServerName)
+	if serverName == "" {
+		serverName = host
+	}
+	// The chain is verified after the handshake so that an expired or
+	// mismatched certificate is still described.
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+	start = time.Now()
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		result.Error = "TLS handshake: " + err.Error()
+		return result
+	}
+	state := tlsConn.ConnectionState()
+	result.TLS = tlsInfo(state)
+	result.TLS.HandshakeMS = millis(time.Since(start))
+	if err := verifyChain(state, serverName); err != nil {
+		result.TLS.VerifyError = err.Error()
+	} else {
+		result.TLS.Verified = true
+	}
+	return result
+}
@@ -3,7 +3,9 @@ package tools
 import (
 	"context"
 	"encoding/json"
-	"github.com/openai/openai-go/v2"
+	"fmt"
+
+	"github.com/quniob/shellm/config"
 )
 
 type Tool interface {
@@ -13,6 +15,47 @@ type Tool interface {
 	Call(ctx context.Context, raw json.RawMessage) (string, error)
 }
 
+// Classifier is implemented by tools that can tell whether a particular call
+// may change state on a host. Tools that do not implement it are treated as
+// mutating.
+type Classifier interface {
+	Mutating(raw json.RawMessage) bool
+}
+
+func IsMutating(t Tool, raw json.RawMessage) bool {
+	if c, ok := t.(Classifier); ok {
+		return c.Mutating(raw)
+	}
+	return true
+}
+
+// Previewer is implemented by tools that can describe what a call would do,
+// used in dry-run mode instead of making the call.
+type Previewer interface {
+	Preview(raw json.RawMessage) string
+}
+
+// Preview describes a call without making it.
+func Preview(t Tool, raw json.RawMessage) string {
+	if p, ok := t.(Previewer); ok {
+		return p.Preview(raw)
+	}
+	return fmt.Sprintf("would call %s(%s)", t.Name(), raw)
+}
+
+// Approver is implemented by tools some of whose calls must be approved by
+// the operator before they are made.
+type Approver interface {
+	NeedsApproval(raw json.RawMessage) bool
+}
+
+func NeedsApproval(t Tool, raw json.RawMessage) bool {
+	if a, ok := t.(Approver); ok {
+		return a.NeedsApproval(raw)
+	}
+	return false
+}
+
 type Registry struct{ m map[string]Tool }
 
 func NewRegistry(tools ...Tool) *Registry {
@@ -22,20 +65,36 @@ func NewRegistry(tools ...Tool) *Registry {
 	}
 	return r
 }
+
+// NewDefaultRegistry returns a registry with every built-in tool wired to
+// the given inventory.
+func NewDefaultRegistry(hosts *config.Hosts) *Registry {
+	return NewRegistry(
+		Report{},
+		Ping{HostsData: hosts},
+		GetHosts{HostsData: hosts},
+		ExecuteCommand{HostsData: hosts},
+		GetHostFacts{HostsData: hosts},
+		Service{HostsData: hosts},
+		Packages{HostsData: hosts},
+		SearchLogs{HostsData: hosts},
+		HostMetrics{HostsData: hosts},
+		Containers{HostsData: hosts},
+		Kubectl{HostsData: hosts},
+		DNSLookup{HostsData: hosts},
+		TCPCheck{HostsData: hosts},
+		HTTPCheck{HostsData: hosts},
+		Traceroute{HostsData: hosts},
+	)
+}
+
 func (r *Registry) Get(name string) (Tool, bool) { t, ok := r.m[name]; return t, ok }
 
-func (r *Registry) Tools() []openai.ChatCompletionToolUnionParam {
-	out := make([]openai.ChatCompletionToolUnionParam, 0, len(r.m))
+// List returns every registered tool.
+func (r *Registry) List() []Tool {
+	out := make([]Tool, 0, len(r.m))
 	for _, t := range r.m {
-		out = append(out, openai.ChatCompletionToolUnionParam{
-			OfFunction: &openai.ChatCompletionFunctionToolParam{
-				Function: openai.FunctionDefinitionParam{
-					Name:        t.Name(),
-					Description: openai.String(t.Description()),
-					Parameters:  t.Schema(),
-				},
-			},
-		})
+		out = append(out, t)
 	}
 	return out
 }
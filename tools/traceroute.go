@@ -0,0 +1,182 @@
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/quniob/shellm/config"
+)
+
+const (
+	defaultMaxHops = 20
+	maxMaxHops     = 64
+)
+
+// tracerouteScript uses traceroute, or tracepath where it is missing. Unlike
+// traceroute, tracepath does not print the address it traces to, so the
+// target is resolved on the origin first.
+const tracerouteScript = `command -v traceroute >/dev/null 2>&1 && exec traceroute -n -q 2 -w 2 -m %[1]d %[2]s 2>&1
+command -v tracepath >/dev/null 2>&1 && {
+  getent ahosts %[2]s 2>/dev/null | awk 'NR == 1 { print "destination", $1 }'
+  exec tracepath -n -m %[1]d %[2]s 2>&1
+}
+echo 'neither traceroute nor tracepath is installed' >&2; exit 127`
+
+type TracerouteArgs struct {
+	HostID  string `json:"host_id"`
+	Target  string `json:"target"`
+	MaxHops int    `json:"max_hops"`
+	Timeout int    `json:"timeout"`
+}
+
+type Traceroute struct {
+	HostsData *config.Hosts
+}
+
+func (Traceroute) Name() string                  { return "traceroute" }
+func (Traceroute) Mutating(json.RawMessage) bool { return false }
+func (Traceroute) Description() string {
+	return "Traces the route to a target and returns JSON hops with their addresses, round-trip times and timed-out probes, and whether the target was reached. " +
+		"Set host_id to trace from an inventory host instead of locally."
+}
+func (Traceroute) Schema() map[string]any {
+	return map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"host_id":  map[string]any{"type": "string", "description": "inventory host to trace from; omit to trace locally"},
+			"target":   map[string]any{"type": "string", "description": "name or IP address"},
+			"max_hops": map[string]any{"type": "integer", "description": fmt.Sprintf("default %d, max %d", defaultMaxHops, maxMaxHops)},
+			"timeout":  map[string]any{"type": "integer", "description": fmt.Sprintf("seconds (default and max %d)", maxCheckTimeout)},
+		},
+		"required": []string{"target"},
+	}
+}
+
+type TraceHop struct {
+	Hop       int       `json:"hop"`
+	Addresses []string  `json:"addresses,omitempty"`
+	RTTMS     []float64 `json:"rtt_ms,omitempty"`
+	Timeouts  int       `json:"timeouts,omitempty"`
+}
+
+type tracerouteResult struct {
+	From        string     `json:"from"`
+	Target      string     `json:"target"`
+	Destination string     `json:"destination,omitempty"`
+	Reached     bool       `json:"reached"`
+	Hops        []TraceHop `json:"hops"`
+}
+
+func (t Traceroute) Call(ctx context.Context, raw json.RawMessage) (string, error) {
+	var args TracerouteArgs
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return "", err
+	}
+	target := t.HostsData.Unmask(args.Target)
+	if target == "" || strings.HasPrefix(target, "-") {
+		return "", fmt.Errorf("invalid target '%s'", args.Target)
+	}
+	hops := args.MaxHops
+	if hops <= 0 {
+		hops = defaultMaxHops
+	}
+	hops = min(hops, maxMaxHops)
+
+	// A trace takes long compared to the other checks, so it gets the most
+	// time unless told otherwise.
+	timeout := args.Timeout
+	if timeout <= 0 {
+		timeout = maxCheckTimeout
+	}
+
+	o, err := newOrigin(t.HostsData, args.HostID)
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel := checkContext(ctx, timeout)
+	defer cancel()
+	out, err := o.run(ctx, fmt.Sprintf(tracerouteScript, hops, shellQuote(target)))
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return "", fmt.Errorf("the trace did not finish within %d seconds; lower max_hops or raise timeout", min(timeout, maxCheckTimeout))
+	}
+	if err != nil {
+		return "", errors.New(t.HostsData.Mask(err.Error()))
+	}
+
+	result := parseTraceroute(out)
+	result.From, result.Target = o.Name(), target
+	if ip := net.ParseIP(target); ip != nil {
+		result.Destination = ip.String()
+	}
+	if n := len(result.Hops); n > 0 && result.Destination != "" {
+		for _, addr := range result.Hops[n-1].Addresses {
+			result.Reached = result.Reached || addr == result.Destination
+		}
+	}
+
+	resp, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return t.HostsData.Mask(string(resp)), nil
+}
+
+// parseTraceroute reads the output of traceroute -n or tracepath -n. A hop
+// printed on several lines is merged.
+func parseTraceroute(out string) tracerouteResult {
+	result := tracerouteResult{Hops: []TraceHop{}}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.Contains(line, "LOCALHOST") {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimRight(fields[0], "?:"))
+		if err != nil {
+			// The traceroute header names the destination address; for
+			// tracepath the script prints it.
+			if strings.HasPrefix(line, "traceroute to") {
+				if _, rest, ok := strings.Cut(line, "("); ok {
+					result.Destination, _, _ = strings.Cut(rest, ")")
+				}
+			}
+			if fields[0] == "destination" && len(fields) == 2 && net.ParseIP(fields[1]) != nil {
+				result.Destination = fields[1]
+			}
+			continue
+		}
+
+		if len(result.Hops) == 0 || result.Hops[len(result.Hops)-1].Hop != n {
+			result.Hops = append(result.Hops, TraceHop{Hop: n})
+		}
+		hop := &result.Hops[len(result.Hops)-1]
+		for i := 1; i < len(fields); i++ {
+			f := fields[i]
+			switch {
+			case f == "*" || f == "no":
+				hop.Timeouts++
+			case f == "reached":
+				// tracepath marks the hop that answered from the target.
+				result.Reached = true
+			case strings.HasSuffix(f, "ms") && f != "ms":
+				if rtt, err := strconv.ParseFloat(strings.TrimSuffix(f, "ms"), 64); err == nil {
+					hop.RTTMS = append(hop.RTTMS, rtt)
+				}
+			case i+1 < len(fields) && fields[i+1] == "ms":
+				if rtt, err := strconv.ParseFloat(f, 64); err == nil {
+					hop.RTTMS = append(hop.RTTMS, rtt)
+				}
+			case net.ParseIP(f) != nil:
+				if !slices.Contains(hop.Addresses, f) {
+					hop.Addresses = append(hop.Addresses, f)
+				}
+			}
+		}
+	}
+	return result
+}